@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/consensus"
+)
+
+// LedgerReader provides the ledger queries served by the API. The methods must be safe to call while the node is mining
+type LedgerReader interface {
+	GetBlock(hash []byte) (common.Block, bool)
+	GetMacroBlock(height int) ([]common.Block, bool)
+	Tip() (int, []byte)
+	FinalizedHeight() int
+	Orphans() []consensus.OrphanInfo
+}
+
+// Block is the JSON representation of a block. Hashes and keys are hex encoded, and the payload is omitted
+type Block struct {
+	Hash             string   `json:"hash"`
+	Issuer           string   `json:"issuer"`
+	PrevBlockHashes  []string `json:"prevBlockHashes"`
+	Height           int      `json:"height"`
+	Nonce            int64    `json:"nonce"`
+	Timestamp        int64    `json:"timestamp"`
+	Difficulty       int64    `json:"difficulty"`
+	PayloadSize      int      `json:"payloadSize"`
+	PayloadRoot      string   `json:"payloadRoot"`
+	Signature        string   `json:"signature"`
+	TransactionCount int      `json:"transactionCount"`
+}
+
+// MacroBlock is the JSON representation of a canonical macroblock. Its blocks are ordered by microblock index
+type MacroBlock struct {
+	Height int     `json:"height"`
+	Blocks []Block `json:"blocks"`
+}
+
+// Tip is the JSON representation of the canonical tip
+type Tip struct {
+	Height          int    `json:"height"`
+	Hash            string `json:"hash"`
+	FinalizedHeight int    `json:"finalizedHeight"`
+}
+
+// Orphan is the JSON representation of a block waiting for its parents
+type Orphan struct {
+	Hash           string    `json:"hash"`
+	Height         int       `json:"height"`
+	MissingParents []string  `json:"missingParents"`
+	Arrival        time.Time `json:"arrival"`
+}
+
+// Error is the JSON body of an error response
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Server serves read-only JSON queries over HTTP:
+//
+//	GET /block/{hash}        the block with the hex encoded hash
+//	GET /macroblock/{height} the canonical macroblock of the height
+//	GET /tip                 the canonical tip and the finalized height
+//	GET /orphans             the blocks waiting for their parents
+type Server struct {
+	ledger LedgerReader
+	mux    *http.ServeMux
+}
+
+// NewServer creates an API server querying the given ledger
+func NewServer(ledger LedgerReader) *Server {
+
+	s := &Server{ledger: ledger, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/block/", s.handleBlock)
+	s.mux.HandleFunc("/macroblock/", s.handleMacroBlock)
+	s.mux.HandleFunc("/tip", s.handleTip)
+	s.mux.HandleFunc("/orphans", s.handleOrphans)
+
+	return s
+}
+
+// ServeHTTP serves the API. Only GET requests are accepted
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET requests are accepted")
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+
+	hash, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/block/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "block hash is not hex encoded")
+		return
+	}
+
+	block, ok := s.ledger.GetBlock(hash)
+	if !ok {
+		writeError(w, http.StatusNotFound, "block is not found")
+		return
+	}
+
+	writeJSON(w, NewBlock(block))
+}
+
+func (s *Server) handleMacroBlock(w http.ResponseWriter, r *http.Request) {
+
+	height, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/macroblock/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "height is not a number")
+		return
+	}
+
+	blocks, ok := s.ledger.GetMacroBlock(height)
+	if !ok {
+		writeError(w, http.StatusNotFound, "canonical chain does not have a macroblock at the height")
+		return
+	}
+
+	macroBlock := MacroBlock{Height: height, Blocks: make([]Block, len(blocks))}
+	for i, block := range blocks {
+		macroBlock.Blocks[i] = NewBlock(block)
+	}
+
+	writeJSON(w, macroBlock)
+}
+
+func (s *Server) handleTip(w http.ResponseWriter, r *http.Request) {
+
+	height, hash := s.ledger.Tip()
+
+	writeJSON(w, Tip{Height: height, Hash: hex.EncodeToString(hash), FinalizedHeight: s.ledger.FinalizedHeight()})
+}
+
+func (s *Server) handleOrphans(w http.ResponseWriter, r *http.Request) {
+
+	orphans := []Orphan{}
+	for _, info := range s.ledger.Orphans() {
+
+		orphan := Orphan{Hash: hex.EncodeToString(info.Hash), Height: info.Height, MissingParents: hexStrings(info.MissingParents), Arrival: info.Arrival}
+		orphans = append(orphans, orphan)
+	}
+
+	writeJSON(w, orphans)
+}
+
+// NewBlock returns the JSON representation of the block
+func NewBlock(block common.Block) Block {
+
+	transactionCount := 0
+	if txs, err := common.DecodeTransactions(block.Payload); err == nil {
+		transactionCount = len(txs)
+	}
+
+	return Block{
+		Hash:             hex.EncodeToString(block.Hash()),
+		Issuer:           hex.EncodeToString(block.Issuer),
+		PrevBlockHashes:  hexStrings(block.PrevBlockHashes),
+		Height:           block.Height,
+		Nonce:            block.Nonce,
+		Timestamp:        block.Timestamp,
+		Difficulty:       block.Difficulty,
+		PayloadSize:      block.PayloadSize,
+		PayloadRoot:      hex.EncodeToString(block.PayloadRoot),
+		Signature:        hex.EncodeToString(block.Signature),
+		TransactionCount: transactionCount,
+	}
+}
+
+func hexStrings(values [][]byte) []string {
+
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i] = hex.EncodeToString(value)
+	}
+
+	return strs
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("could not write the API response: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(Error{Error: message}); err != nil {
+		log.Printf("could not write the API response: %s\n", err)
+	}
+}
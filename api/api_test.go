@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/consensus"
+)
+
+func get(t *testing.T, server *httptest.Server, path string, status int, value interface{}) {
+
+	response, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != status {
+		t.Fatalf("%s: expected status %d, got %d", path, status, response.StatusCode)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+
+	ledger := consensus.NewLedger(1)
+	genesis, _ := ledger.GetMacroBlock(0)
+
+	block := common.Block{Height: 1, PrevBlockHashes: [][]byte{genesis[0].Hash()}}
+	block.SetPayload(common.EncodeTransactions([]common.Transaction{{CoinbaseHeight: 1}}))
+	ledger.AppendBlock(block)
+
+	orphan := common.Block{Height: 3, PrevBlockHashes: [][]byte{[]byte("missing")}}
+	ledger.AppendBlock(orphan)
+
+	server := httptest.NewServer(NewServer(ledger))
+	defer server.Close()
+
+	var tip Tip
+	get(t, server, "/tip", http.StatusOK, &tip)
+	if tip.Height != 1 || tip.Hash != hex.EncodeToString(block.Hash()) {
+		t.Errorf("unexpected tip %+v", tip)
+	}
+
+	var received Block
+	get(t, server, "/block/"+hex.EncodeToString(block.Hash()), http.StatusOK, &received)
+	if received.Height != 1 || received.TransactionCount != 1 || received.PrevBlockHashes[0] != hex.EncodeToString(genesis[0].Hash()) {
+		t.Errorf("unexpected block %+v", received)
+	}
+
+	var macroBlock MacroBlock
+	get(t, server, "/macroblock/1", http.StatusOK, &macroBlock)
+	if len(macroBlock.Blocks) != 1 || macroBlock.Blocks[0].Hash != received.Hash {
+		t.Errorf("unexpected macroblock %+v", macroBlock)
+	}
+
+	var orphans []Orphan
+	get(t, server, "/orphans", http.StatusOK, &orphans)
+	if len(orphans) != 1 || orphans[0].Hash != hex.EncodeToString(orphan.Hash()) || orphans[0].MissingParents[0] != hex.EncodeToString([]byte("missing")) {
+		t.Errorf("unexpected orphans %+v", orphans)
+	}
+
+	var apiError Error
+	get(t, server, "/macroblock/2", http.StatusNotFound, &apiError)
+	get(t, server, "/block/00", http.StatusNotFound, &apiError)
+	get(t, server, "/block/not-hex", http.StatusBadRequest, &apiError)
+
+	response, err := http.Post(server.URL+"/tip", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, response.StatusCode)
+	}
+}
+
+func TestServerWhileAppending(t *testing.T) {
+
+	ledger := consensus.NewLedger(1)
+	genesis, _ := ledger.GetMacroBlock(0)
+
+	server := httptest.NewServer(NewServer(ledger))
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		parent := genesis[0]
+		for height := 1; height <= 50; height++ {
+			block := common.Block{Height: height, PrevBlockHashes: [][]byte{parent.Hash()}}
+			block.SetPayload([]byte(fmt.Sprintf("payload %d", height)))
+			ledger.AppendBlock(block)
+			parent = block
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			var tip Tip
+			get(t, server, "/tip", http.StatusOK, &tip)
+			if tip.Height != 50 {
+				t.Errorf("expected tip height 50, got %d", tip.Height)
+			}
+			return
+		default:
+			var tip Tip
+			get(t, server, "/tip", http.StatusOK, &tip)
+
+			var macroBlock MacroBlock
+			get(t, server, fmt.Sprintf("/macroblock/%d", tip.Height), http.StatusOK, &macroBlock)
+		}
+	}
+}
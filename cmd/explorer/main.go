@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/korkmazkadir/bitcoin/api"
+)
+
+// shortHashLength is the number of hex characters printed for hashes and keys
+const shortHashLength = 12
+
+type stringList []string
+
+func (l *stringList) String() string {
+
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+
+	var nodes, directories stringList
+	flag.Var(&nodes, "node", "API address of a node, can be repeated")
+	flag.Var(&directories, "data", "data directory of a persisted ledger, can be repeated")
+	leaderCount := flag.Int("leader-count", 1, "number of blocks in a macroblock, used to rebuild persisted ledgers")
+	fromHeight := flag.Int("from", 0, "first height to show")
+	toHeight := flag.Int("to", -1, "last height to show, the highest tip by default")
+	verbose := flag.Bool("v", false, "print the ledger logs while rebuilding persisted ledgers")
+	flag.Parse()
+
+	if len(nodes)+len(directories) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one -node or -data source is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	var sources []source
+	for _, address := range nodes {
+		sources = append(sources, newAPISource(address))
+	}
+
+	for _, directory := range directories {
+		s, err := newStoreSource(directory, *leaderCount)
+		if err != nil {
+			panic(err)
+		}
+		sources = append(sources, s)
+	}
+
+	defer func() {
+		for _, s := range sources {
+			s.Close()
+		}
+	}()
+
+	explore(sources, *fromHeight, *toHeight)
+}
+
+// explore prints the canonical macroblocks of the sources height by height, and marks the heights where they disagree
+func explore(sources []source, fromHeight int, toHeight int) {
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "SOURCE\tTIP\tFINALIZED\tTIP HASH")
+	maxHeight := 0
+	for _, s := range sources {
+
+		tip, err := s.Tip()
+		if err != nil {
+			panic(err)
+		}
+
+		if tip.Height > maxHeight {
+			maxHeight = tip.Height
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", s.Name(), tip.Height, tip.FinalizedHeight, shorten(tip.Hash))
+	}
+	writer.Flush()
+
+	if toHeight < 0 || toHeight > maxHeight {
+		toHeight = maxHeight
+	}
+
+	var divergedHeights []int
+	for height := fromHeight; height <= toHeight; height++ {
+
+		macroBlocks := make([]*api.MacroBlock, len(sources))
+		for i, s := range sources {
+
+			macroBlock, ok, err := s.MacroBlock(height)
+			if err != nil {
+				panic(err)
+			}
+
+			if ok {
+				macroBlocks[i] = &macroBlock
+			}
+		}
+
+		diverged := disagree(macroBlocks)
+		if diverged {
+			divergedHeights = append(divergedHeights, height)
+		}
+
+		printHeight(writer, height, sources, macroBlocks, diverged)
+	}
+
+	fmt.Println()
+	if len(sources) == 1 {
+		return
+	}
+
+	if len(divergedHeights) == 0 {
+		fmt.Printf("sources agree on heights %d to %d\n", fromHeight, toHeight)
+		return
+	}
+
+	fmt.Printf("sources disagree on %d heights, the first divergence is at height %d: %v\n", len(divergedHeights), divergedHeights[0], divergedHeights)
+}
+
+// disagree returns true if two sources have different macroblocks at the height. A source without a macroblock is behind, and it does not disagree
+func disagree(macroBlocks []*api.MacroBlock) bool {
+
+	key := ""
+	for _, macroBlock := range macroBlocks {
+
+		if macroBlock == nil {
+			continue
+		}
+
+		var hashes []string
+		for _, block := range macroBlock.Blocks {
+			hashes = append(hashes, block.Hash)
+		}
+
+		k := strings.Join(hashes, ",")
+		if key != "" && k != key {
+			return true
+		}
+		key = k
+	}
+
+	return false
+}
+
+func printHeight(writer *tabwriter.Writer, height int, sources []source, macroBlocks []*api.MacroBlock, diverged bool) {
+
+	marker := ""
+	if diverged {
+		marker = "  <<< DIVERGED"
+	}
+
+	fmt.Fprintf(writer, "\nheight %d%s\n", height, marker)
+	fmt.Fprintln(writer, "SOURCE\tSLOT\tHASH\tISSUER\tPAYLOAD\tTXS\tPARENTS")
+
+	for i, s := range sources {
+
+		if macroBlocks[i] == nil {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\t-\t-\t-\n", s.Name())
+			continue
+		}
+
+		for slot, block := range macroBlocks[i].Blocks {
+
+			var parents []string
+			for _, parent := range block.PrevBlockHashes {
+				parents = append(parents, shorten(parent))
+			}
+
+			fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%d\t%d\t%s\n", s.Name(), slot, shorten(block.Hash), shorten(block.Issuer), block.PayloadSize, block.TransactionCount, strings.Join(parents, ","))
+		}
+	}
+
+	writer.Flush()
+}
+
+func shorten(hash string) string {
+
+	if len(hash) > shortHashLength {
+		return hash[:shortHashLength]
+	}
+
+	return hash
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/api"
+	"github.com/korkmazkadir/bitcoin/consensus"
+	"github.com/korkmazkadir/bitcoin/storage"
+)
+
+const requestTimeout = 10 * time.Second
+
+// source provides the canonical chain of a node or of a persisted ledger
+type source interface {
+	Name() string
+	Tip() (api.Tip, error)
+
+	// MacroBlock returns the canonical macroblock of the height, and false if the chain is shorter
+	MacroBlock(height int) (api.MacroBlock, bool, error)
+
+	Close() error
+}
+
+// apiSource queries the HTTP API of a running node
+type apiSource struct {
+	address string
+	client  *http.Client
+}
+
+func newAPISource(address string) *apiSource {
+
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+
+	return &apiSource{address: strings.TrimSuffix(address, "/"), client: &http.Client{Timeout: requestTimeout}}
+}
+
+func (s *apiSource) Name() string {
+
+	return strings.TrimPrefix(strings.TrimPrefix(s.address, "http://"), "https://")
+}
+
+func (s *apiSource) Tip() (api.Tip, error) {
+
+	tip := api.Tip{}
+	_, err := s.get("/tip", &tip)
+	return tip, err
+}
+
+func (s *apiSource) MacroBlock(height int) (api.MacroBlock, bool, error) {
+
+	macroBlock := api.MacroBlock{}
+	found, err := s.get(fmt.Sprintf("/macroblock/%d", height), &macroBlock)
+	return macroBlock, found, err
+}
+
+func (s *apiSource) Close() error {
+
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// get decodes the JSON response of the path into value, and returns false if the node responds with not found
+func (s *apiSource) get(path string, value interface{}) (bool, error) {
+
+	response, err := s.client.Get(s.address + path)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		apiError := api.Error{}
+		json.Unmarshal(body, &apiError)
+		return false, fmt.Errorf("%s%s responded with %s: %s", s.Name(), path, response.Status, apiError.Error)
+	}
+
+	return true, json.Unmarshal(body, value)
+}
+
+// storeSource rebuilds the ledger of a persisted data directory. The block store is opened for reading,
+// so the directory of a running node can be inspected. Blocks appended after opening it are not visible
+type storeSource struct {
+	directory string
+	store     storage.BlockStore
+	ledger    *consensus.Ledger
+}
+
+func newStoreSource(directory string, leaderCount int) (*storeSource, error) {
+
+	store, err := storage.OpenFileStoreReadOnly(filepath.Join(directory, "blocks.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	ledger, err := consensus.NewLedgerWithStore(leaderCount, store)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("could not rebuild the ledger of %s: %w", directory, err)
+	}
+
+	return &storeSource{directory: directory, store: store, ledger: ledger}, nil
+}
+
+func (s *storeSource) Name() string {
+
+	return s.directory
+}
+
+func (s *storeSource) Tip() (api.Tip, error) {
+
+	height, hash := s.ledger.Tip()
+	return api.Tip{Height: height, Hash: fmt.Sprintf("%x", hash), FinalizedHeight: s.ledger.FinalizedHeight()}, nil
+}
+
+func (s *storeSource) MacroBlock(height int) (api.MacroBlock, bool, error) {
+
+	blocks, ok := s.ledger.GetMacroBlock(height)
+	if !ok {
+		return api.MacroBlock{}, false, nil
+	}
+
+	macroBlock := api.MacroBlock{Height: height, Blocks: make([]api.Block, len(blocks))}
+	for i, block := range blocks {
+		macroBlock.Blocks[i] = api.NewBlock(block)
+	}
+
+	return macroBlock, true, nil
+}
+
+func (s *storeSource) Close() error {
+
+	return s.store.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
 	"fmt"
 	"log"
@@ -19,6 +20,12 @@ func main() {
 	hostname := getEnvWithDefault("NODE_HOSTNAME", "127.0.0.1")
 	registryAddress := getEnvWithDefault("REGISTRY_ADDRESS", "localhost:1234")
 
+	// blocks are kept in memory if the data directory is not set
+	dataDirectory := getEnvWithDefault("DATA_DIR", "")
+
+	// the query API listens on a random port of the node hostname by default
+	apiAddress := getEnvWithDefault("API_ADDRESS", fmt.Sprintf("%s:", hostname))
+
 	demux := common.NewDemultiplexer(0)
 	server := network.NewServer(demux)
 
@@ -33,25 +40,40 @@ func main() {
 		log.Fatal("listen error:", e)
 	}
 
+	log.Printf("p2p server listening on %s\n", l.Addr().String())
+	nodeInfo := getNodeInfo(l.Addr().String())
+
+	// the key is loaded before the registration, the registry attributes block issuers to node IDs by their keys
+	privateKey := loadNodeKey(dataDirectory)
+	nodeInfo.PublicKey = privateKey.Public().(ed25519.PublicKey)
+
+	registry := registery.NewRegistryClient(registryAddress, nodeInfo)
+
+	nodeInfo.ID = registry.RegisterNode(privateKey)
+	log.Printf("node registeration successful, assigned ID is %d\n", nodeInfo.ID)
+
+	nodeConfig := registry.GetConfig()
+
+	err = demux.SetQueuePolicy(nodeConfig.DemuxQueueCapacity, common.DropPolicy(nodeConfig.DemuxDropPolicy))
+	if err != nil {
+		panic(err)
+	}
+
+	// the transport is set before accepting connections. Connections wait in the listener backlog until then
+	tlsTransport := configureTransport(nodeConfig, privateKey)
+	framed := configureWireProtocol(nodeConfig, nodeInfo, demux, server)
+
 	// start serving
 	go func() {
 		for {
 			conn, _ := l.Accept()
 			go func() {
-				rpc.ServeConn(conn)
+				server.ServeConn(rpc.DefaultServer, conn)
 			}()
 		}
 	}()
 
 	log.Printf("p2p server started on %s\n", l.Addr().String())
-	nodeInfo := getNodeInfo(l.Addr().String())
-
-	registry := registery.NewRegistryClient(registryAddress, nodeInfo)
-
-	nodeInfo.ID = registry.RegisterNode()
-	log.Printf("node registeration successful, assigned ID is %d\n", nodeInfo.ID)
-
-	nodeConfig := registry.GetConfig()
 
 	var nodeList []registery.NodeInfo
 
@@ -65,16 +87,48 @@ func main() {
 		log.Printf("received node list %d/%d\n", nodeCount, nodeConfig.NodeCount)
 	}
 
-	peerSet := createPeerSet(nodeList, nodeConfig.GossipFanout, nodeInfo)
+	// peers are authenticated by the keys registered for their addresses, and their framed handshakes by the IDs registered for them
+	if tlsTransport != nil {
+		if framed != nil {
+			framed.SetPeerIDs(peerIDs(nodeList, nodeConfig.Hash()))
+		}
+		tlsTransport.SetPeerKeys(peerKeys(nodeList, nodeConfig.Hash()))
+	}
+
+	peerSet := createPeerSet(nodeList, nodeConfig.GossipFanout, nodeInfo, framed)
 	statLogger := common.NewStatLogger(nodeInfo.ID)
-	bitcoin := consensus.NewBitcoin(demux, nodeConfig, peerSet, statLogger)
+	configurePropagation(nodeConfig, nodeInfo, demux, server, &peerSet, statLogger)
+
+	store := openBlockStore(dataDirectory)
+	defer store.Close()
+
+	// the sync is set on the peer set before the peer set is copied to the consensus layer
+	blockSync := network.NewBlockSync(demux, statLogger, store, nodeInfo.IPAddress, nodeInfo.PortNumber)
+	peerSet.SetBlockSync(blockSync)
+	server.SetBlockSync(blockSync)
+
+	// blocks are accepted only from the nodes authenticated by the registry
+	validatorKeys := registery.AuthenticatedKeys(nodeList, nodeConfig.Hash())
+	log.Printf("%d validator keys are published by the registry\n", len(validatorKeys))
+	if len(validatorKeys) == 0 {
+		log.Printf("the registry did not publish any authenticated key, all received blocks are rejected\n")
+	}
+
+	bitcoin := consensus.NewBitcoin(demux, nodeConfig, peerSet, statLogger, store, privateKey, validatorKeys)
+	bitcoin.SetBlockSync(blockSync)
+
+	startAPI(apiAddress, bitcoin.Ledger())
+
+	// compact blocks are reconstructed from the mempool of the node
+	server.SetTransactionPool(bitcoin.Mempool())
 
-	runConsensus(bitcoin, nodeConfig.EndRound, nodeConfig.NodeCount, nodeConfig.LeaderCount, nodeConfig.BlockSize)
+	runConsensus(bitcoin, nodeConfig.EndRound)
 
 	// collects stats abd uploads to registry
 	log.Printf("uploading stats to the registry\n")
 	events := statLogger.GetEvents()
-	statList := common.StatList{IPAddress: nodeInfo.IPAddress, PortNumber: nodeInfo.PortNumber, NodeID: nodeInfo.ID, Events: events}
+	counters := statLogger.GetCounters()
+	statList := common.StatList{IPAddress: nodeInfo.IPAddress, PortNumber: nodeInfo.PortNumber, NodeID: nodeInfo.ID, PublicKey: nodeInfo.PublicKey, Events: events, Counters: counters}
 	registry.UploadStats(statList)
 
 	log.Printf("reached target round count. Shutting down in 5 minute\n")
@@ -85,7 +139,7 @@ func main() {
 	log.Printf("exiting as expected...\n")
 }
 
-func runConsensus(bitcoinPP *consensus.Bitcoin, numberOfRounds int, nodeCount int, leaderCount int, blockSize int) {
+func runConsensus(bitcoinPP *consensus.Bitcoin, numberOfRounds int) {
 
 	time.Sleep(5 * time.Second)
 	log.Println("Consensus started")
@@ -98,7 +152,8 @@ func runConsensus(bitcoinPP *consensus.Bitcoin, numberOfRounds int, nodeCount in
 
 		log.Printf("+++++++++ Round %d +++++++++++++++\n", currentRound)
 
-		block := createBlock(currentRound, hashMacroblock(previousBlock), blockSize, leaderCount)
+		// the payload is filled with transactions by the consensus layer
+		block := createBlock(currentRound, hashMacroblock(previousBlock))
 		minedBlock := bitcoinPP.MineBlock(block)
 
 		payloadSize := 0
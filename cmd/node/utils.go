@@ -1,21 +1,28 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
+	"fmt"
 	"log"
-	"math"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/korkmazkadir/bitcoin/api"
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/keystore"
 	"github.com/korkmazkadir/bitcoin/network"
 	"github.com/korkmazkadir/bitcoin/registery"
+	"github.com/korkmazkadir/bitcoin/storage"
 )
 
-func createPeerSet(nodeList []registery.NodeInfo, fanOut int, nodeInfo registery.NodeInfo) network.PeerSet {
+func createPeerSet(nodeList []registery.NodeInfo, fanOut int, nodeInfo registery.NodeInfo, framed *network.FramedProtocol) network.PeerSet {
 
 	var copyNodeList []registery.NodeInfo
 	copyNodeList = append(copyNodeList, nodeList...)
@@ -24,6 +31,9 @@ func createPeerSet(nodeList []registery.NodeInfo, fanOut int, nodeInfo registery
 	rand.Shuffle(len(copyNodeList), func(i, j int) { copyNodeList[i], copyNodeList[j] = copyNodeList[j], copyNodeList[i] })
 
 	peerSet := network.PeerSet{}
+	if framed != nil {
+		peerSet.SetFramedProtocol(framed)
+	}
 
 	peerCount := 0
 	for i := 0; i < len(copyNodeList); i++ {
@@ -48,6 +58,177 @@ func createPeerSet(nodeList []registery.NodeInfo, fanOut int, nodeInfo registery
 	return peerSet
 }
 
+// configurePropagation enables the block propagation mode of the config on the peer set and the server
+func configurePropagation(nodeConfig registery.NodeConfig, nodeInfo registery.NodeInfo, demux *common.Demux, server *network.P2PServer, peerSet *network.PeerSet, statLogger *common.StatLogger) {
+
+	switch nodeConfig.PropagationMode {
+
+	case registery.HeaderFirstPropagation:
+		relay := network.NewHeaderRelay(demux, nodeInfo.IPAddress, nodeInfo.PortNumber)
+		peerSet.SetHeaderRelay(relay)
+		server.SetHeaderRelay(relay)
+
+	case registery.ErasureCodedPropagation:
+		err := peerSet.SetErasureCoding(nodeConfig.DataFragmentCount, nodeConfig.FragmentCount)
+		if err != nil {
+			panic(err)
+		}
+		server.SetRelayPeerSet(peerSet)
+
+	case registery.InventoryPropagation:
+		relay := network.NewInventoryRelay(demux, statLogger, nodeInfo.IPAddress, nodeInfo.PortNumber)
+		peerSet.SetInventoryRelay(relay)
+		server.SetInventoryRelay(relay)
+
+	case registery.CompactBlockPropagation:
+		relay := network.NewCompactBlockRelay(demux, statLogger, nodeInfo.IPAddress, nodeInfo.PortNumber)
+		peerSet.SetCompactBlockRelay(relay)
+		server.SetCompactBlockRelay(relay)
+
+	default:
+		if nodeConfig.BlockChunkCount > 1 {
+			peerSet.SetBlockChunkCount(nodeConfig.BlockChunkCount)
+			server.SetRelayPeerSet(peerSet)
+		}
+	}
+}
+
+// startAPI serves the read-only query API of the ledger on the given address in the background
+func startAPI(address string, ledger api.LedgerReader) {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("listen error:", err)
+	}
+
+	log.Printf("query API started on %s\n", listener.Addr().String())
+
+	go func() {
+		err := http.Serve(listener, api.NewServer(ledger))
+		log.Printf("query API stopped: %s\n", err)
+	}()
+}
+
+// configureTransport sets the transport of the connections between nodes. It returns the TLS transport to set the peer keys on,
+// or nil if the nodes are connected with plain TCP
+func configureTransport(nodeConfig registery.NodeConfig, privateKey ed25519.PrivateKey) *network.TLSTransport {
+
+	switch nodeConfig.TransportMode {
+
+	case "", registery.TCPTransport:
+		return nil
+
+	case registery.TLSTransport:
+		tlsTransport, err := network.NewTLSTransport(privateKey)
+		if err != nil {
+			panic(err)
+		}
+		network.SetTransport(tlsTransport)
+		log.Printf("nodes are connected with TLS\n")
+		return tlsTransport
+
+	default:
+		panic(fmt.Errorf("unknown transport mode %s", nodeConfig.TransportMode))
+	}
+}
+
+// configureWireProtocol enables the framed protocol on the server, and returns it to enable it on the peer set.
+// It returns nil if peers are sent messages with net/rpc
+func configureWireProtocol(nodeConfig registery.NodeConfig, nodeInfo registery.NodeInfo, demux *common.Demux, server *network.P2PServer) *network.FramedProtocol {
+
+	switch nodeConfig.WireProtocol {
+
+	case "", registery.RPCWireProtocol:
+		return nil
+
+	case registery.FramedWireProtocol:
+		if (nodeConfig.PropagationMode != "" && nodeConfig.PropagationMode != registery.FullBlockPropagation) || nodeConfig.BlockChunkCount > 1 {
+			panic(fmt.Errorf("framed wire protocol does not support %s propagation with %d chunks", nodeConfig.PropagationMode, nodeConfig.BlockChunkCount))
+		}
+
+		framed := network.NewFramedProtocol(demux, nodeInfo.ID, nodeConfig.Hash())
+		server.SetFramedProtocol(framed)
+		log.Printf("peers are sent messages with the framed wire protocol\n")
+		return framed
+
+	default:
+		panic(fmt.Errorf("unknown wire protocol %s", nodeConfig.WireProtocol))
+	}
+}
+
+// peerKeys returns the keys of the authenticated nodes by their addresses
+func peerKeys(nodeList []registery.NodeInfo, configHash []byte) map[string][]byte {
+
+	keys := make(map[string][]byte)
+	for _, node := range nodeList {
+		if node.Verify(configHash) == nil {
+			keys[fmt.Sprintf("%s:%d", node.IPAddress, node.PortNumber)] = node.PublicKey
+		}
+	}
+
+	return keys
+}
+
+// peerIDs returns the IDs of the authenticated nodes by their addresses
+func peerIDs(nodeList []registery.NodeInfo, configHash []byte) map[string]int {
+
+	ids := make(map[string]int)
+	for _, node := range nodeList {
+		if node.Verify(configHash) == nil {
+			ids[fmt.Sprintf("%s:%d", node.IPAddress, node.PortNumber)] = node.ID
+		}
+	}
+
+	return ids
+}
+
+// openBlockStore opens the block store file in the data directory, or creates an in-memory store if the data directory is empty
+func openBlockStore(dataDirectory string) storage.BlockStore {
+
+	if dataDirectory == "" {
+		return storage.NewMemoryStore()
+	}
+
+	err := os.MkdirAll(dataDirectory, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	store, err := storage.OpenFileStore(filepath.Join(dataDirectory, "blocks.dat"))
+	if err != nil {
+		panic(err)
+	}
+
+	return store
+}
+
+// loadNodeKey loads the key of the node from the data directory, or creates it on the first start.
+// A new key is generated on each start if the data directory is empty
+func loadNodeKey(dataDirectory string) ed25519.PrivateKey {
+
+	if dataDirectory == "" {
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			panic(err)
+		}
+		return privateKey
+	}
+
+	err := os.MkdirAll(dataDirectory, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	privateKey, err := keystore.LoadOrCreate(filepath.Join(dataDirectory, "node.key"))
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("node public key is %x\n", privateKey.Public())
+
+	return privateKey
+}
+
 func getNodeInfo(netAddress string) registery.NodeInfo {
 	tokens := strings.Split(netAddress, ":")
 
@@ -95,24 +276,12 @@ func isElectedAsLeader(nodeList []registery.NodeInfo, round int, nodeID int, lea
 	return false
 }
 
-func createBlock(round int, previousBlockHashes [][]byte, blockSize int, leaderCount int) common.Block {
-
-	payloadSize := int(math.Ceil(float64(blockSize) / float64(leaderCount)))
+func createBlock(round int, previousBlockHashes [][]byte) common.Block {
 
 	block := common.Block{
 		Height:          round,
-		Payload:         getRandomByteSlice(payloadSize),
 		PrevBlockHashes: previousBlockHashes,
 	}
 
 	return block
 }
-
-func getRandomByteSlice(size int) []byte {
-	data := make([]byte, size)
-	_, err := rand.Read(data)
-	if err != nil {
-		panic(err)
-	}
-	return data
-}
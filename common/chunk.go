@@ -0,0 +1,100 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrChunkMismatch   = errors.New("reassembled block does not match the block hash of its parts")
+	ErrPayloadMismatch = errors.New("payload of the reassembled block does not match its header")
+)
+
+// BlockChunk is a part of an encoded block. A block is reassembled once all chunks of its hash are received
+type BlockChunk struct {
+	BlockHash []byte
+
+	// Height is the height of the block
+	Height int
+
+	ChunkCount int
+	ChunkIndex int
+
+	Data []byte
+}
+
+// Hash produces the digest of a chunk
+func (c BlockChunk) Hash() []byte {
+
+	str := fmt.Sprintf("%x,%d,%d,%d,%x", c.BlockHash, c.Height, c.ChunkCount, c.ChunkIndex, c.Data)
+	h := sha256.New()
+	_, err := h.Write([]byte(str))
+	if err != nil {
+		panic(err)
+	}
+
+	return h.Sum(nil)
+}
+
+// SplitBlock encodes the block, and splits it into chunkCount chunks of nearly equal size
+func SplitBlock(block Block, chunkCount int) []BlockChunk {
+
+	data := block.Encode()
+
+	if chunkCount > len(data) {
+		chunkCount = len(data)
+	}
+
+	if chunkCount < 1 {
+		chunkCount = 1
+	}
+
+	blockHash := block.Hash()
+	chunks := make([]BlockChunk, chunkCount)
+	for i := range chunks {
+
+		start := i * len(data) / chunkCount
+		end := (i + 1) * len(data) / chunkCount
+
+		chunks[i] = BlockChunk{BlockHash: blockHash, Height: block.Height, ChunkCount: chunkCount, ChunkIndex: i, Data: data[start:end]}
+	}
+
+	return chunks
+}
+
+// AssembleBlock decodes the block from its chunks ordered by chunk index, and checks the hash and the payload of the block
+func AssembleBlock(chunks []BlockChunk) (Block, error) {
+
+	if len(chunks) == 0 {
+		return Block{}, ErrChunkMismatch
+	}
+
+	var data []byte
+	for _, chunk := range chunks {
+		data = append(data, chunk.Data...)
+	}
+
+	return decodeBlock(data, chunks[0].BlockHash)
+}
+
+// decodeBlock decodes a block encoded by Block.Encode, and checks its hash and its payload.
+// The hash does not cover the payload, so a block with a corrupted payload would otherwise pass as the block of the hash
+func decodeBlock(data []byte, blockHash []byte) (Block, error) {
+
+	block, err := DecodeBlock(data)
+	if err != nil {
+		return Block{}, err
+	}
+
+	if !bytes.Equal(block.Hash(), blockHash) {
+		return Block{}, ErrChunkMismatch
+	}
+
+	if !block.HasValidPayload() {
+		return Block{}, ErrPayloadMismatch
+	}
+
+	return block, nil
+}
@@ -1,13 +1,66 @@
 package common
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/erasure"
 )
 
 const (
 	channelCapacity = 1024
+
+	// defaultQueueCapacity is the number of blocks the block queue keeps if the capacity is not configured
+	defaultQueueCapacity = 1024
+
+	// partialBlockTimeout is the time to wait for the missing chunks or fragments of a block after the first one is received
+	partialBlockTimeout = 30 * time.Second
+
+	// maxChunkCount is the maximum number of chunks a block can be split into
+	maxChunkCount = 1 << 16
+
+	// maxFutureRounds is the number of rounds after the current round whose blocks are buffered.
+	// Blocks of later rounds are dropped
+	maxFutureRounds = 16
 )
 
+var (
+	// ErrAlreadyProcessed is returned for messages that are already processed
+	ErrAlreadyProcessed = errors.New("message is already processed")
+
+	// ErrOutsideRoundWindow is returned for messages of finalized rounds, or rounds too far in the future
+	ErrOutsideRoundWindow = errors.New("message round is outside of the round window")
+
+	// ErrInvalidQueuePolicy is returned for negative queue capacities and unknown drop policies
+	ErrInvalidQueuePolicy = errors.New("invalid block queue policy")
+)
+
+// DropPolicy decides which block is dropped when a block arrives while the block queue is full
+type DropPolicy string
+
+const (
+	// DropOldest drops the block that has been waiting in the queue for the longest time
+	DropOldest DropPolicy = "drop-oldest"
+
+	// DropFutureRounds drops the block of the furthest round after the current round.
+	// If no block of a future round is waiting, the oldest block is dropped
+	DropFutureRounds DropPolicy = "drop-future-rounds"
+
+	// PrioritizeCurrentRound delivers the blocks of the current round before the blocks of earlier rounds,
+	// and drops the oldest block of another round. Blocks of the current round are dropped only if no other block is waiting
+	PrioritizeCurrentRound DropPolicy = "prioritize-current-round"
+)
+
+// BlockValidator returns an error if a received block is not valid
+type BlockValidator func(block Block) error
+
+// HeaderValidator returns an error if a received block header is not valid
+type HeaderValidator func(header BlockHeader) error
+
 // Demux provides message multiplexing service
 // Network and consensus layer communicate using demux
 type Demux struct {
@@ -15,54 +68,731 @@ type Demux struct {
 
 	currentRound int
 
-	// it is used to filter already processed messages
-	processedMessageMap map[string]struct{}
+	// finalizedRound is the lowest round that can still change. Messages of earlier rounds are forgotten, and their blocks are dropped
+	finalizedRound int
+
+	// it is used to filter already processed messages. It keeps the round of a message by hash
+	processedMessageMap map[string]int
+
+	// processedRounds keeps the hashes of processed messages by round to forget them once the round is finalized
+	processedRounds map[int][]string
+
+	// queue keeps the accepted blocks in arrival order until the consensus layer consumes them.
+	// Blocks of rounds after the current round wait in the queue until their round starts
+	queue []Block
+
+	queueCapacity int
+
+	dropPolicy DropPolicy
+
+	// queueUpdated is signaled when a block is added to the queue, or the current round changes
+	queueUpdated *sync.Cond
+
+	// dispatching is the block taken from the queue that waits for the consensus layer. It is nil if no block is waiting.
+	// cancelDispatch is closed to withdraw the block, if it is not valid for a validator set while it waits
+	dispatching    *Block
+	cancelDispatch chan struct{}
+
+	// it is used to reject invalid blocks before they are consumed by consensus layer
+	blockValidator BlockValidator
+
+	// it is used to reject invalid headers before their payloads are requested
+	headerValidator HeaderValidator
+
+	// chunkSets keeps the chunks of incomplete blocks by block hash and chunk count, so a forged chunk count
+	// does not make the chunks of the genuine split rejected
+	chunkSets map[string]*chunkSet
+
+	// fragmentSets keeps the fragments of blocks that are not reconstructed yet by block hash
+	fragmentSets map[string]*fragmentSet
+
+	// statLogger records block reconstruction times. Nothing is recorded if it is nil
+	statLogger *StatLogger
+
+	// maxQueueDepth is the largest number of blocks that waited in the block queue
+	maxQueueDepth int
 
 	blockChan chan Block
+
+	transactionChan chan Transaction
+}
+
+// chunkSet keeps the received chunks of a block by chunk index
+type chunkSet struct {
+	blockHash     string
+	height        int
+	chunks        []BlockChunk
+	receivedCount int
+	firstArrival  time.Time
+}
+
+// chunkSetKey returns the key of the chunk set of a block split into chunkCount chunks
+func chunkSetKey(blockHash []byte, chunkCount int) string {
+	return fmt.Sprintf("%x:%d", blockHash, chunkCount)
+}
+
+// fragmentSet keeps the received fragments of a block by fragment index
+type fragmentSet struct {
+	height            int
+	dataFragmentCount int
+	dataSize          int
+	fragments         []BlockFragment
+	receivedCount     int
+	firstArrival      time.Time
 }
 
 // NewDemultiplexer creates a new demultiplexer with initial round value
 func NewDemultiplexer(initialRound int) *Demux {
 
 	demux := &Demux{currentRound: initialRound}
-	demux.processedMessageMap = make(map[string]struct{})
-	demux.blockChan = make(chan Block, channelCapacity)
+	demux.processedMessageMap = make(map[string]int)
+	demux.processedRounds = make(map[int][]string)
+	demux.queueCapacity = defaultQueueCapacity
+	demux.dropPolicy = DropOldest
+	demux.queueUpdated = sync.NewCond(&demux.mutex)
+	demux.chunkSets = make(map[string]*chunkSet)
+	demux.fragmentSets = make(map[string]*fragmentSet)
+	// blocks wait in the queue, so the channel does not buffer them
+	demux.blockChan = make(chan Block)
+	demux.transactionChan = make(chan Transaction, channelCapacity)
+
+	go demux.dispatchBlocks()
 
 	return demux
 }
 
-// EnqueBlockChunk enques a block chunk to be the consumed by consensus layer
+// SetQueuePolicy sets the number of blocks the block queue keeps, and the policy deciding which block is dropped when it is full.
+// Zero capacity and empty policy keep the current values
+func (d *Demux) SetQueuePolicy(capacity int, policy DropPolicy) error {
+
+	if capacity < 0 {
+		return ErrInvalidQueuePolicy
+	}
+
+	switch policy {
+	case "", DropOldest, DropFutureRounds, PrioritizeCurrentRound:
+	default:
+		return ErrInvalidQueuePolicy
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if capacity > 0 {
+		d.queueCapacity = capacity
+	}
+
+	if policy != "" {
+		d.dropPolicy = policy
+	}
+
+	return nil
+}
+
+// QueueDepth returns the number of blocks waiting in the block queue
+func (d *Demux) QueueDepth() int {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.queue)
+}
+
+// EnqueBlock enques a block to be the consumed by consensus layer
 func (d *Demux) EnqueBlock(block Block) {
 
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
+	d.enqueBlock(block)
+}
+
+// EnqueRequestedBlock enques a block requested from another node. It is enqueued even if it is marked as processed,
+// because a block can be marked as processed without reaching the consensus layer, e.g. when its chunk set expires.
+// A block waiting in the queue, or waiting for the consensus layer, is not enqueued again
+func (d *Demux) EnqueRequestedBlock(block Block) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	blockHash := block.Hash()
+	if d.isQueued(blockHash) {
+		return
+	}
+
+	delete(d.processedMessageMap, string(blockHash))
+	d.enqueBlock(block)
+}
+
+// EnqueBlockChunk adds a chunk to the chunk set of its block. Once all chunks of the block are received,
+// the block is reassembled and enqueued. Incomplete chunk sets are dropped after partialBlockTimeout.
+// It returns true if the chunk is received for the first time, so it should be forwarded
+func (d *Demux) EnqueBlockChunk(chunk BlockChunk) bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	chunkHash := string(chunk.Hash())
+	blockHash := string(chunk.BlockHash)
+	if d.isProcessed(chunkHash) || d.isProcessed(blockHash) || !d.isInWindow(chunk.Height) {
+		return false
+	}
+
+	d.removeExpiredSets()
+
+	if chunk.ChunkCount < 1 || chunk.ChunkCount > maxChunkCount || chunk.ChunkIndex < 0 || chunk.ChunkIndex >= chunk.ChunkCount {
+		d.markAsProcessed(chunk.Height, chunkHash)
+		return false
+	}
+
+	setKey := chunkSetKey(chunk.BlockHash, chunk.ChunkCount)
+	set, ok := d.chunkSets[setKey]
+	if !ok {
+		set = &chunkSet{blockHash: blockHash, height: chunk.Height, chunks: make([]BlockChunk, chunk.ChunkCount), firstArrival: time.Now()}
+		d.chunkSets[setKey] = set
+	}
+
+	if set.chunks[chunk.ChunkIndex].Data != nil {
+		// another chunk with the same index is already received. The chunk is not marked as processed,
+		// so it is accepted again if the received chunk turns out to be invalid
+		return false
+	}
+
+	d.markAsProcessed(chunk.Height, chunkHash)
+	set.chunks[chunk.ChunkIndex] = chunk
+	set.receivedCount++
+
+	if set.receivedCount < len(set.chunks) {
+		return true
+	}
+
+	delete(d.chunkSets, setKey)
+
+	block, err := AssembleBlock(set.chunks)
+	if err != nil {
+		// neither the block nor its chunks are marked as processed, so it is accepted with other chunks, or in full
+		log.Printf("could not reassemble the block %x: %s\n", chunk.BlockHash, err)
+		for _, c := range set.chunks {
+			delete(d.processedMessageMap, string(c.Hash()))
+		}
+		d.incrementCounter("DEMUX_REASSEMBLY_FAILURES")
+		return true
+	}
+
+	d.enqueBlock(block)
+
+	return true
+}
+
+// EnqueBlockFragment adds an erasure coded fragment to the fragment set of its block. Once DataFragmentCount fragments
+// of the block are received, the block is reconstructed and enqueued. Incomplete fragment sets are dropped after partialBlockTimeout.
+// It returns true if the fragment is received for the first time, so it should be forwarded
+func (d *Demux) EnqueBlockFragment(fragment BlockFragment) bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	fragmentHash := string(fragment.Hash())
+	blockHash := string(fragment.BlockHash)
+	if d.isProcessed(fragmentHash) || d.isProcessed(blockHash) || !d.isInWindow(fragment.Height) {
+		return false
+	}
+
+	d.markAsProcessed(fragment.Height, fragmentHash)
+	d.removeExpiredSets()
+
+	if fragment.DataFragmentCount < 1 || fragment.FragmentCount < fragment.DataFragmentCount || fragment.FragmentCount > erasure.MaxFragmentCount ||
+		fragment.FragmentIndex < 0 || fragment.FragmentIndex >= fragment.FragmentCount || len(fragment.Data) == 0 {
+		return false
+	}
+
+	if fragment.DataSize < 0 || fragment.DataSize > len(fragment.Data)*fragment.DataFragmentCount {
+		// the data fragments can not contain the encoded block
+		return false
+	}
+
+	set, ok := d.fragmentSets[blockHash]
+	if !ok {
+		set = &fragmentSet{
+			height:            fragment.Height,
+			dataFragmentCount: fragment.DataFragmentCount,
+			dataSize:          fragment.DataSize,
+			fragments:         make([]BlockFragment, fragment.FragmentCount),
+			firstArrival:      time.Now(),
+		}
+		d.fragmentSets[blockHash] = set
+	}
+
+	if fragment.FragmentCount != len(set.fragments) || fragment.DataFragmentCount != set.dataFragmentCount || fragment.DataSize != set.dataSize {
+		// the fragment does not belong to the fragment set
+		return false
+	}
+
+	if set.fragments[fragment.FragmentIndex].Data != nil {
+		// another fragment with the same index is already received
+		return false
+	}
+
+	set.fragments[fragment.FragmentIndex] = fragment
+	set.receivedCount++
+
+	if set.receivedCount < set.dataFragmentCount {
+		return true
+	}
+
+	delete(d.fragmentSets, blockHash)
+
+	block, err := ReconstructBlock(set.fragments)
+	if err != nil {
+		// the block is not marked as processed, so it is accepted with other fragments, or in full
+		log.Printf("could not reconstruct the block %x: %s\n", fragment.BlockHash, err)
+		d.incrementCounter("DEMUX_RECONSTRUCTION_FAILURES")
+		return true
+	}
+
+	if d.statLogger != nil {
+		d.statLogger.LogReconstruction(time.Since(set.firstArrival).Milliseconds())
+	}
+
+	d.enqueBlock(block)
+
+	return true
+}
+
+// enqueBlock validates a block and adds it to the block queue without blocking. Blocks of finalized rounds are dropped,
+// and if the queue is full a block is dropped according to the drop policy. The caller must hold the mutex
+func (d *Demux) enqueBlock(block Block) {
+
 	round := block.Height
 	blockHash := string(block.Hash())
 	if d.isProcessed(blockHash) {
-		// chunk is already processed
+		// block is already processed
+		return
+	}
+
+	if round < d.finalizedRound {
+		d.incrementCounter("DEMUX_STALE_BLOCKS")
+		return
+	}
+
+	if round > d.currentRound+maxFutureRounds {
+		// the block is not marked as processed, so it is accepted once its round is close enough
+		d.incrementCounter("DEMUX_DROPPED_FUTURE_BLOCKS")
+		return
+	}
+
+	if d.blockValidator != nil && !block.HasValidPayload() {
+		// the block hash does not cover the payload, so a copy with a corrupted payload is recorded by the root of its payload.
+		// It is not processed again, and it does not hide the copy with the genuine payload
+		copyKey := blockHash + string(PayloadRoot(block.Payload))
+		if !d.isProcessed(copyKey) {
+			d.markAsProcessed(round, copyKey)
+			d.incrementCounter("DEMUX_INVALID_PAYLOADS")
+		}
 		return
 	}
 
-	d.blockChan <- block
+	if d.blockValidator != nil && d.blockValidator(block) != nil {
+		// the block hash covers the whole header, signature included, so invalid blocks are not processed again
+		d.markAsProcessed(round, blockHash)
+		return
+	}
 
 	d.markAsProcessed(round, blockHash)
+
+	if len(d.queue) >= d.queueCapacity {
+
+		d.incrementCounter("DEMUX_DROPPED_BLOCKS")
+
+		// dropped blocks are not marked as processed, so they are accepted if they are received again
+		victim := d.dropVictim(block)
+		if victim < 0 {
+			log.Printf("block queue is full, dropping the received block of round %d\n", round)
+			delete(d.processedMessageMap, blockHash)
+			return
+		}
+
+		log.Printf("block queue is full, dropping the queued block of round %d\n", d.queue[victim].Height)
+		delete(d.processedMessageMap, string(d.queue[victim].Hash()))
+		d.removeFromQueue(victim)
+	}
+
+	d.queue = append(d.queue, block)
+	if len(d.queue) > d.maxQueueDepth {
+		d.maxQueueDepth = len(d.queue)
+		d.setCounter("DEMUX_MAX_QUEUE_DEPTH", d.maxQueueDepth)
+	}
+
+	d.queueUpdated.Signal()
+}
+
+// dropVictim returns the index of the queued block to drop according to the drop policy,
+// or -1 if the received block should be dropped. The caller must hold the mutex
+func (d *Demux) dropVictim(received Block) int {
+
+	switch d.dropPolicy {
+
+	case DropFutureRounds:
+		furthest := 0
+		for i, block := range d.queue {
+			if block.Height > d.queue[furthest].Height {
+				furthest = i
+			}
+		}
+
+		if d.queue[furthest].Height > d.currentRound && d.queue[furthest].Height > received.Height {
+			return furthest
+		}
+
+		if received.Height > d.currentRound {
+			return -1
+		}
+
+	case PrioritizeCurrentRound:
+		for i, block := range d.queue {
+			if block.Height != d.currentRound {
+				return i
+			}
+		}
+
+		if received.Height != d.currentRound {
+			return -1
+		}
+	}
+
+	return 0
 }
 
-// EnqueBlockChunk enques a block chunk to be the consumed by consensus layer
+// dispatchBlocks sends the queued blocks to the block channel in the order decided by the drop policy.
+// Blocks of future rounds are not sent before their round starts
+func (d *Demux) dispatchBlocks() {
+
+	for {
+		d.mutex.Lock()
+
+		index := d.nextBlock()
+		for index < 0 {
+			d.queueUpdated.Wait()
+			index = d.nextBlock()
+		}
+
+		block := d.queue[index]
+		d.removeFromQueue(index)
+
+		cancel := make(chan struct{})
+		d.dispatching = &block
+		d.cancelDispatch = cancel
+
+		d.mutex.Unlock()
+
+		// the mutex is not held, so the network layer keeps enqueuing while the consensus layer is busy
+		select {
+		case d.blockChan <- block:
+		case <-cancel:
+		}
+
+		d.mutex.Lock()
+		d.dispatching = nil
+		d.cancelDispatch = nil
+		d.mutex.Unlock()
+	}
+}
+
+// nextBlock returns the index of the next queued block to deliver, or -1 if there is not a block of the current or an earlier round.
+// The caller must hold the mutex
+func (d *Demux) nextBlock() int {
+
+	next := -1
+	for i, block := range d.queue {
+
+		if block.Height > d.currentRound {
+			continue
+		}
+
+		if d.dropPolicy != PrioritizeCurrentRound || block.Height == d.currentRound {
+			return i
+		}
+
+		if next < 0 {
+			next = i
+		}
+	}
+
+	return next
+}
+
+// isQueued returns true if the block with the given hash waits in the queue, or waits for the consensus layer.
+// The caller must hold the mutex
+func (d *Demux) isQueued(hash []byte) bool {
+
+	if d.dispatching != nil && bytes.Equal(d.dispatching.Hash(), hash) {
+		return true
+	}
+
+	for _, block := range d.queue {
+		if bytes.Equal(block.Hash(), hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Demux) removeFromQueue(index int) {
+
+	copy(d.queue[index:], d.queue[index+1:])
+	d.queue[len(d.queue)-1] = Block{}
+	d.queue = d.queue[:len(d.queue)-1]
+}
+
+// UpdateRound sets the current round, and the lowest round that can still change.
+// Messages of rounds before the finalized round are forgotten, and the queued blocks of these rounds are dropped
+func (d *Demux) UpdateRound(currentRound int, finalizedRound int) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.currentRound = currentRound
+
+	for round := d.finalizedRound; round < finalizedRound; round++ {
+		for _, hash := range d.processedRounds[round] {
+			delete(d.processedMessageMap, hash)
+		}
+		delete(d.processedRounds, round)
+	}
+
+	if finalizedRound > d.finalizedRound {
+		d.finalizedRound = finalizedRound
+	}
+
+	stale := 0
+	for i := 0; i < len(d.queue); {
+		if d.queue[i].Height < d.finalizedRound {
+			d.removeFromQueue(i)
+			stale++
+			continue
+		}
+		i++
+	}
+
+	if stale > 0 && d.statLogger != nil {
+		d.statLogger.AddToCounter("DEMUX_STALE_BLOCKS", stale)
+	}
+
+	// the queued blocks of the new round can be delivered
+	d.queueUpdated.Signal()
+}
+
+// FinalizedRound returns the lowest round that can still change. Data kept for the blocks of earlier rounds can be dropped
+func (d *Demux) FinalizedRound() int {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.finalizedRound
+}
+
+// EnqueTransaction enques a transaction to be the consumed by consensus layer
+func (d *Demux) EnqueTransaction(tx Transaction) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// the transaction hash does not cover the signatures, so a copy with an invalid signature does not hide the valid one
+	txHash := string(tx.WitnessHash())
+	if d.isProcessed(txHash) {
+		return
+	}
+
+	select {
+	case d.transactionChan <- tx:
+		d.markAsProcessed(d.currentRound, txHash)
+	default:
+		// the transaction is not marked as processed, so it is accepted if it is received again
+		d.incrementCounter("DEMUX_DROPPED_TRANSACTIONS")
+	}
+}
+
+// SetBlockValidator sets the validator applied to each received block.
+// Blocks received before it is set, and not consumed yet, are validated again and the invalid ones are dropped
+func (d *Demux) SetBlockValidator(validator BlockValidator) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.blockValidator = validator
+	if validator == nil {
+		return
+	}
+
+	// invalid blocks stay marked as processed, so they are not received again
+	for i := 0; i < len(d.queue); {
+		if validator(d.queue[i]) != nil {
+			d.forgetInvalidPayload(d.queue[i])
+			d.removeFromQueue(i)
+			continue
+		}
+		i++
+	}
+
+	if d.dispatching != nil && validator(*d.dispatching) != nil {
+		d.forgetInvalidPayload(*d.dispatching)
+		close(d.cancelDispatch)
+		d.dispatching = nil
+	}
+}
+
+// forgetInvalidPayload removes the processed mark of a block with a payload that does not match its header,
+// so the copy with the genuine payload is accepted. The caller must hold the mutex
+func (d *Demux) forgetInvalidPayload(block Block) {
+
+	if !block.HasValidPayload() {
+		delete(d.processedMessageMap, string(block.Hash()))
+	}
+}
+
+// SetHeaderValidator sets the validator applied to each received block header
+func (d *Demux) SetHeaderValidator(validator HeaderValidator) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.headerValidator = validator
+}
+
+// ValidateHeader returns an error if the header is not valid, or the block is already processed.
+// It does not mark valid headers as processed, the block is processed once it is enqueued with its payload
+func (d *Demux) ValidateHeader(header BlockHeader) error {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.isProcessed(string(header.Hash())) {
+		return ErrAlreadyProcessed
+	}
+
+	if !d.isInWindow(header.Height) {
+		return ErrOutsideRoundWindow
+	}
+
+	if d.headerValidator == nil {
+		return nil
+	}
+
+	err := d.headerValidator(header)
+	if err != nil {
+		// invalid headers are not processed again
+		d.markAsProcessed(header.Height, string(header.Hash()))
+	}
+
+	return err
+}
+
+// SetStatLogger sets the stat logger recording block reconstruction times
+func (d *Demux) SetStatLogger(statLogger *StatLogger) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.statLogger = statLogger
+}
+
+// IsProcessed returns true if the message with the given hash is already processed
+func (d *Demux) IsProcessed(hash []byte) bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.isProcessed(string(hash))
+}
+
+// GetBlockChan returns the channel of received blocks
 func (d *Demux) GetBlockChan() chan Block {
 
 	return d.blockChan
 }
 
+// GetTransactionChan returns the channel of received transactions
+func (d *Demux) GetTransactionChan() chan Transaction {
+
+	return d.transactionChan
+}
+
+// removeExpiredSets drops the chunk and fragment sets that are not completed in partialBlockTimeout.
+// Late chunks and fragments of dropped blocks are ignored. The caller must hold the mutex
+func (d *Demux) removeExpiredSets() {
+
+	expired := make(map[string]int)
+	for setKey, set := range d.chunkSets {
+
+		if time.Since(set.firstArrival) < partialBlockTimeout {
+			continue
+		}
+
+		expired[set.blockHash] = set.height
+
+		log.Printf("dropping the incomplete block %x, received %d of %d chunks\n", set.blockHash, set.receivedCount, len(set.chunks))
+		delete(d.chunkSets, setKey)
+	}
+
+	// a block is dropped when none of its chunk sets is completed
+	for _, set := range d.chunkSets {
+		delete(expired, set.blockHash)
+	}
+
+	for blockHash, height := range expired {
+		d.markAsProcessed(height, blockHash)
+	}
+
+	for blockHash, set := range d.fragmentSets {
+
+		if time.Since(set.firstArrival) < partialBlockTimeout {
+			continue
+		}
+
+		log.Printf("dropping the incomplete block %x, received %d of %d fragments\n", blockHash, set.receivedCount, set.dataFragmentCount)
+		delete(d.fragmentSets, blockHash)
+		d.markAsProcessed(set.height, blockHash)
+	}
+}
+
 func (d *Demux) isProcessed(hash string) bool {
 
-	chunkHashString := string(hash)
-	_, ok := d.processedMessageMap[chunkHashString]
+	_, ok := d.processedMessageMap[hash]
 	return ok
 }
 
 func (d *Demux) markAsProcessed(round int, hash string) {
 
-	d.processedMessageMap[hash] = struct{}{}
+	if _, ok := d.processedMessageMap[hash]; ok {
+		return
+	}
+
+	// messages of finalized rounds are forgotten with the earliest round that can still change
+	if round < d.finalizedRound {
+		round = d.finalizedRound
+	}
+
+	d.processedMessageMap[hash] = round
+	d.processedRounds[round] = append(d.processedRounds[round], hash)
+}
+
+// isInWindow returns true if the messages of the round are neither finalized nor too far in the future
+func (d *Demux) isInWindow(round int) bool {
+
+	return round >= d.finalizedRound && round <= d.currentRound+maxFutureRounds
+}
+
+func (d *Demux) incrementCounter(name string) {
+
+	if d.statLogger != nil {
+		d.statLogger.IncrementCounter(name)
+	}
+}
+
+func (d *Demux) setCounter(name string, value int) {
+
+	if d.statLogger != nil {
+		d.statLogger.SetCounter(name, value)
+	}
 }
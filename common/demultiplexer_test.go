@@ -0,0 +1,543 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/erasure"
+)
+
+func TestDemuxBlockChunks(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	block := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 3}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 1000))
+
+	chunks := SplitBlock(block, 8)
+	if len(chunks) != 8 {
+		t.Fatalf("expected 8 chunks, got %d", len(chunks))
+	}
+
+	// chunks arrive in any order
+	for i := len(chunks) - 1; i > 0; i-- {
+
+		if !demux.EnqueBlockChunk(chunks[i]) {
+			t.Errorf("chunk %d is not accepted", i)
+		}
+
+		if demux.EnqueBlockChunk(chunks[i]) {
+			t.Errorf("duplicate chunk %d is accepted", i)
+		}
+	}
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Fatalf("block is enqueued before all chunks are received")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	demux.EnqueBlockChunk(chunks[0])
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if !bytes.Equal(received.Hash(), block.Hash()) || !bytes.Equal(received.Payload, block.Payload) {
+			t.Errorf("reassembled block is not the original block")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("block is not reassembled")
+	}
+
+	// chunks of a processed block are not forwarded
+	other := SplitBlock(block, 4)
+	if demux.EnqueBlockChunk(other[0]) {
+		t.Errorf("chunk of a processed block is accepted")
+	}
+}
+
+func TestDemuxBlockFragments(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	block := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 3}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 1000))
+
+	encoder, err := erasure.NewEncoder(3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments := EncodeBlockFragments(block, encoder)
+
+	// fragments with a data size the data fragments can not contain are rejected
+	for _, size := range []int{-1, len(fragments[0].Data)*3 + 1} {
+		invalid := fragments[7]
+		invalid.DataSize = size
+		if demux.EnqueBlockFragment(invalid) {
+			t.Errorf("fragment with data size %d is accepted", size)
+		}
+	}
+
+	// any 3 fragments reconstruct the block
+	for _, i := range []int{7, 2} {
+		if !demux.EnqueBlockFragment(fragments[i]) {
+			t.Errorf("fragment %d is not accepted", i)
+		}
+	}
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Fatalf("block is enqueued before enough fragments are received")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// all fragments of a block have the same data size
+	mismatched := fragments[5]
+	mismatched.DataSize--
+	if demux.EnqueBlockFragment(mismatched) {
+		t.Errorf("fragment with a different data size is accepted")
+	}
+
+	demux.EnqueBlockFragment(fragments[5])
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if !bytes.Equal(received.Hash(), block.Hash()) || !bytes.Equal(received.Payload, block.Payload) {
+			t.Errorf("reconstructed block is not the original block")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("block is not reconstructed")
+	}
+
+	if demux.EnqueBlockFragment(fragments[0]) {
+		t.Errorf("fragment of a reconstructed block is accepted")
+	}
+}
+
+func TestDemuxRoundGarbageCollection(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	current := Block{Issuer: []byte("issuer"), Height: 1}
+	future := Block{Issuer: []byte("issuer"), Height: 2}
+	tooFar := Block{Issuer: []byte("issuer"), Height: 2 + maxFutureRounds}
+
+	demux.EnqueBlock(current)
+	demux.EnqueBlock(future)
+	demux.EnqueBlock(tooFar)
+
+	received := <-demux.GetBlockChan()
+	if received.Height != 1 {
+		t.Fatalf("expected the block of round 1, got round %d", received.Height)
+	}
+
+	select {
+	case block := <-demux.GetBlockChan():
+		t.Fatalf("block of round %d is enqueued before its round starts", block.Height)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the buffered block is released when its round starts
+	demux.UpdateRound(2, 0)
+
+	select {
+	case received = <-demux.GetBlockChan():
+		if received.Height != 2 {
+			t.Fatalf("expected the block of round 2, got round %d", received.Height)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("buffered block is not released")
+	}
+
+	if demux.IsProcessed(tooFar.Hash()) {
+		t.Errorf("block too far in the future is marked as processed")
+	}
+
+	// processed messages of finalized rounds are forgotten, and their blocks are dropped
+	demux.UpdateRound(3, 2)
+
+	if demux.IsProcessed(current.Hash()) {
+		t.Errorf("block of a finalized round is still kept")
+	}
+
+	if !demux.IsProcessed(future.Hash()) {
+		t.Errorf("block of a round that can still change is forgotten")
+	}
+
+	demux.EnqueBlock(current)
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Fatalf("block of a finalized round is enqueued")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDemuxDropPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy   DropPolicy
+		heights  []int
+		round    int
+		expected []int
+	}{
+		// all blocks are of future rounds, so they wait in the queue until the round update
+		{policy: DropOldest, heights: []int{1, 2, 3}, round: 3, expected: []int{2, 3}},
+		{policy: DropFutureRounds, heights: []int{3, 1, 2}, round: 3, expected: []int{1, 2}},
+		{policy: DropFutureRounds, heights: []int{1, 2, 3}, round: 3, expected: []int{1, 2}},
+		// the blocks of the current round are delivered before the blocks of earlier rounds
+		{policy: PrioritizeCurrentRound, heights: []int{1, 2, 3}, round: 3, expected: []int{3, 2}},
+		{policy: PrioritizeCurrentRound, heights: []int{1, 2}, round: 2, expected: []int{2, 1}},
+	}
+
+	for _, test := range tests {
+
+		demux := NewDemultiplexer(0)
+		if err := demux.SetQueuePolicy(2, test.policy); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, height := range test.heights {
+			demux.EnqueBlock(Block{Issuer: []byte("issuer"), Height: height, Nonce: int64(i)})
+		}
+
+		demux.UpdateRound(test.round, 0)
+
+		var received []int
+		for range test.expected {
+			select {
+			case block := <-demux.GetBlockChan():
+				received = append(received, block.Height)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: expected the blocks of rounds %v, received %v", test.policy, test.expected, received)
+			}
+		}
+
+		if fmt.Sprint(received) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: expected the blocks of rounds %v, received %v", test.policy, test.expected, received)
+		}
+	}
+
+	demux := NewDemultiplexer(0)
+	if demux.SetQueuePolicy(-1, DropOldest) == nil || demux.SetQueuePolicy(1, "drop-newest") == nil {
+		t.Errorf("invalid queue policy is accepted")
+	}
+}
+
+func TestDemuxRequestedBlock(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	block := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 1}
+	demux.EnqueBlock(block)
+
+	select {
+	case <-demux.GetBlockChan():
+	case <-time.After(time.Second):
+		t.Fatalf("block is not enqueued")
+	}
+
+	// a processed block is not enqueued again
+	demux.EnqueBlock(block)
+	if demux.QueueDepth() != 0 {
+		t.Fatalf("processed block is enqueued again")
+	}
+
+	// a requested block is enqueued even if it is processed
+	demux.EnqueRequestedBlock(block)
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if received.Nonce != 1 {
+			t.Errorf("expected the requested block, got the block with nonce %d", received.Nonce)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("requested block is not enqueued")
+	}
+
+	// a requested block waiting in the queue is not enqueued again
+	future := Block{Issuer: []byte("issuer"), Height: 2, Nonce: 2}
+	demux.EnqueRequestedBlock(future)
+	demux.EnqueRequestedBlock(future)
+	if depth := demux.QueueDepth(); depth != 1 {
+		t.Errorf("expected 1 queued block, got %d", depth)
+	}
+}
+
+func TestDemuxDroppedBlock(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+	if err := demux.SetQueuePolicy(1, DropFutureRounds); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := Block{Issuer: []byte("issuer"), Height: 2, Nonce: 1}
+	dropped := Block{Issuer: []byte("issuer"), Height: 3, Nonce: 2}
+	demux.EnqueBlock(queued)
+
+	// the block of the furthest round is dropped from the full queue
+	demux.EnqueBlock(dropped)
+	if demux.QueueDepth() != 1 || demux.IsProcessed(dropped.Hash()) {
+		t.Fatalf("dropped block is kept as processed")
+	}
+
+	demux.UpdateRound(2, 0)
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if received.Nonce != queued.Nonce {
+			t.Fatalf("expected the queued block, got the block with nonce %d", received.Nonce)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("queued block is not delivered")
+	}
+
+	// the dropped block is accepted when it is received again
+	demux.EnqueBlock(dropped)
+	demux.UpdateRound(3, 0)
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if received.Nonce != dropped.Nonce {
+			t.Errorf("expected the dropped block, got the block with nonce %d", received.Nonce)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dropped block is not accepted when it is received again")
+	}
+}
+
+func TestDemuxBlockReconstructionFailure(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	block := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 3}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 1000))
+
+	encoder, err := erasure.NewEncoder(3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments := EncodeBlockFragments(block, encoder)
+
+	corrupted := fragments[7]
+	corrupted.Data = bytes.Repeat([]byte{0xff}, len(corrupted.Data))
+
+	for _, fragment := range []BlockFragment{corrupted, fragments[2], fragments[5]} {
+		demux.EnqueBlockFragment(fragment)
+	}
+
+	if demux.IsProcessed(block.Hash()) {
+		t.Fatalf("block is marked as processed after a failed reconstruction")
+	}
+
+	// valid fragments received later reconstruct the block
+	for _, i := range []int{7, 0, 1} {
+		if !demux.EnqueBlockFragment(fragments[i]) {
+			t.Errorf("fragment %d is not accepted", i)
+		}
+	}
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if !bytes.Equal(received.Hash(), block.Hash()) {
+			t.Errorf("reconstructed block is not the original block")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("block is not reconstructed")
+	}
+}
+
+func TestDemuxForgedChunks(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	block := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 3}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 1000))
+	chunks := SplitBlock(block, 4)
+
+	// a forged chunk with another chunk count arrives first
+	forgedCount := BlockChunk{BlockHash: block.Hash(), Height: 1, ChunkCount: 3, ChunkIndex: 0, Data: []byte("forged")}
+	demux.EnqueBlockChunk(forgedCount)
+
+	// a forged chunk with the same chunk count and index arrives before the genuine chunk
+	forgedData := chunks[0]
+	forgedData.Data = []byte("forged")
+	demux.EnqueBlockChunk(forgedData)
+
+	for i, chunk := range chunks {
+		accepted := demux.EnqueBlockChunk(chunk)
+		if accepted != (i > 0) {
+			t.Errorf("chunk %d is accepted %t", i, accepted)
+		}
+	}
+
+	if demux.IsProcessed(block.Hash()) {
+		t.Fatalf("block is marked as processed after a failed reassembly")
+	}
+
+	// the genuine chunks are accepted again after the failed reassembly
+	for i, chunk := range chunks {
+		if !demux.EnqueBlockChunk(chunk) {
+			t.Errorf("chunk %d is not accepted after the failed reassembly", i)
+		}
+	}
+
+	if received := receiveDemuxBlock(t, demux); !bytes.Equal(received.Hash(), block.Hash()) {
+		t.Errorf("reassembled block is not the original block")
+	}
+}
+
+func TestDemuxLateBlockValidator(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	valid := Block{Issuer: []byte("validator"), Height: 1}
+	invalid := Block{Issuer: []byte("unknown"), Height: 1}
+
+	// blocks received before the validator is set wait for the consensus layer
+	demux.EnqueBlock(invalid)
+	demux.EnqueBlock(valid)
+
+	// the block waiting to be dispatched is taken from the queue
+	time.Sleep(100 * time.Millisecond)
+
+	demux.SetBlockValidator(func(block Block) error {
+		if !bytes.Equal(block.Issuer, valid.Issuer) {
+			return fmt.Errorf("unknown issuer %s", block.Issuer)
+		}
+		return nil
+	})
+
+	if received := receiveDemuxBlock(t, demux); !bytes.Equal(received.Issuer, valid.Issuer) {
+		t.Fatalf("block of an unknown issuer is delivered")
+	}
+
+	select {
+	case block := <-demux.GetBlockChan():
+		t.Fatalf("block of %s is delivered", block.Issuer)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDemuxTamperedBlock(t *testing.T) {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	demux := NewDemultiplexer(1)
+	demux.SetBlockValidator(func(block Block) error {
+		if !ed25519.Verify(block.Issuer, block.SigningHash(), block.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	})
+
+	genuine := Block{Issuer: publicKey, Height: 1, Nonce: 1}
+	genuine.SetPayload(bytes.Repeat([]byte("payload"), 100))
+	genuine.Signature = ed25519.Sign(privateKey, genuine.SigningHash())
+
+	tampered := genuine
+	tampered.Signature = append([]byte{}, genuine.Signature...)
+	tampered.Signature[0]++
+
+	// a copy with a broken signature arrives first, in full and in chunks
+	demux.EnqueBlock(tampered)
+	for _, chunk := range SplitBlock(tampered, 4) {
+		demux.EnqueBlockChunk(chunk)
+	}
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Fatalf("block with a broken signature is delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	demux.EnqueBlock(genuine)
+
+	if received := receiveDemuxBlock(t, demux); !bytes.Equal(received.Signature, genuine.Signature) {
+		t.Errorf("expected the genuine block")
+	}
+}
+
+func TestDemuxInvalidPayload(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+	demux.SetBlockValidator(func(block Block) error { return nil })
+
+	genuine := Block{Issuer: []byte("issuer"), Height: 1, Nonce: 1}
+	genuine.SetPayload(bytes.Repeat([]byte("payload"), 100))
+
+	// a copy with the same header and a corrupted payload arrives first
+	corrupted := genuine
+	corrupted.Payload = append([]byte{}, genuine.Payload...)
+	corrupted.Payload[0]++
+
+	demux.EnqueBlock(corrupted)
+	demux.EnqueBlock(corrupted)
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Fatalf("block with a corrupted payload is delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if demux.IsProcessed(genuine.Hash()) {
+		t.Fatalf("block hash is marked as processed by a copy with a corrupted payload")
+	}
+
+	demux.EnqueBlock(genuine)
+
+	if received := receiveDemuxBlock(t, demux); !bytes.Equal(received.Payload, genuine.Payload) {
+		t.Errorf("expected the block with the genuine payload")
+	}
+}
+
+func TestDemuxTransactionSignatures(t *testing.T) {
+
+	demux := NewDemultiplexer(1)
+
+	input := TxInput{PrevOut: OutPoint{TxHash: []byte("hash"), Index: 0}, Signature: []byte("forged")}
+	forged := Transaction{Inputs: []TxInput{input}, Outputs: []TxOutput{{Value: 10, PublicKey: []byte("key")}}}
+
+	genuine := forged
+	genuine.Inputs = []TxInput{{PrevOut: input.PrevOut, Signature: []byte("genuine")}}
+
+	// a copy with an invalid signature arrives first, and it is received once
+	demux.EnqueTransaction(forged)
+	demux.EnqueTransaction(forged)
+	demux.EnqueTransaction(genuine)
+
+	var received []Transaction
+	for len(received) < 3 {
+		select {
+		case tx := <-demux.GetTransactionChan():
+			received = append(received, tx)
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+
+	if len(received) != 2 || !bytes.Equal(received[1].Inputs[0].Signature, genuine.Inputs[0].Signature) {
+		t.Errorf("expected the forged and the genuine copies once, got %d transactions", len(received))
+	}
+}
+
+func receiveDemuxBlock(t *testing.T, demux *Demux) Block {
+
+	t.Helper()
+
+	select {
+	case block := <-demux.GetBlockChan():
+		return block
+	case <-time.After(time.Second):
+		t.Fatal("block is not delivered")
+		return Block{}
+	}
+}
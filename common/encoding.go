@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncatedData = errors.New("data is truncated")
+
+// Encoder writes values in a compact binary format. Integers are varint encoded, byte slices are length prefixed.
+// It is shared by the block encoding and the wire protocol
+type Encoder struct {
+	buffer  bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *Encoder) WriteUvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buffer.Write(e.scratch[:n])
+}
+
+func (e *Encoder) WriteVarint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buffer.Write(e.scratch[:n])
+}
+
+func (e *Encoder) WriteBytes(b []byte) {
+	e.WriteUvarint(uint64(len(b)))
+	e.buffer.Write(b)
+}
+
+// WriteHashes writes the number of hashes followed by each hash
+func (e *Encoder) WriteHashes(hashes [][]byte) {
+	e.WriteUvarint(uint64(len(hashes)))
+	for _, hash := range hashes {
+		e.WriteBytes(hash)
+	}
+}
+
+// WriteRaw writes the bytes without a length prefix. They can only be read by Decoder.Rest
+func (e *Encoder) WriteRaw(b []byte) {
+	e.buffer.Write(b)
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buffer.Bytes()
+}
+
+// Decoder reads values written by an Encoder
+type Decoder struct {
+	data []byte
+}
+
+// NewDecoder creates a decoder reading the given data
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+func (d *Decoder) ReadUvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, errTruncatedData
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func (d *Decoder) ReadVarint() (int64, error) {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0, errTruncatedData
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+// ReadLength reads a length, and checks that the remaining data is long enough to contain length many items of itemSize bytes
+func (d *Decoder) ReadLength(itemSize int) (int, error) {
+	v, err := d.ReadUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(len(d.data)/itemSize) {
+		return 0, errTruncatedData
+	}
+	return int(v), nil
+}
+
+func (d *Decoder) ReadBytes() ([]byte, error) {
+	length, err := d.ReadLength(1)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	copy(b, d.data[:length])
+	d.data = d.data[length:]
+	return b, nil
+}
+
+// ReadHashes reads hashes written by WriteHashes
+func (d *Decoder) ReadHashes() ([][]byte, error) {
+	// an encoded hash takes at least a byte
+	count, err := d.ReadLength(1)
+	if err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	for i := 0; i < count; i++ {
+		hash, err := d.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Rest returns the remaining data
+func (d *Decoder) Rest() []byte {
+	data := d.data
+	d.data = nil
+	return data
+}
+
+func (d *Decoder) Remaining() int {
+	return len(d.data)
+}
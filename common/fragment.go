@@ -0,0 +1,91 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/korkmazkadir/bitcoin/erasure"
+)
+
+// BlockFragment is an erasure coded fragment of an encoded block.
+// A block is reconstructed once DataFragmentCount fragments of its hash are received
+type BlockFragment struct {
+	BlockHash []byte
+
+	// Height is the height of the block
+	Height int
+
+	DataFragmentCount int
+	FragmentCount     int
+	FragmentIndex     int
+
+	// DataSize is the size of the encoded block in bytes
+	DataSize int
+
+	Data []byte
+}
+
+// Hash produces the digest of a fragment
+func (f BlockFragment) Hash() []byte {
+
+	str := fmt.Sprintf("%x,%d,%d,%d,%d,%d,%x", f.BlockHash, f.Height, f.DataFragmentCount, f.FragmentCount, f.FragmentIndex, f.DataSize, f.Data)
+	h := sha256.New()
+	_, err := h.Write([]byte(str))
+	if err != nil {
+		panic(err)
+	}
+
+	return h.Sum(nil)
+}
+
+// EncodeBlockFragments encodes the block, and produces the fragments of the encoder
+func EncodeBlockFragments(block Block, encoder *erasure.Encoder) []BlockFragment {
+
+	data := block.Encode()
+	blockHash := block.Hash()
+
+	encoded := encoder.Encode(data)
+	fragments := make([]BlockFragment, len(encoded))
+	for i := range encoded {
+		fragments[i] = BlockFragment{
+			BlockHash:         blockHash,
+			Height:            block.Height,
+			DataFragmentCount: encoder.DataCount(),
+			FragmentCount:     encoder.FragmentCount(),
+			FragmentIndex:     i,
+			DataSize:          len(data),
+			Data:              encoded[i],
+		}
+	}
+
+	return fragments
+}
+
+// ReconstructBlock decodes the block from its fragments ordered by fragment index. Missing fragments have nil data
+func ReconstructBlock(fragments []BlockFragment) (Block, error) {
+
+	var first *BlockFragment
+	data := make([][]byte, len(fragments))
+	for i := range fragments {
+		if fragments[i].Data != nil {
+			data[i] = fragments[i].Data
+			first = &fragments[i]
+		}
+	}
+
+	if first == nil {
+		return Block{}, erasure.ErrTooFewFragments
+	}
+
+	encoder, err := erasure.NewEncoder(first.DataFragmentCount, first.FragmentCount)
+	if err != nil {
+		return Block{}, err
+	}
+
+	decoded, err := encoder.Decode(data, first.DataSize)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return decodeBlock(decoded, first.BlockHash)
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"crypto/sha256"
+)
+
+// PayloadChunkSize is the size of the payload chunks committed by the payload root
+const PayloadChunkSize = 4096
+
+// PayloadRoot returns the Merkle root of the payload split into chunks of PayloadChunkSize bytes
+func PayloadRoot(payload []byte) []byte {
+
+	var leaves [][]byte
+	for start := 0; start < len(payload); start += PayloadChunkSize {
+
+		end := start + PayloadChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		leaves = append(leaves, hashNode(0, payload[start:end]))
+	}
+
+	return MerkleRoot(leaves)
+}
+
+// MerkleRoot returns the root of the Merkle tree with the given leaves.
+// The last node of a level is paired with itself if the level has an odd number of nodes.
+// The root of an empty tree is the hash of an empty leaf
+func MerkleRoot(leaves [][]byte) []byte {
+
+	if len(leaves) == 0 {
+		return hashNode(0, nil)
+	}
+
+	level := leaves
+	for len(level) > 1 {
+
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+
+			next = append(next, hashNode(1, level[i], right))
+		}
+
+		level = next
+	}
+
+	return level[0]
+}
+
+// hashNode hashes the concatenation of the parts prefixed with a byte distinguishing leaves from inner nodes
+func hashNode(prefix byte, parts ...[]byte) []byte {
+
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
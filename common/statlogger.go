@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -14,6 +15,9 @@ const (
 	Echo
 	Accept
 	EndOfRound
+	Reorg
+	DiscardedTransactions
+	Reconstruction
 )
 
 func (e EventType) String() string {
@@ -28,67 +32,168 @@ func (e EventType) String() string {
 		return "ACCEPT"
 	case EndOfRound:
 		return "END_OF_ROUND"
+	case Reorg:
+		return "REORG"
+	case DiscardedTransactions:
+		return "DISCARDED_TRANSACTIONS"
+	case Reconstruction:
+		return "RECONSTRUCTION"
 	default:
 		panic(fmt.Errorf("undefined enum value %d", e))
 	}
 }
 
 type Event struct {
-	Round       int
-	Type        EventType
+	Round int
+	Type  EventType
+	// ElapsedTime is in milliseconds. It is zero for the events that are not timed
 	ElapsedTime int
+	// Value is the number of removed macroblocks for REORG events, and the number of discarded transactions
+	// for DISCARDED_TRANSACTIONS events. It is zero for timed events
+	Value int
 }
 
 type StatList struct {
 	IPAddress  string
 	PortNumber int
 	NodeID     int
-	Events     []Event
+	// PublicKey is the key the node signs its blocks with
+	PublicKey []byte
+	Events    []Event
+	// Counters keeps the final value of each counter by name
+	Counters map[string]int
 }
 
 type StatLogger struct {
+	mutex sync.Mutex
+
 	round      int
 	roundStart time.Time
 	nodeID     int
 
-	events []Event
+	events   []Event
+	counters map[string]int
 }
 
 func NewStatLogger(nodeID int) *StatLogger {
-	return &StatLogger{nodeID: nodeID}
+	return &StatLogger{nodeID: nodeID, counters: make(map[string]int)}
 }
 
 func (s *StatLogger) NewRound(round int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	s.round = round
 	s.roundStart = time.Now()
 }
 
 func (s *StatLogger) LogPropose(elapsedTime int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "PROPOSE", elapsedTime)
 	s.events = append(s.events, Event{Round: s.round, Type: Proposed, ElapsedTime: int(elapsedTime)})
 }
 
 func (s *StatLogger) LogBlockReceive(elapsedTime int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "BLOCK_RECEIVED", elapsedTime)
 	s.events = append(s.events, Event{Round: s.round, Type: BlockReceived, ElapsedTime: int(elapsedTime)})
 }
 
 func (s *StatLogger) LogEcho(elapsedTime int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "ECHO", elapsedTime)
 	s.events = append(s.events, Event{Round: s.round, Type: Echo, ElapsedTime: int(elapsedTime)})
 }
 
 func (s *StatLogger) LogAccept(elapsedTime int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "ACCEPT", elapsedTime)
 	s.events = append(s.events, Event{Round: s.round, Type: Accept, ElapsedTime: int(elapsedTime)})
 }
 
 func (s *StatLogger) LogEndOfRound() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	elapsedTime := time.Since(s.roundStart).Milliseconds()
 	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "END_OF_ROUND", elapsedTime)
 	s.events = append(s.events, Event{Round: s.round, Type: EndOfRound, ElapsedTime: int(elapsedTime)})
 }
 
+// LogReorg logs a reorganization of the canonical chain with its depth
+func (s *StatLogger) LogReorg(depth int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "REORG", depth)
+	s.events = append(s.events, Event{Round: s.round, Type: Reorg, Value: depth})
+}
+
+// LogDiscardedTransactions logs the number of transactions of the round's macroblock discarded because of conflicts between its microblocks
+func (s *StatLogger) LogDiscardedTransactions(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "DISCARDED_TRANSACTIONS", count)
+	s.events = append(s.events, Event{Round: s.round, Type: DiscardedTransactions, Value: count})
+}
+
+// LogReconstruction logs the time between the first fragment of an erasure coded block and its reconstruction
+func (s *StatLogger) LogReconstruction(elapsedTime int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Printf("stats\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, "RECONSTRUCTION", elapsedTime)
+	s.events = append(s.events, Event{Round: s.round, Type: Reconstruction, ElapsedTime: int(elapsedTime)})
+}
+
+// IncrementCounter increments the counter with the given name by one
+func (s *StatLogger) IncrementCounter(name string) {
+	s.AddToCounter(name, 1)
+}
+
+// AddToCounter adds the value to the counter with the given name
+func (s *StatLogger) AddToCounter(name string, value int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counters[name] += value
+	log.Printf("counter\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, name, s.counters[name])
+}
+
+// SetCounter sets the counter with the given name to the value
+func (s *StatLogger) SetCounter(name string, value int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counters[name] = value
+	log.Printf("counter\t%d\t%d\t%s\t%d\t", s.nodeID, s.round, name, value)
+}
+
+// GetCounters returns a copy of the counters
+func (s *StatLogger) GetCounters() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counters := make(map[string]int, len(s.counters))
+	for name, value := range s.counters {
+		counters[name] = value
+	}
+
+	return counters
+}
+
 func (s *StatLogger) GetEvents() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	return s.events
 }
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errTrailingData = errors.New("data contains trailing bytes")
+
+// OutPoint references an output of a transaction
+type OutPoint struct {
+	TxHash []byte
+	Index  int
+}
+
+// Key returns a string that identifies the outpoint
+func (o OutPoint) Key() string {
+	return fmt.Sprintf("%x:%d", o.TxHash, o.Index)
+}
+
+// TxInput spends an output. The signature is produced by the owner of the output over the transaction hash
+type TxInput struct {
+	PrevOut   OutPoint
+	Signature []byte
+}
+
+// TxOutput transfers value to the owner of a public key
+type TxOutput struct {
+	Value     int64
+	PublicKey []byte
+}
+
+// Transaction defines a transfer of value between ed25519 keys
+type Transaction struct {
+	// CoinbaseHeight is the height of the block for coinbase transactions, otherwise it is zero
+	CoinbaseHeight int
+
+	Inputs  []TxInput
+	Outputs []TxOutput
+}
+
+// IsCoinbase returns true if the transaction creates new value without spending outputs
+func (tx Transaction) IsCoinbase() bool {
+	return len(tx.Inputs) == 0
+}
+
+// Hash produces the digest of a transaction.
+// It considers all fields of a transaction except input signatures.
+func (tx Transaction) Hash() []byte {
+
+	e := &Encoder{}
+	tx.encode(e, false)
+
+	h := sha256.New()
+	_, err := h.Write(e.Bytes())
+	if err != nil {
+		panic(err)
+	}
+
+	return h.Sum(nil)
+}
+
+// WitnessHash produces the digest of the whole transaction encoding, input signatures included.
+// Copies of a transaction with different signatures have the same hash, but different witness hashes
+func (tx Transaction) WitnessHash() []byte {
+
+	e := &Encoder{}
+	tx.encode(e, true)
+
+	hash := sha256.Sum256(e.Bytes())
+	return hash[:]
+}
+
+// ShortTransactionID returns the identifier of a transaction in a compact block, the first 8 bytes of its hash.
+// It is not salted, so the mempool can index its transactions by it. Colliding transactions are requested in full
+func ShortTransactionID(txHash []byte) uint64 {
+	return binary.BigEndian.Uint64(txHash[:8])
+}
+
+// Size returns the number of bytes of the encoded transaction
+func (tx Transaction) Size() int {
+
+	e := &Encoder{}
+	tx.encode(e, true)
+
+	return len(e.Bytes())
+}
+
+func (tx Transaction) encode(e *Encoder, withSignatures bool) {
+
+	e.WriteVarint(int64(tx.CoinbaseHeight))
+
+	e.WriteUvarint(uint64(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		e.WriteBytes(input.PrevOut.TxHash)
+		e.WriteVarint(int64(input.PrevOut.Index))
+		if withSignatures {
+			e.WriteBytes(input.Signature)
+		}
+	}
+
+	e.WriteUvarint(uint64(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		e.WriteVarint(output.Value)
+		e.WriteBytes(output.PublicKey)
+	}
+}
+
+func decodeTransaction(d *Decoder) (Transaction, error) {
+
+	tx := Transaction{}
+
+	coinbaseHeight, err := d.ReadVarint()
+	if err != nil {
+		return tx, err
+	}
+	tx.CoinbaseHeight = int(coinbaseHeight)
+
+	// an encoded input takes at least 3 bytes
+	inputCount, err := d.ReadLength(3)
+	if err != nil {
+		return tx, err
+	}
+
+	for i := 0; i < inputCount; i++ {
+
+		input := TxInput{}
+		if input.PrevOut.TxHash, err = d.ReadBytes(); err != nil {
+			return tx, err
+		}
+
+		index, err := d.ReadVarint()
+		if err != nil {
+			return tx, err
+		}
+		input.PrevOut.Index = int(index)
+
+		if input.Signature, err = d.ReadBytes(); err != nil {
+			return tx, err
+		}
+
+		tx.Inputs = append(tx.Inputs, input)
+	}
+
+	// an encoded output takes at least 2 bytes
+	outputCount, err := d.ReadLength(2)
+	if err != nil {
+		return tx, err
+	}
+
+	for i := 0; i < outputCount; i++ {
+
+		output := TxOutput{}
+		if output.Value, err = d.ReadVarint(); err != nil {
+			return tx, err
+		}
+
+		if output.PublicKey, err = d.ReadBytes(); err != nil {
+			return tx, err
+		}
+
+		tx.Outputs = append(tx.Outputs, output)
+	}
+
+	return tx, nil
+}
+
+// EncodeTransactions encodes a list of transactions to be used as a block payload
+func EncodeTransactions(txs []Transaction) []byte {
+
+	e := &Encoder{}
+	e.WriteUvarint(uint64(len(txs)))
+	for _, tx := range txs {
+		tx.encode(e, true)
+	}
+
+	return e.Bytes()
+}
+
+// DecodeTransactions decodes a block payload produced by EncodeTransactions
+func DecodeTransactions(payload []byte) ([]Transaction, error) {
+
+	d := NewDecoder(payload)
+
+	// an encoded transaction takes at least 3 bytes
+	count, err := d.ReadLength(3)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := make([]Transaction, 0, count)
+	for i := 0; i < count; i++ {
+		tx, err := decodeTransaction(d)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+
+	if d.Remaining() != 0 {
+		return nil, errTrailingData
+	}
+
+	return txs, nil
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransactionEncoding(t *testing.T) {
+
+	txs := []Transaction{
+		{CoinbaseHeight: 3, Outputs: []TxOutput{{Value: 50, PublicKey: []byte("key-1")}}},
+		{
+			Inputs:  []TxInput{{PrevOut: OutPoint{TxHash: []byte("hash"), Index: 2}, Signature: []byte("signature")}},
+			Outputs: []TxOutput{{Value: 20, PublicKey: []byte("key-2")}, {Value: 30, PublicKey: []byte("key-3")}},
+		},
+	}
+
+	payload := EncodeTransactions(txs)
+
+	decoded, err := DecodeTransactions(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != len(txs) {
+		t.Fatalf("expected %d transactions, decoded %d", len(txs), len(decoded))
+	}
+
+	for i := range txs {
+		if !bytes.Equal(txs[i].Hash(), decoded[i].Hash()) {
+			t.Errorf("decoded transaction %d is faulty", i)
+		}
+	}
+
+	if !bytes.Equal(decoded[1].Inputs[0].Signature, txs[1].Inputs[0].Signature) {
+		t.Errorf("decoded signature is faulty")
+	}
+
+	// the signatures change the witness hash, but not the hash
+	resigned := decoded[1]
+	resigned.Inputs = []TxInput{{PrevOut: resigned.Inputs[0].PrevOut, Signature: []byte("other signature")}}
+	if !bytes.Equal(resigned.Hash(), txs[1].Hash()) || bytes.Equal(resigned.WitnessHash(), txs[1].WitnessHash()) {
+		t.Errorf("signatures are not covered by the witness hash only")
+	}
+
+	if _, err := DecodeTransactions(payload[:len(payload)-1]); err == nil {
+		t.Errorf("truncated payload is decoded")
+	}
+
+	if _, err := DecodeTransactions([]byte("hello world")); err == nil {
+		t.Errorf("random payload is decoded")
+	}
+}
@@ -2,9 +2,16 @@ package common
 
 import (
 	"crypto/sha256"
-	"fmt"
+	"errors"
 )
 
+// BlockEncodingVersion is the version of the binary encoding of blocks and block headers.
+// It is the first field of an encoding, and it is part of the block hash and the signing hash
+const BlockEncodingVersion = 1
+
+// ErrUnsupportedVersion is returned when decoding a block or a block header of an unknown encoding version
+var ErrUnsupportedVersion = errors.New("unsupported block encoding version")
+
 // Block defines blockchain block structure
 type Block struct {
 	Issuer []byte
@@ -15,21 +22,300 @@ type Block struct {
 
 	Nonce int64
 
+	// Timestamp is the mining time of the block in milliseconds since epoch
+	Timestamp int64
+
+	// Difficulty is the expected number of hashes to mine the block
+	Difficulty int64
+
+	// PayloadSize is the size of the payload in bytes
+	PayloadSize int
+
+	// PayloadRoot is the Merkle root of the payload chunks. It is set by SetPayload
+	PayloadRoot []byte
+
 	Signature []byte
 
 	Payload []byte
 }
 
-// Hash produces the digest of a Block.
-// It considers all fields of a Block.
+// BlockHeader contains the fields of a block except the payload.
+// It commits to the payload with the payload size and the Merkle root of the payload chunks,
+// so it can be validated and propagated before the payload is available
+type BlockHeader struct {
+	Issuer []byte
+
+	PrevBlockHashes [][]byte
+
+	Height int
+
+	Nonce int64
+
+	Timestamp int64
+
+	Difficulty int64
+
+	PayloadSize int
+
+	PayloadRoot []byte
+
+	Signature []byte
+}
+
+// SetPayload sets the payload of the block, and the payload fields of the header
+func (b *Block) SetPayload(payload []byte) {
+
+	b.Payload = payload
+	b.PayloadSize = len(payload)
+	b.PayloadRoot = PayloadRoot(payload)
+}
+
+// HasValidPayload returns true if the payload matches the payload size and the payload root of the header
+func (b Block) HasValidPayload() bool {
+
+	return b.PayloadSize == len(b.Payload) && string(b.PayloadRoot) == string(PayloadRoot(b.Payload))
+}
+
+// Header returns the header of the block
+func (b Block) Header() BlockHeader {
+
+	return BlockHeader{
+		Issuer:          b.Issuer,
+		PrevBlockHashes: b.PrevBlockHashes,
+		Height:          b.Height,
+		Nonce:           b.Nonce,
+		Timestamp:       b.Timestamp,
+		Difficulty:      b.Difficulty,
+		PayloadSize:     b.PayloadSize,
+		PayloadRoot:     b.PayloadRoot,
+		Signature:       b.Signature,
+	}
+}
+
+// Hash produces the digest of a Block. It is the hash of the block header
 func (b Block) Hash() []byte {
 
-	str := fmt.Sprintf("%x,%x,%d,%d,%x", b.Issuer, b.PrevBlockHashes, b.Height, b.Nonce, b.Payload)
-	h := sha256.New()
-	_, err := h.Write([]byte(str))
+	return b.Header().Hash()
+}
+
+// SigningHash produces the digest of a Block signed by its issuer. It is the signing hash of the block header
+func (b Block) SigningHash() []byte {
+
+	return b.Header().SigningHash()
+}
+
+// Block creates a block from the header and the payload
+func (h BlockHeader) Block(payload []byte) Block {
+
+	return Block{
+		Issuer:          h.Issuer,
+		PrevBlockHashes: h.PrevBlockHashes,
+		Height:          h.Height,
+		Nonce:           h.Nonce,
+		Timestamp:       h.Timestamp,
+		Difficulty:      h.Difficulty,
+		PayloadSize:     h.PayloadSize,
+		PayloadRoot:     h.PayloadRoot,
+		Signature:       h.Signature,
+		Payload:         payload,
+	}
+}
+
+// Hash produces the digest of a block header identifying the block. It is the sha256 digest of the header encoding,
+// signature included, so a copy of a block with a different signature has a different hash
+func (h BlockHeader) Hash() []byte {
+
+	hash := sha256.Sum256(h.Encode())
+	return hash[:]
+}
+
+// SigningHash produces the digest signed by the issuer of the block, and searched by proof of work.
+// It is the sha256 digest of the header encoding without the signature, because the signature is produced over it
+func (h BlockHeader) SigningHash() []byte {
+
+	e := &Encoder{}
+	h.encode(e, false)
+
+	hash := sha256.Sum256(e.Bytes())
+	return hash[:]
+}
+
+// Encode returns the canonical binary encoding of the header. It is used for the wire and for storage
+func (h BlockHeader) Encode() []byte {
+
+	e := &Encoder{}
+	h.encode(e, true)
+
+	return e.Bytes()
+}
+
+// DecodeBlockHeader decodes a header produced by BlockHeader.Encode
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+
+	d := NewDecoder(data)
+	header, err := decodeBlockHeader(d)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	if d.Remaining() != 0 {
+		return BlockHeader{}, errTrailingData
+	}
+
+	return header, nil
+}
+
+// GobEncode makes gob, and so the RPC layer, send headers in the canonical encoding
+func (h BlockHeader) GobEncode() ([]byte, error) {
+
+	return h.Encode(), nil
+}
+
+// GobDecode decodes a header sent by GobEncode
+func (h *BlockHeader) GobDecode(data []byte) error {
+
+	header, err := DecodeBlockHeader(data)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	*h = header
+	return nil
+}
+
+// Encode returns the canonical binary encoding of the block. It is the header encoding followed by the payload
+func (b Block) Encode() []byte {
+
+	e := &Encoder{}
+	b.Header().encode(e, true)
+	e.WriteBytes(b.Payload)
+
+	return e.Bytes()
+}
+
+// DecodeBlock decodes a block produced by Block.Encode
+func DecodeBlock(data []byte) (Block, error) {
+
+	d := NewDecoder(data)
+	header, err := decodeBlockHeader(d)
+	if err != nil {
+		return Block{}, err
+	}
+
+	payload, err := d.ReadBytes()
+	if err != nil {
+		return Block{}, err
+	}
+
+	if d.Remaining() != 0 {
+		return Block{}, errTrailingData
+	}
+
+	return header.Block(payload), nil
+}
+
+// GobEncode makes gob, and so the RPC layer, send blocks in the canonical encoding
+func (b Block) GobEncode() ([]byte, error) {
+
+	return b.Encode(), nil
+}
+
+// GobDecode decodes a block sent by GobEncode
+func (b *Block) GobDecode(data []byte) error {
+
+	block, err := DecodeBlock(data)
+	if err != nil {
+		return err
+	}
+
+	*b = block
+	return nil
+}
+
+func (h BlockHeader) encode(e *Encoder, withSignature bool) {
+
+	e.WriteUvarint(BlockEncodingVersion)
+	e.WriteBytes(h.Issuer)
+
+	e.WriteUvarint(uint64(len(h.PrevBlockHashes)))
+	for _, prevBlockHash := range h.PrevBlockHashes {
+		e.WriteBytes(prevBlockHash)
+	}
+
+	e.WriteVarint(int64(h.Height))
+	e.WriteVarint(h.Nonce)
+	e.WriteVarint(h.Timestamp)
+	e.WriteVarint(h.Difficulty)
+	e.WriteVarint(int64(h.PayloadSize))
+	e.WriteBytes(h.PayloadRoot)
+
+	if withSignature {
+		e.WriteBytes(h.Signature)
+	}
+}
+
+func decodeBlockHeader(d *Decoder) (BlockHeader, error) {
+
+	header := BlockHeader{}
+
+	version, err := d.ReadUvarint()
+	if err != nil {
+		return header, err
+	}
+
+	if version != BlockEncodingVersion {
+		return header, ErrUnsupportedVersion
+	}
+
+	if header.Issuer, err = d.ReadBytes(); err != nil {
+		return header, err
+	}
+
+	// an encoded hash takes at least 1 byte
+	prevBlockCount, err := d.ReadLength(1)
+	if err != nil {
+		return header, err
+	}
+
+	for i := 0; i < prevBlockCount; i++ {
+		prevBlockHash, err := d.ReadBytes()
+		if err != nil {
+			return header, err
+		}
+		header.PrevBlockHashes = append(header.PrevBlockHashes, prevBlockHash)
+	}
+
+	height, err := d.ReadVarint()
+	if err != nil {
+		return header, err
+	}
+	header.Height = int(height)
+
+	if header.Nonce, err = d.ReadVarint(); err != nil {
+		return header, err
+	}
+
+	if header.Timestamp, err = d.ReadVarint(); err != nil {
+		return header, err
+	}
+
+	if header.Difficulty, err = d.ReadVarint(); err != nil {
+		return header, err
+	}
+
+	payloadSize, err := d.ReadVarint()
+	if err != nil {
+		return header, err
+	}
+	header.PayloadSize = int(payloadSize)
+
+	if header.PayloadRoot, err = d.ReadBytes(); err != nil {
+		return header, err
+	}
+
+	if header.Signature, err = d.ReadBytes(); err != nil {
+		return header, err
 	}
 
-	return h.Sum(nil)
+	return header, nil
 }
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestBlockHeader(t *testing.T) {
+
+	block := Block{Issuer: []byte("issuer"), Height: 3, Nonce: 7}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 3*PayloadChunkSize))
+
+	if !block.HasValidPayload() {
+		t.Fatalf("payload does not match the header")
+	}
+
+	header := block.Header()
+	if !bytes.Equal(header.Hash(), block.Hash()) {
+		t.Errorf("block hash is not the header hash")
+	}
+
+	rebuilt := header.Block(block.Payload)
+	if !bytes.Equal(rebuilt.Hash(), block.Hash()) || !rebuilt.HasValidPayload() {
+		t.Errorf("block rebuilt from the header is not the same block")
+	}
+
+	// changing a single byte of the payload changes the payload root
+	tampered := append([]byte{}, block.Payload...)
+	tampered[len(tampered)-1]++
+	if header.Block(tampered).HasValidPayload() {
+		t.Errorf("tampered payload matches the header")
+	}
+
+	if header.Block(block.Payload[:len(block.Payload)-1]).HasValidPayload() {
+		t.Errorf("truncated payload matches the header")
+	}
+
+	if bytes.Equal(PayloadRoot(nil), PayloadRoot([]byte{0})) {
+		t.Errorf("empty payload has the same root as a non-empty payload")
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+
+	block := Block{Issuer: []byte("issuer"), PrevBlockHashes: [][]byte{[]byte("first"), []byte("second")}, Height: 3, Nonce: -7, Timestamp: 1000, Difficulty: 42}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 100))
+	block.Signature = []byte("signature")
+
+	encoded := block.Encode()
+	decoded, err := DecodeBlock(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, block) {
+		t.Errorf("decoded block is not the original block")
+	}
+
+	// the encoding is canonical
+	if !bytes.Equal(decoded.Encode(), encoded) {
+		t.Errorf("encoding of the decoded block is different")
+	}
+
+	header, err := DecodeBlockHeader(block.Header().Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(header, block.Header()) {
+		t.Errorf("decoded header is not the original header")
+	}
+
+	// the signature is part of the hash, but not of the signing hash
+	signed := block
+	signed.Signature = []byte("other signature")
+	if bytes.Equal(signed.Hash(), block.Hash()) {
+		t.Errorf("blocks with different signatures have the same hash")
+	}
+
+	if !bytes.Equal(signed.SigningHash(), block.SigningHash()) {
+		t.Errorf("signature changes the signing hash")
+	}
+
+	moved := block
+	moved.PrevBlockHashes = [][]byte{[]byte("firsts"), []byte("econd")}
+	if bytes.Equal(moved.Hash(), block.Hash()) {
+		t.Errorf("blocks with different parents have the same hash")
+	}
+
+	if _, err := DecodeBlock(encoded[:len(encoded)-1]); err == nil {
+		t.Errorf("truncated block is decoded")
+	}
+
+	if _, err := DecodeBlock(append(encoded, 0)); err == nil {
+		t.Errorf("block with trailing data is decoded")
+	}
+
+	unknown := append([]byte{BlockEncodingVersion + 1}, encoded[1:]...)
+	if _, err := DecodeBlock(unknown); err != ErrUnsupportedVersion {
+		t.Errorf("expected %s, got %v", ErrUnsupportedVersion, err)
+	}
+
+	// gob sends blocks in the canonical encoding
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(block); err != nil {
+		t.Fatal(err)
+	}
+
+	var received Block
+	if err := gob.NewDecoder(&buffer).Decode(&received); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, block) {
+		t.Errorf("block sent with gob is not the original block")
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/mempool"
 	"github.com/korkmazkadir/bitcoin/network"
 	"github.com/korkmazkadir/bitcoin/registery"
+	"github.com/korkmazkadir/bitcoin/storage"
 )
 
 type Bitcoin struct {
@@ -20,25 +22,52 @@ type Bitcoin struct {
 	ledger     *Ledger
 	publickKey []byte
 	privateKey []byte
+	wallet     *wallet
+	mempool    *mempool.Mempool
+
+	// blockSync requests missing blocks, and announces the tip. It is nil if block sync is not enabled
+	blockSync *network.BlockSync
+
+	// issuers keeps the validator keys published by the registry. Blocks of other issuers are rejected
+	issuers *issuerSet
 }
 
-func NewBitcoin(demux *common.Demux, nodeConfig registery.NodeConfig, peerSet network.PeerSet, statLogger *common.StatLogger) *Bitcoin {
+// NewBitcoin creates the consensus layer. The ledger keeps its blocks in the store, and it is rebuilt from the blocks already in the store.
+// Blocks are signed with the private key, which also owns the outputs spent by the node.
+// Received blocks are accepted only from the validator keys, and all of them are rejected if there is not any validator key
+func NewBitcoin(demux *common.Demux, nodeConfig registery.NodeConfig, peerSet network.PeerSet, statLogger *common.StatLogger, store storage.BlockStore, privateKey ed25519.PrivateKey, validatorKeys [][]byte) *Bitcoin {
+
+	ledger, err := NewLedgerWithStore(nodeConfig.LeaderCount, store)
+	if err != nil {
+		panic(err)
+	}
 
 	consensus := &Bitcoin{
 		demux:      demux,
 		config:     nodeConfig,
 		peerSet:    peerSet,
 		statLogger: statLogger,
-		ledger:     NewLedger(nodeConfig.LeaderCount),
+		ledger:     ledger,
+		mempool:    newMempool(nodeConfig),
+		issuers:    newIssuerSet(validatorKeys),
 	}
 
-	pubKey, privKey, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		panic(err)
-	}
+	consensus.ledger.difficulty = newDifficultyAdjuster(nodeConfig)
+	consensus.ledger.reorgHandler = consensus.logReorg
+	consensus.ledger.tipHandler = consensus.handleTipChange
+	consensus.addValidationRules()
+
+	pubKey := privateKey.Public().(ed25519.PublicKey)
 
 	consensus.publickKey = pubKey
-	consensus.privateKey = privKey
+	consensus.privateKey = privateKey
+	consensus.wallet = newWallet(pubKey, privateKey)
+
+	// received blocks are verified before they are appended or forwarded. The validator keys are set before,
+	// so no block is accepted from an unknown issuer
+	demux.SetBlockValidator(consensus.validateReceivedBlock)
+	demux.SetHeaderValidator(consensus.validateReceivedHeader)
+	demux.SetStatLogger(statLogger)
 
 	// starts a task to disseminate blocks in the background
 	go consensus.disseminate()
@@ -51,69 +80,315 @@ func (b *Bitcoin) GetMacroBlock(round int) ([]common.Block, bool) {
 	return b.ledger.GetMacroBlock(round)
 }
 
-// MineBlock implements simulated mining
+// SetBlockSync enables requesting the missing parents of received blocks, and announcing the tip to the peers
+func (b *Bitcoin) SetBlockSync(blockSync *network.BlockSync) {
+
+	b.blockSync = blockSync
+	blockSync.AnnounceTip(b.ledger.tip.height, hashMacroBlock(b.ledger.tip.blocks))
+}
+
+// SetValidatorKeys replaces the keys allowed to issue blocks. Received blocks of other issuers are rejected,
+// and all of them are rejected if the keys are empty
+func (b *Bitcoin) SetValidatorKeys(keys [][]byte) {
+
+	b.issuers.set(keys)
+}
+
+// Ledger returns the ledger of the node. Its query methods can be called while the node is mining
+func (b *Bitcoin) Ledger() *Ledger {
+
+	return b.ledger
+}
+
+// Mempool returns the mempool of the node
+func (b *Bitcoin) Mempool() *mempool.Mempool {
+
+	return b.mempool
+}
+
+// MineBlock mines a microblock for the height of the given block, and returns the macroblock once all of its microblocks are available
 func (b *Bitcoin) MineBlock(block common.Block) []common.Block {
 
 	// sets block issuer
 	block.Issuer = b.publickKey
 
+	// spends the outputs of the node to fill the mempool
+	b.generateTransactions()
+
+	// sets block parents, difficulty and payload
+	b.switchToCanonicalParent(&block)
+	b.prepareBlock(&block)
+
 	b.statLogger.NewRound(block.Height)
+	b.demux.UpdateRound(block.Height, b.ledger.FinalizedHeight())
 
-	simulatedMiningTime := b.miningTime()
+	// the macroblock may be already available if the node is lagging behind
+	if blocks, roundFinished := b.ledger.GetMacroBlock(block.Height); roundFinished {
+		b.endRound(block.Height)
+		return blocks
+	}
+
+	if b.config.MiningMode == registery.ProofOfWorkMining {
+		return b.mineWithProofOfWork(block)
+	}
+
+	return b.simulateMining(block)
+}
+
+// simulateMining implements simulated mining
+func (b *Bitcoin) simulateMining(block common.Block) []common.Block {
+
+	simulatedMiningTime := b.miningTime(block.Difficulty)
 	blockChan := b.demux.GetBlockChan()
+	transactionChan := b.demux.GetTransactionChan()
 
-	log.Printf("Mining time is %d \n", simulatedMiningTime)
+	// the timer is not restarted when a message is received
+	miningTimer := time.NewTimer(simulatedMiningTime)
+	defer miningTimer.Stop()
+
+	log.Printf("Mining time is %s \n", simulatedMiningTime)
 
 	for {
 		select {
 
-		case blockToAppend := <-blockChan:
+		case tx := <-transactionChan:
 
-			microBlockIndex := int(blockToAppend.Nonce % int64(b.ledger.concurrencyLevel))
+			b.handleTransaction(tx)
 
-			log.Printf("[%d] Received:\t%x\tHeight: %d\n", microBlockIndex, blockToAppend.Hash(), blockToAppend.Height)
-
-			// appends the received block to the ledger
-			b.ledger.AppendBlock(blockToAppend)
+		case blockToAppend := <-blockChan:
 
-			// gets the macroblock
-			blocks, roundFinished := b.ledger.GetMacroBlock(block.Height)
+			blocks, roundFinished := b.appendReceivedBlock(blockToAppend, block.Height)
 			if roundFinished {
-				b.statLogger.LogEndOfRound()
 				return blocks
 			}
 
-		case <-time.After(time.Duration(simulatedMiningTime) * time.Second):
+			b.switchToCanonicalParent(&block)
+
+		case <-miningTimer.C:
 
 			block.Nonce = produceRandomNonce()
-			microBlockIndex := b.getBlockIndex(block.Nonce)
-			_, blockAvailable := b.ledger.GetMicroblock(block.Height, microBlockIndex)
-			// appends the mined block if there is not a block mined for the specific index
-			if !blockAvailable {
-				// signs the block
-				block.Signature = Sign(block.Hash(), b.privateKey)
-				b.ledger.AppendBlock(block)
-
-				log.Printf("[%d] Mined:\t\t%x\tHeight: %d\n", microBlockIndex, block.Hash(), block.Height)
-			}
+			block.Timestamp = currentTimestamp()
 
-			// gets the macroblock
-			blocks, roundFinished := b.ledger.GetMacroBlock(block.Height)
+			blocks, roundFinished := b.appendMinedBlock(block)
 			if roundFinished {
-				b.statLogger.LogEndOfRound()
 				log.Println("end of round")
 				return blocks
 			}
 
 			log.Println("Unsuccessful mining...")
 			// if its is here, it means that there are missing microblocks. The current node should try to mine
-			simulatedMiningTime = b.miningTime()
-			log.Printf("Mining time is %d \n", simulatedMiningTime)
+			simulatedMiningTime = b.miningTime(block.Difficulty)
+			miningTimer.Reset(simulatedMiningTime)
+			log.Printf("Mining time is %s \n", simulatedMiningTime)
+
+		}
+
+	}
+
+}
+
+// mineWithProofOfWork searches nonces until the signing hash of the block meets the difficulty target
+func (b *Bitcoin) mineWithProofOfWork(block common.Block) []common.Block {
+
+	target := difficultyTarget(block.Difficulty)
+	blockChan := b.demux.GetBlockChan()
+	transactionChan := b.demux.GetTransactionChan()
+
+	miner := startMiner(block, b.config.MinerCount, target)
+	defer func() { miner.Stop() }()
+
+	log.Printf("Mining with %d workers, difficulty is %d \n", b.config.MinerCount, block.Difficulty)
+
+	for {
+		select {
+
+		case tx := <-transactionChan:
+
+			b.handleTransaction(tx)
+
+		case blockToAppend := <-blockChan:
+
+			blocks, roundFinished := b.appendReceivedBlock(blockToAppend, block.Height)
+			if roundFinished {
+				return blocks
+			}
+
+			// restarts mining on top of the new branch
+			if b.switchToCanonicalParent(&block) {
+				miner.Stop()
+				target = difficultyTarget(block.Difficulty)
+				miner = startMiner(block, b.config.MinerCount, target)
+			}
+
+		case minedBlock := <-miner.Found():
+
+			blocks, roundFinished := b.appendMinedBlock(minedBlock)
+			if roundFinished {
+				log.Println("end of round")
+				return blocks
+			}
 
 		}
+	}
+}
+
+// appendReceivedBlock appends a block received from the network, and returns the macroblock of the given height if it is available
+func (b *Bitcoin) appendReceivedBlock(blockToAppend common.Block, height int) ([]common.Block, bool) {
+
+	microBlockIndex := b.getBlockIndex(blockToAppend.Nonce)
+
+	log.Printf("[%d] Received:\t%x\tHeight: %d\n", microBlockIndex, blockToAppend.Hash(), blockToAppend.Height)
+
+	// appends the received block to the ledger
+	b.ledger.AppendBlock(blockToAppend)
+
+	// the block waits for its parents, so they are requested
+	if missing := b.ledger.missingParents(blockToAppend); len(missing) > 0 && b.blockSync != nil {
+		b.blockSync.RequestBlocks(missing)
+	}
+
+	// gets the macroblock
+	blocks, roundFinished := b.ledger.GetMacroBlock(height)
+	if roundFinished {
+		b.endRound(height)
+	}
+
+	return blocks, roundFinished
+}
+
+// appendMinedBlock appends a mined block if there is not a block for the same microblock index,
+// and returns the macroblock of the block height if it is available
+func (b *Bitcoin) appendMinedBlock(block common.Block) ([]common.Block, bool) {
+
+	microBlockIndex := b.getBlockIndex(block.Nonce)
+	_, blockAvailable := b.ledger.GetMicroblock(block.Height, microBlockIndex)
+	// appends the mined block if there is not a block mined for the specific index
+	if !blockAvailable {
+		// signs the block
+		block.Signature = Sign(block.SigningHash(), b.privateKey)
+		b.ledger.AppendBlock(block)
+
+		log.Printf("[%d] Mined:\t\t%x\tHeight: %d\n", microBlockIndex, block.Hash(), block.Height)
+	}
 
+	// gets the macroblock
+	blocks, roundFinished := b.ledger.GetMacroBlock(block.Height)
+	if roundFinished {
+		b.endRound(block.Height)
 	}
 
+	return blocks, roundFinished
+}
+
+// addValidationRules adds the rules that depend on the node config to the validation pipeline of the ledger
+func (b *Bitcoin) addValidationRules() {
+
+	v := b.ledger.validator
+	v.statLogger = b.statLogger
+
+	if maxPayloadSize := b.maxPayloadSize(); maxPayloadSize > 0 {
+		v.addHeaderRule(checkPayloadSize(maxPayloadSize))
+	}
+
+	v.addHeaderRule(checkKnownIssuer(b.issuers))
+	v.addHeaderRule(checkSignature)
+
+	if b.config.MiningMode == registery.ProofOfWorkMining {
+		v.addHeaderRule(checkProofOfWork)
+	}
+
+	v.addChainRule(checkDifficulty(b.ledger.difficulty))
+	v.addChainRule(checkTransactions(b.ledger))
+}
+
+// validateReceivedBlock is used by the demux to reject invalid blocks before they are appended or forwarded
+func (b *Bitcoin) validateReceivedBlock(block common.Block) error {
+
+	return b.ledger.validator.validateBlock(block)
+}
+
+// validateReceivedHeader is used by the demux to reject invalid headers before their payloads are fetched
+func (b *Bitcoin) validateReceivedHeader(header common.BlockHeader) error {
+
+	return b.ledger.validator.validateHeader(header)
+}
+
+// maxPayloadSize returns the payload size of a microblock of a macroblock of BlockSize bytes
+func (b *Bitcoin) maxPayloadSize() int {
+
+	if b.config.LeaderCount < 1 {
+		return b.config.BlockSize
+	}
+
+	return int(math.Ceil(float64(b.config.BlockSize) / float64(b.config.LeaderCount)))
+}
+
+// switchToCanonicalParent moves the block on top of the canonical macroblock of the previous height.
+// It returns true if the parent of the block has changed because of a reorganization
+func (b *Bitcoin) switchToCanonicalParent(block *common.Block) bool {
+
+	parentBlocks, ok := b.ledger.GetMacroBlock(block.Height - 1)
+	if !ok {
+		// keeps mining on top of the current parent
+		return false
+	}
+
+	parentHashes := hashMacroBlock(parentBlocks)
+	if macroBlockKey(parentHashes) == macroBlockKey(block.PrevBlockHashes) {
+		return false
+	}
+
+	block.PrevBlockHashes = parentHashes
+	b.prepareBlock(block)
+
+	log.Printf("Switched to the canonical branch at height %d\n", block.Height-1)
+
+	return true
+}
+
+// prepareBlock sets the difficulty and the payload of the block determined by its parents
+func (b *Bitcoin) prepareBlock(block *common.Block) {
+
+	difficulty, err := b.ledger.Difficulty(block.PrevBlockHashes)
+	if err != nil {
+		panic(err)
+	}
+	block.Difficulty = difficulty
+
+	utxo, err := b.ledger.utxoSetOf(block.PrevBlockHashes)
+	if err != nil {
+		panic(err)
+	}
+	block.SetPayload(b.createPayload(block.Height, utxo))
+}
+
+// endRound logs the end of the round, the number of transactions of the macroblock discarded because of conflicts between its microblocks,
+// the number of received blocks waiting in the demux queue, and the orphan pool counters
+func (b *Bitcoin) endRound(height int) {
+
+	b.statLogger.LogEndOfRound()
+	b.statLogger.LogDiscardedTransactions(b.ledger.discardedTransactions(height))
+	b.statLogger.SetCounter("DEMUX_QUEUE_DEPTH", b.demux.QueueDepth())
+	b.statLogger.SetCounter("ORPHAN_BLOCKS", b.ledger.OrphanCount())
+	b.statLogger.SetCounter("ORPHAN_EVICTED", b.ledger.EvictedOrphanCount())
+}
+
+// handleTipChange updates the mempool with the transactions of the new canonical chain, and announces the new tip
+func (b *Bitcoin) handleTipChange(connected []*macroBlock, disconnected []*macroBlock) {
+
+	b.updateMempool(connected, disconnected)
+
+	// the ledger is not locked while the handler is called, so the new tip is the last connected macroblock
+	if b.blockSync != nil {
+		tip := connected[len(connected)-1]
+		b.blockSync.AnnounceTip(tip.height, hashMacroBlock(tip.blocks))
+	}
+}
+
+// logReorg reports a reorganization of the canonical chain as a stats event
+func (b *Bitcoin) logReorg(reorg Reorg) {
+
+	b.statLogger.LogReorg(reorg.Depth())
 }
 
 func (b *Bitcoin) getBlockIndex(nonce int64) int {
@@ -130,9 +405,11 @@ func (b *Bitcoin) disseminate() {
 	}
 }
 
-func (b *Bitcoin) miningTime() int {
+// miningTime returns an exponentially distributed mining time whose mean is the time to compute difficulty many hashes
+func (b *Bitcoin) miningTime(difficulty int64) time.Duration {
 
-	return int(-math.Log(1.0-rand.Float64()) * 100 * 1 / (1 / float64(b.config.NodeCount)))
+	meanMiningTime := float64(difficulty) / float64(hashRate(b.config))
+	return time.Duration(-math.Log(1.0-rand.Float64()) * meanMiningTime * float64(time.Second))
 }
 
 func (b *Bitcoin) PrintLedgerStatus() {
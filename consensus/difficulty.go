@@ -0,0 +1,121 @@
+package consensus
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/registery"
+)
+
+// maxRetargetFactor bounds the change of difficulty at a single adjustment, as Bitcoin does
+const maxRetargetFactor = 4
+
+// difficultyAdjuster computes the difficulty of each height from the timestamps of previous macroblocks.
+// All nodes compute the same difficulty because it only depends on the content of the chain.
+type difficultyAdjuster struct {
+	initialDifficulty int64
+	targetRoundTime   time.Duration
+	retargetInterval  int
+}
+
+func newDifficultyAdjuster(config registery.NodeConfig) *difficultyAdjuster {
+
+	adjuster := &difficultyAdjuster{
+		initialDifficulty: config.Difficulty,
+		targetRoundTime:   time.Duration(config.TargetRoundTime) * time.Second,
+		retargetInterval:  config.RetargetInterval,
+	}
+
+	if adjuster.initialDifficulty < 1 {
+		if config.MiningMode == registery.ProofOfWorkMining {
+			adjuster.initialDifficulty = 1
+		} else {
+			// the legacy expected mining time of a node is 100 * NodeCount seconds
+			adjuster.initialDifficulty = 100 * int64(config.NodeCount) * hashRate(config)
+		}
+	}
+
+	return adjuster
+}
+
+// difficulty returns the difficulty of the blocks built on top of the given macroblock
+func (d *difficultyAdjuster) difficulty(parent *macroBlock) (int64, error) {
+
+	// the genesis block does not carry a difficulty
+	if parent.height == 0 {
+		return d.initialDifficulty, nil
+	}
+
+	height := parent.height + 1
+	previousDifficulty := parent.blocks[0].Difficulty
+
+	// difficulty only changes at the first height of an adjustment window
+	if d.retargetInterval < 2 || d.targetRoundTime <= 0 || (height-1)%d.retargetInterval != 0 {
+		return previousDifficulty, nil
+	}
+
+	first := parent.ancestor(height - d.retargetInterval)
+	if first == nil {
+		return 0, fmt.Errorf("macroblock %d is not available", height-d.retargetInterval)
+	}
+
+	// the window contains retargetInterval macroblocks, so retargetInterval-1 intervals are measured
+	actualTimespan := macroBlockTime(parent.blocks) - macroBlockTime(first.blocks)
+	expectedTimespan := int64(d.retargetInterval-1) * d.targetRoundTime.Milliseconds()
+
+	return retarget(previousDifficulty, actualTimespan, expectedTimespan), nil
+}
+
+// retarget scales the difficulty by the ratio of the expected timespan to the actual timespan
+func retarget(difficulty int64, actualTimespan int64, expectedTimespan int64) int64 {
+
+	if actualTimespan < expectedTimespan/maxRetargetFactor {
+		actualTimespan = expectedTimespan / maxRetargetFactor
+	}
+
+	if actualTimespan > expectedTimespan*maxRetargetFactor {
+		actualTimespan = expectedTimespan * maxRetargetFactor
+	}
+
+	if actualTimespan < 1 {
+		actualTimespan = 1
+	}
+
+	newDifficulty := new(big.Int).Mul(big.NewInt(difficulty), big.NewInt(expectedTimespan))
+	newDifficulty.Div(newDifficulty, big.NewInt(actualTimespan))
+
+	if !newDifficulty.IsInt64() {
+		return difficulty * maxRetargetFactor
+	}
+
+	if newDifficulty.Int64() < 1 {
+		return 1
+	}
+
+	return newDifficulty.Int64()
+}
+
+// macroBlockTime is the timestamp of the last mined microblock of a macroblock
+func macroBlockTime(blocks []common.Block) int64 {
+
+	var timestamp int64
+	for i := range blocks {
+		if blocks[i].Timestamp > timestamp {
+			timestamp = blocks[i].Timestamp
+		}
+	}
+
+	return timestamp
+}
+
+// hashRate returns the number of hashes per second a node computes in simulated mining mode
+func hashRate(config registery.NodeConfig) int64 {
+
+	if config.SimulatedHashRate < 1 {
+		return 1
+	}
+
+	return config.SimulatedHashRate
+}
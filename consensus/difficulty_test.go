@@ -0,0 +1,27 @@
+package consensus
+
+import (
+	"testing"
+)
+
+func TestRetarget(t *testing.T) {
+
+	// blocks are mined two times faster than expected
+	if d := retarget(1000, 5000, 10000); d != 2000 {
+		t.Errorf("expected difficulty 2000, got %d", d)
+	}
+
+	// blocks are mined two times slower than expected
+	if d := retarget(1000, 20000, 10000); d != 500 {
+		t.Errorf("expected difficulty 500, got %d", d)
+	}
+
+	// the change is bounded by maxRetargetFactor
+	if d := retarget(1000, 1, 10000); d != 1000*maxRetargetFactor {
+		t.Errorf("expected difficulty %d, got %d", 1000*maxRetargetFactor, d)
+	}
+
+	if d := retarget(1000, 1000000, 10000); d != 1000/maxRetargetFactor {
+		t.Errorf("expected difficulty %d, got %d", 1000/maxRetargetFactor, d)
+	}
+}
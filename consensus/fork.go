@@ -0,0 +1,133 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// macroBlock is a complete set of microblocks of a height, ordered by microblock index.
+// Competing macroblocks of the same height form the branches of the block tree.
+type macroBlock struct {
+	// key identifies the macroblock. It is the concatenation of microblock hashes
+	key string
+
+	// hash is the digest of the macroblock used for tie-breaking
+	hash []byte
+
+	height int
+	blocks []common.Block
+	parent *macroBlock
+
+	// work is the cumulative work of the branch ending with the macroblock
+	work int64
+
+	// discardedTransactions is the number of transactions skipped because they duplicate or conflict with
+	// the transactions of previous microblocks. It is set when the macroblock is applied to a UTXO set
+	discardedTransactions int
+
+	// changes are the changes of the macroblock to the UTXO set of its branch, so the macroblock is disconnected without rebuilding the set.
+	// They are set when the macroblock is applied to a UTXO set
+	changes []utxoChange
+}
+
+// Reorg describes a switch of the canonical chain to a competing branch
+type Reorg struct {
+	// ForkHeight is the height of the last macroblock common to both branches
+	ForkHeight int
+
+	OldTipHeight int
+	NewTipHeight int
+}
+
+// Depth is the number of canonical macroblocks removed by the reorganization
+func (r Reorg) Depth() int {
+	return r.OldTipHeight - r.ForkHeight
+}
+
+func newMacroBlock(blocks []common.Block, parent *macroBlock) *macroBlock {
+
+	hashes := make([][]byte, len(blocks))
+	var work int64
+	for i := range blocks {
+		hashes[i] = blocks[i].Hash()
+		work += blockWork(blocks[i])
+	}
+
+	mb := &macroBlock{
+		key:    macroBlockKey(hashes),
+		hash:   macroBlockHash(hashes),
+		height: blocks[0].Height,
+		blocks: blocks,
+		parent: parent,
+		work:   work,
+	}
+
+	if parent != nil {
+		mb.work += parent.work
+	}
+
+	return mb
+}
+
+// ancestor returns the macroblock of the given height on the branch of the macroblock
+func (mb *macroBlock) ancestor(height int) *macroBlock {
+
+	current := mb
+	for current != nil && current.height > height {
+		current = current.parent
+	}
+
+	if current == nil || current.height != height {
+		return nil
+	}
+
+	return current
+}
+
+// isBetterThan implements the fork choice rule.
+// The branch with the most cumulative work wins, ties are broken by the lowest macroblock hash
+func (mb *macroBlock) isBetterThan(other *macroBlock) bool {
+
+	if other == nil {
+		return true
+	}
+
+	if mb.work != other.work {
+		return mb.work > other.work
+	}
+
+	return bytes.Compare(mb.hash, other.hash) < 0
+}
+
+// blockWork returns the work of a microblock. Blocks without difficulty count as one unit of work
+func blockWork(block common.Block) int64 {
+
+	if block.Difficulty < 1 {
+		return 1
+	}
+
+	return block.Difficulty
+}
+
+// macroBlockKey returns the key of the macroblock formed by the given microblock hashes
+func macroBlockKey(hashes [][]byte) string {
+	return string(bytes.Join(hashes, nil))
+}
+
+// macroBlockHash returns the digest of a macroblock. The digest of a single microblock macroblock is the microblock hash
+func macroBlockHash(hashes [][]byte) []byte {
+
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+
+	h := sha256.New()
+	_, err := h.Write(bytes.Join(hashes, nil))
+	if err != nil {
+		panic(err)
+	}
+
+	return h.Sum(nil)
+}
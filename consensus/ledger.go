@@ -1,149 +1,694 @@
 package consensus
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
 )
 
+var errAlreadyAppended = errors.New("block is already appended")
+
+// finalityDepth is the number of macroblocks on top of a macroblock to consider it final
+const finalityDepth = 6
+
+// Ledger keeps the block tree, and selects the canonical chain. Blocks are appended by the consensus goroutine only.
+// AppendBlock locks the ledger, and the exported query methods lock it for reading, so they can be called from other goroutines
 type Ledger struct {
+	mutex sync.RWMutex
+
 	concurrencyLevel int
 
-	waitList           []common.Block
-	blockMap           map[int][]common.Block
+	// validator applies parent and chain rules to appended blocks
+	validator *validator
+
+	// difficulty computes the difficulty of the next blocks. It is nil if difficulty is not used
+	difficulty *difficultyAdjuster
+
+	// reorgHandler is called each time the canonical chain switches to a competing branch
+	reorgHandler func(Reorg)
+
+	// tipHandler is called each time the tip of the canonical chain changes with the macroblocks added to and removed from the canonical chain
+	tipHandler func(connected []*macroBlock, disconnected []*macroBlock)
+
+	// orphans keeps the blocks whose parents are not appended yet
+	orphans *orphanPool
+
+	// store keeps all appended blocks by hash and by height, including the blocks of competing branches
+	store storage.BlockStore
+
+	// headers keeps the headers of the appended blocks by hash, so the block tree is built without reading the store
+	headers map[string]common.BlockHeader
+
+	// children keeps the hashes of the appended blocks by the key of their parent macroblock
+	children map[string][][]byte
+
+	// blockCounts keeps the number of appended blocks by height
+	blockCounts map[int]int
+
+	// macroBlocks keeps all complete macroblocks by key
+	macroBlocks map[string]*macroBlock
+
+	// canonical keeps the macroblocks of the branch selected by the fork choice rule by height
+	canonical map[int]*macroBlock
+	tip       *macroBlock
+
+	// utxo is the UTXO set after the transactions of the canonical chain up to utxoTip
+	utxo    *utxoSet
+	utxoTip *macroBlock
+
 	readyToDisseminate chan common.Block
+
+	// appended keeps the blocks appended by the current AppendBlock call. They are sent to readyToDisseminate after the ledger is unlocked
+	appended []common.Block
+
+	// tipChanges keeps the tip changes of the current AppendBlock call. The handlers are called after the ledger is unlocked
+	tipChanges []tipChange
+}
+
+// tipChange is a change of the tip of the canonical chain. reorg is nil if the new tip extends the old tip
+type tipChange struct {
+	connected    []*macroBlock
+	disconnected []*macroBlock
+	reorg        *Reorg
 }
 
-// NewLedger creates, and initialize a leader, returns a pointer to it
+// NewLedger creates, and initialize a leader keeping its blocks in memory, returns a pointer to it
 func NewLedger(concurrencyLevel int) *Ledger {
+
+	ledger, err := NewLedgerWithStore(concurrencyLevel, storage.NewMemoryStore())
+	if err != nil {
+		panic(err)
+	}
+
+	return ledger
+}
+
+// NewLedgerWithStore creates a ledger keeping its blocks in the store. If the store already contains blocks,
+// the chain is rebuilt by replaying them in append order. Stored blocks are validated before they are appended, so they are not validated again
+func NewLedgerWithStore(concurrencyLevel int, store storage.BlockStore) (*Ledger, error) {
 	ledger := &Ledger{
 		concurrencyLevel:   concurrencyLevel,
-		blockMap:           make(map[int][]common.Block),
+		validator:          newValidator(concurrencyLevel),
+		orphans:            newOrphanPool(maxOrphanCount, maxOrphanAge),
+		headers:            make(map[string]common.BlockHeader),
+		children:           make(map[string][][]byte),
+		blockCounts:        make(map[int]int),
+		macroBlocks:        make(map[string]*macroBlock),
+		canonical:          make(map[int]*macroBlock),
 		readyToDisseminate: make(chan common.Block, 1024),
 	}
 
 	// initiates the genesis block
-	ledger.blockMap[0] = []common.Block{{Issuer: []byte("initial block"), Height: 0, Nonce: 12123423423435, Payload: []byte("hello world")}}
+	genesisBlock := common.Block{Issuer: []byte("initial block"), Height: 0, Nonce: 12123423423435}
+	genesisBlock.SetPayload([]byte("hello world"))
 
-	return ledger
+	if store.Count() == 0 {
+		if err := store.Append(genesisBlock); err != nil {
+			return nil, err
+		}
+	}
+
+	// the blocks are replayed into a memory store, so the macroblocks are assembled only from the blocks replayed so far
+	ledger.store = storage.NewMemoryStore()
+	err := store.ForEach(func(block common.Block) error {
+
+		if block.Height == 0 {
+			if !bytes.Equal(block.Hash(), genesisBlock.Hash()) {
+				return fmt.Errorf("genesis block of the store is %x, expected %x", block.Hash(), genesisBlock.Hash())
+			}
+
+			ledger.store.Append(block)
+			ledger.index(block.Header())
+			ledger.registerMacroBlock(newMacroBlock([]common.Block{block}, nil))
+			return nil
+		}
+
+		return ledger.restore(block)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ledger.tip == nil {
+		return nil, fmt.Errorf("store does not contain the genesis block")
+	}
+
+	if count := store.Count(); count > 1 {
+		log.Printf("restored %d blocks from the store, tip height is %d\n", count, ledger.tip.height)
+	}
+
+	// the tip changes of the replayed blocks are not reported
+	ledger.tipChanges = nil
+	ledger.store = store
+
+	return ledger, nil
 }
 
-// AppendBlock thy to append the given block to the ledger
+// AppendBlock thy to append the given block to the ledger. A block whose parents are missing is kept in the orphan pool,
+// and it is appended once its parents are appended. The appended blocks are disseminated, and the handlers are called
+// after the ledger is unlocked, so they can block or query the ledger
 func (l *Ledger) AppendBlock(block common.Block) {
 
-	appendResult := l.append(block)
+	appended, tipChanges := l.appendBlock(block)
+
+	for _, b := range appended {
+		l.readyToDisseminate <- b
+	}
+
+	for _, change := range tipChanges {
+
+		if l.tipHandler != nil {
+			l.tipHandler(change.connected, change.disconnected)
+		}
+
+		if change.reorg != nil && l.reorgHandler != nil {
+			l.reorgHandler(*change.reorg)
+		}
+	}
+}
+
+// appendBlock appends the block and the orphans waiting for it while the ledger is locked.
+// It returns the appended blocks and the tip changes in order
+func (l *Ledger) appendBlock(block common.Block) ([]common.Block, []tipChange) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	defer func() {
+		l.appended = nil
+		l.tipChanges = nil
+	}()
+
+	if l.isAppended(block) || l.orphans.contains(block.Hash()) {
+		return nil, nil
+	}
+
+	appendResult, err := l.append(block)
+	if err != nil {
+		// the block is rejected by the validator
+		return nil, nil
+	}
 
 	// could not append the block so nothing todo
 	if !appendResult {
-		log.Printf("putting a block to the waiting list. Block height is %d\n", block.Height)
-		l.waitList = append(l.waitList, block)
-		return
+		log.Printf("putting a block to the orphan pool. Block height is %d\n", block.Height)
+		l.orphans.add(block, l.missingParents(block))
+		return nil, nil
 	}
 
-	// trying to append waiting blocks.
-	for appendResult {
+	log.Printf("Appended:\t\t%x\n", block.Hash())
+
+	// appends the orphans waiting for the appended blocks
+	appended := [][]byte{block.Hash()}
+	for len(appended) > 0 {
 
-		appendResult = false
-		for _, wb := range l.waitList {
-			// when you append a waiting block
-			// you should retry remaning blocks to append
-			appendResult = appendResult || l.append(wb)
+		parentHash := appended[0]
+		appended = appended[1:]
+
+		for _, orphan := range l.orphans.promote(parentHash) {
+
+			ok, err := l.append(orphan)
+			if ok {
+				log.Printf("Appended orphan:\t%x\n", orphan.Hash())
+				appended = append(appended, orphan.Hash())
+			} else if err == nil {
+				// the orphan is still missing another parent
+				l.orphans.add(orphan, l.missingParents(orphan))
+			}
 		}
 	}
 
-	log.Printf("Appended:\t\t%x\n", block.Hash())
+	return l.appended, l.tipChanges
 }
 
-// GetMinedBlock returns true with a  list of microblocks if all the microblocks for a specific height are available otherwise returns false
+// GetMacroBlock returns true with a list of microblocks if the canonical chain contains a macroblock for a specific height otherwise returns false.
+// The microblocks are ordered by microblock index, and each index holds the block with the lowest hash among the competing ones.
+// Transactions are applied in this order
 func (l *Ledger) GetMacroBlock(height int) ([]common.Block, bool) {
 
-	heightBlocks, ok := l.blockMap[height]
-
-	// returns the genesis block
-	if height == 0 {
-		if len(heightBlocks) != 1 {
-			panic("no genesis block")
-		}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
 
-		return heightBlocks, true
-	}
+	mb, ok := l.canonical[height]
 
 	// there is no block so return false
 	if !ok {
 		return []common.Block{}, false
 	}
 
-	blocks := make([]common.Block, l.concurrencyLevel)
-	microblockIndexes := make([]bool, l.concurrencyLevel)
-	for _, block := range heightBlocks {
-		microblockIndexes[block.Nonce%int64(l.concurrencyLevel)] = true
-		blocks[block.Nonce%int64(l.concurrencyLevel)] = block
+	return mb.blocks, true
+}
+
+// GetMicroblock returns the microblock with the given index built on top of the canonical macroblock of the previous height
+func (l *Ledger) GetMicroblock(height int, macroblockIndex int) (common.Block, bool) {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	parent, ok := l.canonical[height-1]
+
+	// there is no parent so return false
+	if !ok {
+		return common.Block{}, false
 	}
 
-	for _, isMicroBlockAvailable := range microblockIndexes {
-		if !isMicroBlockAvailable {
-			return []common.Block{}, false
+	for _, hash := range l.children[parent.key] {
+		if l.microBlockIndex(l.headers[string(hash)]) == macroblockIndex {
+			return l.store.Get(hash)
 		}
 	}
 
-	return blocks, true
+	return common.Block{}, false
+}
+
+// FinalizedHeight returns the height of the last canonical macroblock that is buried under finalityDepth macroblocks.
+// Competing branches forking below this height are not expected to win the fork choice
+func (l *Ledger) FinalizedHeight() int {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.tip.height < finalityDepth {
+		return 0
+	}
+
+	return l.tip.height - finalityDepth
 }
 
-func (l *Ledger) GetMicroblock(height int, macroblockIndex int) (common.Block, bool) {
+// GetBlock returns the appended block with the given hash, including the blocks of competing branches
+func (l *Ledger) GetBlock(hash []byte) (common.Block, bool) {
 
-	heightBlocks, ok := l.blockMap[height]
+	// the store is safe for concurrent use
+	return l.store.Get(hash)
+}
 
-	// there is no block so return false
+// Tip returns the height and the hash of the last macroblock of the canonical chain
+func (l *Ledger) Tip() (int, []byte) {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.tip.height, l.tip.hash
+}
+
+// OrphanInfo describes a block waiting for its parents
+type OrphanInfo struct {
+	Hash           []byte
+	Height         int
+	MissingParents [][]byte
+	Arrival        time.Time
+}
+
+// Orphans returns the blocks waiting for their parents in arrival order
+func (l *Ledger) Orphans() []OrphanInfo {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.orphans.list()
+}
+
+// Difficulty returns the difficulty of the blocks built on top of the macroblock with the given hashes
+func (l *Ledger) Difficulty(prevBlockHashes [][]byte) (int64, error) {
+
+	if l.difficulty == nil {
+		return 0, nil
+	}
+
+	parent, ok := l.macroBlocks[macroBlockKey(prevBlockHashes)]
 	if !ok {
-		return common.Block{}, false
+		return 0, fmt.Errorf("parent macroblock is not available")
 	}
 
-	for _, block := range heightBlocks {
-		if (block.Nonce % int64(l.concurrencyLevel)) == int64(macroblockIndex) {
-			return block, true
-		}
+	return l.difficulty.difficulty(parent)
+}
+
+// utxoSetOf returns the UTXO set of the branch ending with the macroblock with the given hashes.
+// The returned set must not be modified
+func (l *Ledger) utxoSetOf(prevBlockHashes [][]byte) (*utxoSet, error) {
+
+	parent, ok := l.macroBlocks[macroBlockKey(prevBlockHashes)]
+	if !ok {
+		return nil, fmt.Errorf("parent macroblock is not available")
 	}
 
-	return common.Block{}, false
+	return l.utxoSetAt(parent), nil
 }
 
-func (l *Ledger) append(block common.Block) bool {
+// append appends the block if its parent macroblock is available.
+// It returns an error if the block is not valid, or it is already appended
+func (l *Ledger) append(block common.Block) (bool, error) {
 
-	previousRoundBlocks, ok := l.blockMap[block.Height-1]
+	if l.isAppended(block) {
+		return false, errAlreadyAppended
+	}
 
+	parentHeaders, ok := l.parentHeaders(block)
 	if !ok {
-		// retuning because all of the previous blocks are missing
-		return false
+		// returning because one of the prev blocks is missing!!!
+		return false, nil
 	}
 
-	// creates an available block map
-	availableBlocks := make(map[string]struct{})
-	for _, b := range previousRoundBlocks {
-		availableBlocks[string(b.Hash())] = struct{}{}
+	if err := l.validator.validateParents(block, parentHeaders); err != nil {
+		return false, err
 	}
 
-	// checks for all prev block hashes
-	for _, h := range block.PrevBlockHashes {
-		_, ok := availableBlocks[string(h)]
-		if !ok {
-			// returning because one of the prev blocks is missing!!!
-			return false
-		}
+	parent := l.parentMacroBlock(block, parentHeaders)
+
+	if err := l.validator.validateChain(block, parent); err != nil {
+		return false, err
 	}
 
-	//TODO: validate block, and simulate the cost of validation here
+	//TODO: simulate the cost of validation here
 
 	// apending block top the ledger
-	currentRoundBlocks := l.blockMap[block.Height]
-	currentRoundBlocks = append(currentRoundBlocks, block)
-	l.blockMap[block.Height] = currentRoundBlocks
+	if err := l.store.Append(block); err != nil {
+		// the block is not appended, so it is appended again when it is received again
+		log.Printf("could not store the block %x: %s\n", block.Hash(), err)
+		return false, err
+	}
+
+	l.index(block.Header())
+	l.assembleMacroBlock(parent)
 
 	// the block is validated, and appended to the ledger.
 	// the node should disseminate it
-	l.readyToDisseminate <- block
+	l.appended = append(l.appended, block)
+
+	return true, nil
+}
+
+// restore appends a stored block without validating it or disseminating it
+func (l *Ledger) restore(block common.Block) error {
+
+	parentHeaders, ok := l.parentHeaders(block)
+	if !ok {
+		return fmt.Errorf("parents of the stored block %x are not stored before it", block.Hash())
+	}
+
+	parent := l.parentMacroBlock(block, parentHeaders)
+
+	if err := l.store.Append(block); err != nil {
+		return err
+	}
+
+	l.index(block.Header())
+	l.assembleMacroBlock(parent)
+
+	return nil
+}
+
+// index keeps the header of an appended block in memory
+func (l *Ledger) index(header common.BlockHeader) {
+
+	hash := header.Hash()
+	parentKey := macroBlockKey(header.PrevBlockHashes)
+
+	l.headers[string(hash)] = header
+	l.children[parentKey] = append(l.children[parentKey], hash)
+	l.blockCounts[header.Height]++
+}
+
+// parentHeaders returns the headers of the blocks referenced by the previous block hashes of the block if all of them are available
+func (l *Ledger) parentHeaders(block common.Block) ([]common.BlockHeader, bool) {
+
+	parentHeaders := make([]common.BlockHeader, len(block.PrevBlockHashes))
+	for i, h := range block.PrevBlockHashes {
+
+		header, ok := l.headers[string(h)]
+		if !ok {
+			return nil, false
+		}
+
+		parentHeaders[i] = header
+	}
+
+	return parentHeaders, len(parentHeaders) > 0
+}
+
+// parentMacroBlock returns the macroblock formed by the validated parent blocks.
+// A complete set of microblocks is registered as a macroblock the first time a block references it
+func (l *Ledger) parentMacroBlock(block common.Block, parentHeaders []common.BlockHeader) *macroBlock {
+
+	if mb, ok := l.macroBlocks[macroBlockKey(block.PrevBlockHashes)]; ok {
+		return mb
+	}
+
+	grandParent := l.macroBlocks[macroBlockKey(parentHeaders[0].PrevBlockHashes)]
+
+	mb := newMacroBlock(l.storedBlocks(block.PrevBlockHashes), grandParent)
+	l.registerMacroBlock(mb)
+
+	return mb
+}
+
+// assembleMacroBlock selects the microblock with the lowest hash for each index among the blocks built on top of the parent.
+// If all indexes are filled, the resulting macroblock is registered. Only the blocks of the macroblock are read from the store
+func (l *Ledger) assembleMacroBlock(parent *macroBlock) {
+
+	hashes := make([][]byte, l.concurrencyLevel)
+
+	for _, hash := range l.children[parent.key] {
+
+		index := l.microBlockIndex(l.headers[string(hash)])
+		if hashes[index] == nil || string(hash) < string(hashes[index]) {
+			hashes[index] = hash
+		}
+	}
+
+	for i := range hashes {
+		if hashes[i] == nil {
+			return
+		}
+	}
+
+	if _, ok := l.macroBlocks[macroBlockKey(hashes)]; ok {
+		return
+	}
+
+	l.registerMacroBlock(newMacroBlock(l.storedBlocks(hashes), parent))
+}
+
+// storedBlocks reads the blocks with the given hashes from the store. The blocks must be appended
+func (l *Ledger) storedBlocks(hashes [][]byte) []common.Block {
+
+	blocks := make([]common.Block, len(hashes))
+	for i, hash := range hashes {
+
+		block, ok := l.store.Get(hash)
+		if !ok {
+			panic(fmt.Sprintf("appended block %x is not in the store", hash))
+		}
+
+		blocks[i] = block
+	}
+
+	return blocks
+}
+
+// registerMacroBlock registers a complete macroblock, and applies the fork choice rule
+func (l *Ledger) registerMacroBlock(mb *macroBlock) {
+
+	l.macroBlocks[mb.key] = mb
+
+	if mb.isBetterThan(l.tip) {
+		l.setTip(mb)
+	}
+}
+
+// setTip makes the branch ending with the given macroblock the canonical chain
+func (l *Ledger) setTip(newTip *macroBlock) {
+
+	oldTip := l.tip
+	l.tip = newTip
+
+	// finds the fork point
+	var connected []*macroBlock
+	forkPoint := newTip
+	for forkPoint != nil && l.canonical[forkPoint.height] != forkPoint {
+		connected = append([]*macroBlock{forkPoint}, connected...)
+		forkPoint = forkPoint.parent
+	}
+
+	// removes the macroblocks of the old branch
+	var disconnected []*macroBlock
+	if oldTip != nil {
+		for h := forkPoint.height + 1; h <= oldTip.height; h++ {
+			disconnected = append(disconnected, l.canonical[h])
+			delete(l.canonical, h)
+		}
+	}
+
+	for _, mb := range connected {
+		l.canonical[mb.height] = mb
+	}
+
+	l.updateUTXOSet(newTip)
+
+	if oldTip == nil {
+		return
+	}
+
+	change := tipChange{connected: connected, disconnected: disconnected}
+	if len(disconnected) > 0 {
+		change.reorg = &Reorg{ForkHeight: forkPoint.height, OldTipHeight: oldTip.height, NewTipHeight: newTip.height}
+		log.Printf("Reorganization:\tfork height %d, old tip %d, new tip %d\n", change.reorg.ForkHeight, change.reorg.OldTipHeight, change.reorg.NewTipHeight)
+	}
+
+	l.tipChanges = append(l.tipChanges, change)
+}
+
+// updateUTXOSet moves the UTXO set of the canonical chain to the new tip.
+// On a reorganization, the macroblocks of the old branch are reverted down to the fork point
+func (l *Ledger) updateUTXOSet(newTip *macroBlock) {
+
+	if l.utxo == nil {
+		l.utxo = newUTXOSet()
+	}
+
+	l.switchUTXOSet(l.utxo, l.utxoTip, newTip)
+	l.utxoTip = newTip
+}
+
+// utxoSetAt returns the UTXO set after the transactions of the branch ending with the given macroblock.
+// The set of another branch is a view on the set of the canonical chain, so it is valid until the canonical chain changes.
+// The returned set must not be modified, use a view to apply changes
+func (l *Ledger) utxoSetAt(mb *macroBlock) *utxoSet {
+
+	if mb == l.utxoTip {
+		return l.utxo
+	}
+
+	view := l.utxo.view()
+	l.switchUTXOSet(view, l.utxoTip, mb)
+
+	return view
+}
+
+// switchUTXOSet moves the set from the branch ending with from to the branch ending with to.
+// The macroblocks of the first branch after the fork point are reverted, and the macroblocks of the second one are applied
+func (l *Ledger) switchUTXOSet(set *utxoSet, from *macroBlock, to *macroBlock) {
+
+	var connected []*macroBlock
+	for from != to {
+
+		if from != nil && (to == nil || from.height >= to.height) {
+			set.revert(from.changes)
+			from = from.parent
+		} else {
+			connected = append(connected, to)
+			to = to.parent
+		}
+	}
+
+	for i := len(connected) - 1; i >= 0; i-- {
+		l.applyMacroBlock(set, connected[i])
+	}
+}
+
+// applyMacroBlock applies the transactions of the microblocks in microblock index order.
+// A transaction is skipped if it is already applied, if an earlier microblock of the macroblock contains it,
+// or if it spends an output spent by an earlier transaction. Since all nodes apply the microblocks in the same order,
+// they skip the same transactions. The number of skipped transactions and the changes to the set are recorded in the macroblock
+func (l *Ledger) applyMacroBlock(set *utxoSet, mb *macroBlock) {
+
+	applied := make(map[string]struct{})
+	discarded := 0
+	var changes []utxoChange
+
+	for _, block := range mb.blocks {
+
+		txs, err := common.DecodeTransactions(block.Payload)
+		if err != nil {
+			// the payload of the genesis block is not a transaction list
+			continue
+		}
+
+		for _, tx := range txs {
+
+			hash := string(tx.Hash())
+			if _, ok := applied[hash]; ok || set.contains(tx) {
+				discarded++
+				continue
+			}
+
+			if tx.IsCoinbase() {
+				if checkCoinbase(tx, block.Height) != nil {
+					discarded++
+					continue
+				}
+			} else if set.checkTransaction(tx) != nil {
+				discarded++
+				continue
+			}
+
+			changes = append(changes, set.applyTransaction(tx)...)
+			applied[hash] = struct{}{}
+		}
+	}
+
+	mb.discardedTransactions = discarded
+	mb.changes = changes
+}
+
+// OrphanCount returns the number of blocks waiting for their parents
+func (l *Ledger) OrphanCount() int {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.orphans.count()
+}
+
+// EvictedOrphanCount returns the number of orphans evicted because of the size or age limits of the orphan pool
+func (l *Ledger) EvictedOrphanCount() int {
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.orphans.evictedCount
+}
+
+// discardedTransactions returns the number of transactions discarded by the canonical macroblock of the given height
+func (l *Ledger) discardedTransactions(height int) int {
+
+	mb, ok := l.canonical[height]
+	if !ok {
+		return 0
+	}
+
+	return mb.discardedTransactions
+}
+
+// missingParents returns the hashes of the parents of the block that are not appended
+func (l *Ledger) missingParents(block common.Block) [][]byte {
+
+	var missing [][]byte
+	for _, hash := range block.PrevBlockHashes {
+		if _, ok := l.headers[string(hash)]; !ok {
+			missing = append(missing, hash)
+		}
+	}
+
+	return missing
+}
+
+func (l *Ledger) isAppended(block common.Block) bool {
+
+	_, ok := l.headers[string(block.Hash())]
+	return ok
+}
+
+func (l *Ledger) microBlockIndex(header common.BlockHeader) int {
 
-	return true
+	return int(header.Nonce % int64(l.concurrencyLevel))
 }
 
 func (l *Ledger) PrintStatus() {
@@ -152,13 +697,13 @@ func (l *Ledger) PrintStatus() {
 	status := fmt.Sprintf("[0 | %d]", len(genesisBlock))
 	for i := 1; ; i++ {
 
-		mb, ok := l.blockMap[i]
+		_, ok := l.canonical[i]
 
 		if !ok {
 			break
 		}
 
-		status = fmt.Sprintf("%s <-[%d | %d]", status, i, len(mb))
+		status = fmt.Sprintf("%s <-[%d | %d]", status, i, l.blockCounts[i])
 	}
 
 	log.Println(status)
@@ -2,11 +2,14 @@ package consensus
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"math"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
 )
 
 func createBlock(round int, previousBlockHashes [][]byte, blockSize int, leaderCount int) common.Block {
@@ -15,9 +18,9 @@ func createBlock(round int, previousBlockHashes [][]byte, blockSize int, leaderC
 
 	block := common.Block{
 		Height:          round,
-		Payload:         getRandomByteSlice(payloadSize),
 		PrevBlockHashes: previousBlockHashes,
 	}
+	block.SetPayload(getRandomByteSlice(payloadSize))
 
 	return block
 }
@@ -71,3 +74,375 @@ func TestLedger(t *testing.T) {
 		t.Errorf("retreived block is faulty")
 	}
 }
+
+func TestLedgerForkChoice(t *testing.T) {
+
+	ledger := NewLedger(1)
+
+	reorgCount := 0
+	ledger.reorgHandler = func(r Reorg) {
+		reorgCount++
+	}
+
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	b1 := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+	c1 := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+
+	ledger.AppendBlock(b1)
+	ledger.AppendBlock(c1)
+
+	// competing macroblocks have the same work, so the lowest hash wins
+	winner, loser := b1, c1
+	if bytes.Compare(c1.Hash(), b1.Hash()) < 0 {
+		winner, loser = c1, b1
+	}
+
+	canonical, _ := ledger.GetMacroBlock(1)
+	if !bytes.Equal(canonical[0].Hash(), winner.Hash()) {
+		t.Errorf("canonical block is not the block with the lowest hash")
+	}
+
+	// extending the losing branch makes it the canonical chain
+	reorgCount = 0
+	l2 := createBlock(2, [][]byte{loser.Hash()}, 1000, 1)
+	ledger.AppendBlock(l2)
+
+	canonical, _ = ledger.GetMacroBlock(1)
+	if !bytes.Equal(canonical[0].Hash(), loser.Hash()) {
+		t.Errorf("canonical chain did not switch to the branch with the most work")
+	}
+
+	if _, ok := ledger.GetMacroBlock(2); !ok {
+		t.Errorf("block is not available")
+	}
+
+	if reorgCount != 1 {
+		t.Errorf("expected one reorganization, got %d", reorgCount)
+	}
+}
+
+func TestLedgerHandlersUnlocked(t *testing.T) {
+
+	// the dissemination channel is not read while the block is appended
+	ledger := NewLedger(1)
+	ledger.readyToDisseminate = make(chan common.Block)
+
+	var tipHeights []int
+	ledger.tipHandler = func(connected []*macroBlock, disconnected []*macroBlock) {
+		// the handlers can query the ledger
+		height, _ := ledger.Tip()
+		tipHeights = append(tipHeights, height)
+	}
+
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+	b1 := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+
+	done := make(chan struct{})
+	go func() {
+		ledger.AppendBlock(b1)
+		close(done)
+	}()
+
+	// the ledger can be queried while the appended block waits to be disseminated
+	time.Sleep(50 * time.Millisecond)
+	if height, _ := ledger.Tip(); height != 1 {
+		t.Errorf("expected the tip height 1, got %d", height)
+	}
+
+	select {
+	case block := <-ledger.readyToDisseminate:
+		if !bytes.Equal(block.Hash(), b1.Hash()) {
+			t.Errorf("appended block is not disseminated")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("appended block is not disseminated")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tip handler blocks on the ledger")
+	}
+
+	if len(tipHeights) != 1 || tipHeights[0] != 1 {
+		t.Errorf("expected the tip handler to see the height 1, got %v", tipHeights)
+	}
+}
+
+func TestLedgerConflictResolution(t *testing.T) {
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWallet(pubKey, privKey)
+
+	ledger := NewLedger(2)
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	coinbase := w.coinbase(1)
+	b1 := common.Block{Height: 1, Nonce: 0, PrevBlockHashes: [][]byte{genesisBlock[0].Hash()}}
+	b1.SetPayload(common.EncodeTransactions([]common.Transaction{coinbase}))
+	c1 := common.Block{Height: 1, Nonce: 1, PrevBlockHashes: [][]byte{genesisBlock[0].Hash()}}
+	c1.SetPayload(common.EncodeTransactions(nil))
+	ledger.AppendBlock(b1)
+	ledger.AppendBlock(c1)
+
+	if _, ok := ledger.GetMacroBlock(1); !ok {
+		t.Fatalf("macroblock is not available")
+	}
+
+	entry := ledger.utxo.ownedBy(pubKey)[0]
+	spend := w.spend(entry)
+
+	// spends the same output with different outputs
+	conflicting := common.Transaction{
+		Inputs:  []common.TxInput{{PrevOut: entry.outPoint}},
+		Outputs: []common.TxOutput{{Value: entry.output.Value, PublicKey: pubKey}},
+	}
+	conflicting.Inputs[0].Signature = ed25519.Sign(privKey, conflicting.Hash())
+
+	parents := [][]byte{b1.Hash(), c1.Hash()}
+	b2 := common.Block{Height: 2, Nonce: 0, PrevBlockHashes: parents}
+	b2.SetPayload(common.EncodeTransactions([]common.Transaction{spend}))
+	c2 := common.Block{Height: 2, Nonce: 1, PrevBlockHashes: parents}
+	c2.SetPayload(common.EncodeTransactions([]common.Transaction{spend, conflicting}))
+
+	// the order of arrival does not change the result
+	ledger.AppendBlock(c2)
+	ledger.AppendBlock(b2)
+
+	blocks, ok := ledger.GetMacroBlock(2)
+	if !ok {
+		t.Fatalf("macroblock is not available")
+	}
+
+	if !bytes.Equal(blocks[0].Hash(), b2.Hash()) || !bytes.Equal(blocks[1].Hash(), c2.Hash()) {
+		t.Errorf("microblocks are not ordered by microblock index")
+	}
+
+	if discarded := ledger.discardedTransactions(2); discarded != 2 {
+		t.Errorf("expected 2 discarded transactions, got %d", discarded)
+	}
+
+	if !ledger.utxo.contains(spend) {
+		t.Errorf("transaction of the first microblock is not applied")
+	}
+
+	if ledger.utxo.contains(conflicting) {
+		t.Errorf("double spending transaction is applied")
+	}
+}
+
+func TestLedgerUTXOReorg(t *testing.T) {
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWallet(pubKey, privKey)
+
+	ledger := NewLedger(1)
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	appendBlock := func(parent []byte, height int, nonce int64, txs ...common.Transaction) common.Block {
+		block := common.Block{Height: height, Nonce: nonce, PrevBlockHashes: [][]byte{parent}}
+		block.SetPayload(common.EncodeTransactions(txs))
+		ledger.AppendBlock(block)
+		return block
+	}
+
+	coinbase := w.coinbase(1)
+	b1 := appendBlock(genesisBlock[0].Hash(), 1, 0, coinbase)
+
+	entry := ledger.utxo.ownedBy(pubKey)[0]
+	spend := w.spend(entry)
+	b2 := appendBlock(b1.Hash(), 2, 0, spend)
+
+	if !ledger.utxo.contains(spend) {
+		t.Fatalf("transaction of the canonical chain is not applied")
+	}
+
+	// a longer branch with the same coinbase transaction, and without the spending transaction
+	c1 := appendBlock(genesisBlock[0].Hash(), 1, 1, coinbase)
+	c2 := appendBlock(c1.Hash(), 2, 1)
+	appendBlock(c2.Hash(), 3, 1)
+
+	if height, _ := ledger.Tip(); height != 3 {
+		t.Fatalf("canonical chain did not switch to the longer branch")
+	}
+
+	// the spending transaction of the old branch is reverted
+	if ledger.utxo.contains(spend) {
+		t.Errorf("transaction of the old branch is not reverted")
+	}
+
+	if _, ok := ledger.utxo.output(entry.outPoint); !ok {
+		t.Errorf("output spent by the old branch is not restored")
+	}
+
+	if owned := len(ledger.utxo.ownedBy(pubKey)); owned != walletOutputCount {
+		t.Errorf("expected %d outputs, got %d", walletOutputCount, owned)
+	}
+
+	// the set of the old branch is computed on top of the canonical set without modifying it
+	old := ledger.utxoSetAt(ledger.macroBlocks[macroBlockKey([][]byte{b2.Hash()})])
+	if !old.contains(spend) || len(old.ownedBy(pubKey)) != 2*walletOutputCount-1 {
+		t.Errorf("UTXO set of the old branch is not computed")
+	}
+
+	if ledger.utxo.contains(spend) {
+		t.Errorf("UTXO set of the canonical chain is modified")
+	}
+}
+
+func TestLedgerRestore(t *testing.T) {
+
+	store := storage.NewMemoryStore()
+	ledger, err := NewLedgerWithStore(1, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	// a branch of two blocks, and a competing block of height 1
+	b1 := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+	b2 := createBlock(2, [][]byte{b1.Hash()}, 1000, 1)
+	fork := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+
+	for _, block := range []common.Block{b1, b2, fork} {
+		ledger.AppendBlock(block)
+		<-ledger.readyToDisseminate
+	}
+
+	restored, err := NewLedgerWithStore(1, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for height := 0; height <= 2; height++ {
+
+		expected, _ := ledger.GetMacroBlock(height)
+		blocks, ok := restored.GetMacroBlock(height)
+		if !ok || !bytes.Equal(blocks[0].Hash(), expected[0].Hash()) {
+			t.Errorf("canonical macroblock of height %d is not restored", height)
+		}
+	}
+
+	if !restored.isAppended(fork) {
+		t.Errorf("block of the competing branch is not restored")
+	}
+
+	// restored blocks are not disseminated again
+	select {
+	case <-restored.readyToDisseminate:
+		t.Errorf("restored block is disseminated")
+	default:
+	}
+
+	// a store of another chain is not accepted
+	other := storage.NewMemoryStore()
+	other.Append(common.Block{Issuer: []byte("other genesis")})
+	if _, err := NewLedgerWithStore(1, other); err == nil {
+		t.Errorf("store with another genesis block is accepted")
+	}
+}
+
+// countingStore counts the reads of a block store
+type countingStore struct {
+	*storage.MemoryStore
+	gets      int
+	heightGet int
+}
+
+func (s *countingStore) Get(hash []byte) (common.Block, bool) {
+	s.gets++
+	return s.MemoryStore.Get(hash)
+}
+
+func (s *countingStore) AtHeight(height int) []common.Block {
+	s.heightGet++
+	return s.MemoryStore.AtHeight(height)
+}
+
+func TestLedgerStoreReads(t *testing.T) {
+
+	store := &countingStore{MemoryStore: storage.NewMemoryStore()}
+	ledger, err := NewLedgerWithStore(2, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+	parents := [][]byte{genesisBlock[0].Hash()}
+
+	const height = 5
+	for h := 1; h <= height; h++ {
+
+		var hashes [][]byte
+		for index := 0; index < 2; index++ {
+			block := createBlock(h, parents, 1000, 2)
+			block.Nonce = int64(index)
+			ledger.AppendBlock(block)
+			<-ledger.readyToDisseminate
+			hashes = append(hashes, block.Hash())
+		}
+
+		parents = hashes
+	}
+
+	if tip, _ := ledger.Tip(); tip != height {
+		t.Fatalf("expected the tip height %d, got %d", height, tip)
+	}
+
+	// the blocks of a macroblock are read once when the macroblock is registered
+	if store.heightGet != 0 || store.gets != 2*height {
+		t.Errorf("expected %d reads by hash and no reads by height, got %d and %d", 2*height, store.gets, store.heightGet)
+	}
+}
+
+func TestLedgerOrphans(t *testing.T) {
+
+	ledger := NewLedger(1)
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	b1 := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+	b2 := createBlock(2, [][]byte{b1.Hash()}, 1000, 1)
+	b3 := createBlock(3, [][]byte{b2.Hash()}, 1000, 1)
+
+	// blocks arrive in reverse order, and more than once
+	for _, block := range []common.Block{b3, b2, b3, b2} {
+		ledger.AppendBlock(block)
+	}
+
+	if ledger.OrphanCount() != 2 {
+		t.Fatalf("expected 2 orphans, got %d", ledger.OrphanCount())
+	}
+
+	ledger.AppendBlock(b1)
+
+	if ledger.OrphanCount() != 0 {
+		t.Errorf("expected no orphans, got %d", ledger.OrphanCount())
+	}
+
+	if canonical, ok := ledger.GetMacroBlock(3); !ok || !bytes.Equal(canonical[0].Hash(), b3.Hash()) {
+		t.Errorf("orphans are not appended")
+	}
+
+	// each block is disseminated once, parents first
+	for _, expected := range []common.Block{b1, b2, b3} {
+		if disseminated := <-ledger.readyToDisseminate; !bytes.Equal(disseminated.Hash(), expected.Hash()) {
+			t.Errorf("expected the block of height %d, got the block of height %d", expected.Height, disseminated.Height)
+		}
+	}
+
+	ledger.AppendBlock(b2)
+
+	select {
+	case block := <-ledger.readyToDisseminate:
+		t.Errorf("block of height %d is disseminated again", block.Height)
+	default:
+	}
+}
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// maxTarget is the largest possible value of a sha256 digest
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// miner searches nonces for a block using a pool of worker goroutines
+type miner struct {
+	target *big.Int
+
+	stopChan  chan struct{}
+	foundChan chan common.Block
+
+	waitGroup sync.WaitGroup
+}
+
+// startMiner starts workerCount goroutines searching nonces for the given block.
+// Each block whose signing hash meets the target is delivered through Found.
+func startMiner(block common.Block, workerCount int, target *big.Int) *miner {
+
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	m := &miner{
+		target:    target,
+		stopChan:  make(chan struct{}),
+		foundChan: make(chan common.Block),
+	}
+
+	for i := 0; i < workerCount; i++ {
+		m.waitGroup.Add(1)
+		go m.work(block, produceRandomNonce())
+	}
+
+	return m
+}
+
+// Found returns the channel that delivers blocks meeting the target
+func (m *miner) Found() <-chan common.Block {
+	return m.foundChan
+}
+
+// Stop stops all workers and waits for them to exit
+func (m *miner) Stop() {
+	close(m.stopChan)
+	m.waitGroup.Wait()
+}
+
+func (m *miner) work(block common.Block, startNonce int64) {
+
+	defer m.waitGroup.Done()
+
+	for nonce := startNonce; ; nonce++ {
+
+		select {
+		case <-m.stopChan:
+			return
+		default:
+		}
+
+		block.Nonce = nonce
+		block.Timestamp = currentTimestamp()
+		if !meetsTarget(block.SigningHash(), m.target) {
+			continue
+		}
+
+		select {
+		case m.foundChan <- block:
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// difficultyTarget returns the largest hash value accepted for the given difficulty
+func difficultyTarget(difficulty int64) *big.Int {
+
+	if difficulty < 1 {
+		difficulty = 1
+	}
+
+	return new(big.Int).Div(maxTarget, big.NewInt(difficulty))
+}
+
+// meetsTarget returns true if the hash interpreted as a big endian number is not greater than the target
+func meetsTarget(hash []byte, target *big.Int) bool {
+
+	return new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
@@ -0,0 +1,26 @@
+package consensus
+
+import (
+	"testing"
+)
+
+func TestMiner(t *testing.T) {
+
+	ledger := NewLedger(1)
+	genesisBlock, _ := ledger.GetMacroBlock(0)
+
+	block := createBlock(1, [][]byte{genesisBlock[0].Hash()}, 1000, 1)
+	target := difficultyTarget(64)
+
+	miner := startMiner(block, 4, target)
+	minedBlock := <-miner.Found()
+	miner.Stop()
+
+	if !meetsTarget(minedBlock.SigningHash(), target) {
+		t.Errorf("mined block hash %x does not meet the target", minedBlock.Hash())
+	}
+
+	if meetsTarget(maxTarget.Bytes(), target) {
+		t.Errorf("maximum hash value should not meet the target")
+	}
+}
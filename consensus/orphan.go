@@ -0,0 +1,165 @@
+package consensus
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+const (
+	// maxOrphanCount is the number of blocks the orphan pool keeps. The oldest orphans are evicted first
+	maxOrphanCount = 1024
+
+	// maxOrphanAge is the time an orphan waits for its parents before it is evicted
+	maxOrphanAge = 10 * time.Minute
+)
+
+type orphan struct {
+	block   common.Block
+	hash    string
+	missing []string
+	arrival time.Time
+}
+
+// orphanPool keeps the blocks whose parents are not appended yet, indexed by their missing parent hashes.
+// When a parent is appended, the blocks waiting for it are promoted once, instead of retrying all orphans after each append.
+// The limits are applied when an orphan is added
+type orphanPool struct {
+	maxCount int
+	maxAge   time.Duration
+
+	// entries keeps orphans in arrival order
+	entries *list.List
+	byHash  map[string]*list.Element
+
+	// byParent keeps the hashes of the orphans waiting for a parent by parent hash
+	byParent map[string]map[string]struct{}
+
+	evictedCount int
+}
+
+func newOrphanPool(maxCount int, maxAge time.Duration) *orphanPool {
+
+	return &orphanPool{
+		maxCount: maxCount,
+		maxAge:   maxAge,
+		entries:  list.New(),
+		byHash:   make(map[string]*list.Element),
+		byParent: make(map[string]map[string]struct{}),
+	}
+}
+
+// add adds a block waiting for the given parents. Adding an orphan again does nothing
+func (p *orphanPool) add(block common.Block, missingParents [][]byte) {
+
+	hash := string(block.Hash())
+	if _, ok := p.byHash[hash]; ok {
+		return
+	}
+
+	o := &orphan{block: block, hash: hash, arrival: time.Now()}
+	for _, parent := range missingParents {
+
+		o.missing = append(o.missing, string(parent))
+
+		children, ok := p.byParent[string(parent)]
+		if !ok {
+			children = make(map[string]struct{})
+			p.byParent[string(parent)] = children
+		}
+		children[hash] = struct{}{}
+	}
+
+	p.byHash[hash] = p.entries.PushBack(o)
+
+	p.evict()
+}
+
+// promote removes the orphans waiting for the parent with the given hash, and returns them in arrival order.
+// An orphan still missing another parent is added again by the caller
+func (p *orphanPool) promote(parentHash []byte) []common.Block {
+
+	children, ok := p.byParent[string(parentHash)]
+	if !ok {
+		return nil
+	}
+
+	var elements []*list.Element
+	for hash := range children {
+		elements = append(elements, p.byHash[hash])
+	}
+
+	// the orphans are returned in arrival order, so all nodes append them in the same order
+	var blocks []common.Block
+	for element := p.entries.Front(); element != nil && len(blocks) < len(elements); element = element.Next() {
+		if _, ok := children[element.Value.(*orphan).hash]; ok {
+			blocks = append(blocks, element.Value.(*orphan).block)
+		}
+	}
+
+	for _, element := range elements {
+		p.remove(element)
+	}
+
+	return blocks
+}
+
+// contains returns true if the block with the given hash is an orphan
+func (p *orphanPool) contains(hash []byte) bool {
+
+	_, ok := p.byHash[string(hash)]
+	return ok
+}
+
+// list returns the orphans in arrival order
+func (p *orphanPool) list() []OrphanInfo {
+
+	orphans := make([]OrphanInfo, 0, p.entries.Len())
+	for element := p.entries.Front(); element != nil; element = element.Next() {
+
+		o := element.Value.(*orphan)
+		info := OrphanInfo{Hash: []byte(o.hash), Height: o.block.Height, Arrival: o.arrival}
+		for _, parent := range o.missing {
+			info.MissingParents = append(info.MissingParents, []byte(parent))
+		}
+		orphans = append(orphans, info)
+	}
+
+	return orphans
+}
+
+// count returns the number of orphans
+func (p *orphanPool) count() int {
+
+	return p.entries.Len()
+}
+
+// evict removes the oldest orphans while the pool is larger than its limit or they are older than the maximum age
+func (p *orphanPool) evict() {
+
+	now := time.Now()
+	for element := p.entries.Front(); element != nil; element = p.entries.Front() {
+
+		o := element.Value.(*orphan)
+		if p.entries.Len() <= p.maxCount && now.Sub(o.arrival) <= p.maxAge {
+			return
+		}
+
+		p.remove(element)
+		p.evictedCount++
+	}
+}
+
+func (p *orphanPool) remove(element *list.Element) {
+
+	o := p.entries.Remove(element).(*orphan)
+	delete(p.byHash, o.hash)
+
+	for _, parent := range o.missing {
+		delete(p.byParent[parent], o.hash)
+		if len(p.byParent[parent]) == 0 {
+			delete(p.byParent, parent)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func TestOrphanPool(t *testing.T) {
+
+	pool := newOrphanPool(2, time.Hour)
+
+	parent := []byte("parent")
+	other := []byte("other parent")
+
+	first := common.Block{Height: 2, Nonce: 1, PrevBlockHashes: [][]byte{parent}}
+	second := common.Block{Height: 2, Nonce: 2, PrevBlockHashes: [][]byte{parent, other}}
+	third := common.Block{Height: 2, Nonce: 3, PrevBlockHashes: [][]byte{other}}
+
+	pool.add(first, [][]byte{parent})
+	pool.add(second, [][]byte{parent, other})
+	pool.add(first, [][]byte{parent})
+
+	if pool.count() != 2 {
+		t.Fatalf("expected 2 orphans, got %d", pool.count())
+	}
+
+	// the oldest orphan is evicted when the pool is full
+	pool.add(third, [][]byte{other})
+
+	if pool.contains(first.Hash()) || pool.evictedCount != 1 {
+		t.Errorf("oldest orphan is not evicted")
+	}
+
+	promoted := pool.promote(parent)
+	if len(promoted) != 1 || promoted[0].Nonce != 2 {
+		t.Fatalf("expected the orphan waiting for the parent, got %d orphans", len(promoted))
+	}
+
+	// a promoted orphan is removed from all indexes
+	promoted = pool.promote(other)
+	if len(promoted) != 1 || promoted[0].Nonce != 3 {
+		t.Fatalf("expected the orphan waiting for the other parent, got %d orphans", len(promoted))
+	}
+
+	if pool.count() != 0 || len(pool.byParent) != 0 {
+		t.Errorf("promoted orphans are kept in the pool")
+	}
+
+	// expired orphans are evicted
+	pool = newOrphanPool(2, 0)
+	pool.add(first, [][]byte{parent})
+	time.Sleep(time.Millisecond)
+	pool.add(third, [][]byte{other})
+
+	if pool.contains(first.Hash()) {
+		t.Errorf("expired orphan is not evicted")
+	}
+}
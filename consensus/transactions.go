@@ -0,0 +1,117 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/mempool"
+	"github.com/korkmazkadir/bitcoin/registery"
+)
+
+const (
+	// defaultMempoolSize is used if the config does not define the mempool size
+	defaultMempoolSize = 64 * 1000 * 1000
+
+	// defaultMempoolMaxAge is used if the config does not define the maximum age of transactions
+	defaultMempoolMaxAge = 10 * time.Minute
+)
+
+func newMempool(config registery.NodeConfig) *mempool.Mempool {
+
+	size := config.MempoolSize
+	if size <= 0 {
+		size = defaultMempoolSize
+	}
+
+	maxAge := time.Duration(config.MempoolMaxAge) * time.Second
+	if maxAge <= 0 {
+		maxAge = defaultMempoolMaxAge
+	}
+
+	return mempool.NewMempool(size, maxAge)
+}
+
+// handleTransaction admits a received transaction to the mempool, and forwards it if it is admitted
+func (b *Bitcoin) handleTransaction(tx common.Transaction) {
+
+	if err := b.mempool.Add(tx, b.checkTransaction); err != nil {
+		return
+	}
+
+	b.peerSet.DisseminateTransaction(tx)
+}
+
+// checkTransaction checks a transaction against the UTXO set of the canonical chain
+func (b *Bitcoin) checkTransaction(tx common.Transaction) error {
+
+	return b.ledger.utxo.checkTransaction(tx)
+}
+
+// generateTransactions creates transactions spending the outputs of the node, submits them to the mempool, and disseminates them
+func (b *Bitcoin) generateTransactions() {
+
+	txs := b.wallet.createTransactions(b.ledger.utxo, b.mempool.IsSpent, b.maxPayloadSize())
+	for _, tx := range txs {
+		if err := b.mempool.Add(tx, b.checkTransaction); err != nil {
+			continue
+		}
+		b.peerSet.DisseminateTransaction(tx)
+	}
+
+	log.Printf("Generated %d transactions, mempool contains %d transactions (%d bytes)\n", len(txs), b.mempool.Count(), b.mempool.Size())
+}
+
+// createPayload creates a payload containing a coinbase transaction followed by the transactions of the mempool
+// that are valid on top of the given UTXO set
+func (b *Bitcoin) createPayload(height int, set *utxoSet) []byte {
+
+	coinbase := b.wallet.coinbase(height)
+	txs := []common.Transaction{coinbase}
+
+	view := set.view()
+	view.applyTransaction(coinbase)
+
+	// reserves space for the coinbase transaction and the encoded transaction count
+	maxSize := b.maxPayloadSize() - coinbase.Size() - binary.MaxVarintLen64
+
+	for _, tx := range b.mempool.Select(maxSize) {
+
+		if view.checkTransaction(tx) != nil {
+			continue
+		}
+
+		view.applyTransaction(tx)
+		txs = append(txs, tx)
+	}
+
+	return common.EncodeTransactions(txs)
+}
+
+// updateMempool removes the transactions included in the canonical chain from the mempool,
+// and returns the transactions of the removed macroblocks to the mempool
+func (b *Bitcoin) updateMempool(connected []*macroBlock, disconnected []*macroBlock) {
+
+	for _, mb := range connected {
+		for _, block := range mb.blocks {
+			if txs, err := common.DecodeTransactions(block.Payload); err == nil {
+				b.mempool.RemoveIncluded(txs)
+			}
+		}
+	}
+
+	for _, mb := range disconnected {
+		for _, block := range mb.blocks {
+			txs, err := common.DecodeTransactions(block.Payload)
+			if err != nil {
+				continue
+			}
+			for _, tx := range txs {
+				if !tx.IsCoinbase() {
+					b.mempool.Add(tx, b.checkTransaction)
+				}
+			}
+		}
+	}
+}
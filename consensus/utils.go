@@ -5,6 +5,9 @@ import (
 	"crypto/rand"
 	"math"
 	"math/big"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
 )
 
 func produceRandomNonce() int64 {
@@ -19,3 +22,19 @@ func Sign(digest []byte, privateKey []byte) []byte {
 
 	return ed25519.Sign(privateKey, digest)
 }
+
+// currentTimestamp returns the current time in milliseconds since epoch
+func currentTimestamp() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// hashMacroBlock returns the hashes of the microblocks of a macroblock
+func hashMacroBlock(blocks []common.Block) [][]byte {
+
+	hashes := make([][]byte, len(blocks))
+	for i := range blocks {
+		hashes[i] = blocks[i].Hash()
+	}
+
+	return hashes
+}
@@ -0,0 +1,218 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// blockReward is the maximum value a coinbase transaction can create
+const blockReward int64 = 5000000000
+
+var (
+	errMissingOutput = errors.New("input spends a missing or already spent output")
+	errDoubleSpend   = errors.New("transaction spends the same output twice")
+)
+
+// utxoEntry is an unspent output with its outpoint
+type utxoEntry struct {
+	outPoint common.OutPoint
+	output   common.TxOutput
+}
+
+// utxoChange is an output created or spent by a transaction. The changes of a macroblock are reverted in reverse order
+type utxoChange struct {
+	entry   utxoEntry
+	created bool
+}
+
+// utxoSet keeps the unspent transaction outputs.
+// A set created by view reads through its parent, and records changes without modifying the parent
+type utxoSet struct {
+	parent *utxoSet
+
+	entries map[string]utxoEntry
+	spent   map[string]struct{}
+}
+
+func newUTXOSet() *utxoSet {
+	return &utxoSet{entries: make(map[string]utxoEntry), spent: make(map[string]struct{})}
+}
+
+// view returns a set that applies changes on top of the current set
+func (u *utxoSet) view() *utxoSet {
+	view := newUTXOSet()
+	view.parent = u
+	return view
+}
+
+// output returns the unspent output referenced by the outpoint
+func (u *utxoSet) output(outPoint common.OutPoint) (common.TxOutput, bool) {
+
+	key := outPoint.Key()
+	for set := u; set != nil; set = set.parent {
+
+		if _, ok := set.spent[key]; ok {
+			return common.TxOutput{}, false
+		}
+
+		if entry, ok := set.entries[key]; ok {
+			return entry.output, true
+		}
+	}
+
+	return common.TxOutput{}, false
+}
+
+// ownedBy returns the unspent outputs of the given public key
+func (u *utxoSet) ownedBy(publicKey []byte) []utxoEntry {
+
+	var owned []utxoEntry
+	u.collectOwned(publicKey, &owned, make(map[string]struct{}))
+
+	return owned
+}
+
+func (u *utxoSet) collectOwned(publicKey []byte, owned *[]utxoEntry, shadowed map[string]struct{}) {
+
+	for key, entry := range u.entries {
+		if _, ok := shadowed[key]; !ok && string(entry.output.PublicKey) == string(publicKey) {
+			*owned = append(*owned, entry)
+		}
+		shadowed[key] = struct{}{}
+	}
+
+	for key := range u.spent {
+		shadowed[key] = struct{}{}
+	}
+
+	if u.parent != nil {
+		u.parent.collectOwned(publicKey, owned, shadowed)
+	}
+}
+
+// checkTransaction returns an error if the transaction can not be applied to the set.
+// Coinbase transactions are checked by the caller
+func (u *utxoSet) checkTransaction(tx common.Transaction) error {
+
+	if tx.IsCoinbase() || tx.CoinbaseHeight != 0 {
+		return fmt.Errorf("unexpected coinbase transaction")
+	}
+
+	txHash := tx.Hash()
+	spent := make(map[string]struct{}, len(tx.Inputs))
+
+	var inputValue int64
+	for _, input := range tx.Inputs {
+
+		key := input.PrevOut.Key()
+		if _, ok := spent[key]; ok {
+			return errDoubleSpend
+		}
+		spent[key] = struct{}{}
+
+		output, ok := u.output(input.PrevOut)
+		if !ok {
+			return errMissingOutput
+		}
+
+		if len(output.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(output.PublicKey, txHash, input.Signature) {
+			return fmt.Errorf("input signature does not match the owner of the output")
+		}
+
+		inputValue += output.Value
+	}
+
+	return checkOutputs(tx, inputValue)
+}
+
+// checkOutputs returns an error if the outputs are malformed, or they transfer more value than maxValue
+func checkOutputs(tx common.Transaction, maxValue int64) error {
+
+	var outputValue int64
+	for _, output := range tx.Outputs {
+
+		if output.Value <= 0 {
+			return fmt.Errorf("output value %d is not positive", output.Value)
+		}
+
+		if len(output.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("output key size is %d bytes", len(output.PublicKey))
+		}
+
+		outputValue += output.Value
+		if outputValue > maxValue {
+			return fmt.Errorf("outputs transfer more than %d", maxValue)
+		}
+	}
+
+	return nil
+}
+
+// applyTransaction spends the inputs of the transaction, and adds its outputs to the set.
+// It returns the changes to the set in order
+func (u *utxoSet) applyTransaction(tx common.Transaction) []utxoChange {
+
+	changes := make([]utxoChange, 0, len(tx.Inputs)+len(tx.Outputs))
+
+	for _, input := range tx.Inputs {
+
+		output, _ := u.output(input.PrevOut)
+		changes = append(changes, utxoChange{entry: utxoEntry{outPoint: input.PrevOut, output: output}})
+		u.remove(input.PrevOut.Key())
+	}
+
+	txHash := tx.Hash()
+	for i, output := range tx.Outputs {
+		entry := utxoEntry{outPoint: common.OutPoint{TxHash: txHash, Index: i}, output: output}
+		changes = append(changes, utxoChange{entry: entry, created: true})
+		u.add(entry)
+	}
+
+	return changes
+}
+
+// revert reverts the changes applied to the set
+func (u *utxoSet) revert(changes []utxoChange) {
+
+	for i := len(changes) - 1; i >= 0; i-- {
+
+		if changes[i].created {
+			u.remove(changes[i].entry.outPoint.Key())
+		} else {
+			u.add(changes[i].entry)
+		}
+	}
+}
+
+func (u *utxoSet) add(entry utxoEntry) {
+
+	key := entry.outPoint.Key()
+	u.entries[key] = entry
+	delete(u.spent, key)
+}
+
+func (u *utxoSet) remove(key string) {
+
+	delete(u.entries, key)
+
+	// the output may be kept by the parent
+	if u.parent != nil {
+		u.spent[key] = struct{}{}
+	}
+}
+
+// contains returns true if any output of the transaction is in the set
+func (u *utxoSet) contains(tx common.Transaction) bool {
+
+	txHash := tx.Hash()
+	for i := range tx.Outputs {
+		if _, ok := u.output(common.OutPoint{TxHash: txHash, Index: i}); ok {
+			return true
+		}
+	}
+
+	return false
+}
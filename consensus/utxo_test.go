@@ -0,0 +1,52 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestUTXOSet(t *testing.T) {
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWallet(pubKey, privKey)
+	set := newUTXOSet()
+
+	coinbase := w.coinbase(1)
+	set.applyTransaction(coinbase)
+
+	owned := set.ownedBy(pubKey)
+	if len(owned) != walletOutputCount {
+		t.Fatalf("expected %d outputs, got %d", walletOutputCount, len(owned))
+	}
+
+	tx := w.spend(owned[0])
+
+	view := set.view()
+	if err := view.checkTransaction(tx); err != nil {
+		t.Fatalf("valid transaction is rejected: %s", err)
+	}
+	view.applyTransaction(tx)
+
+	// the view does not modify the parent set
+	if _, ok := set.output(owned[0].outPoint); !ok {
+		t.Errorf("spent output is removed from the parent set")
+	}
+
+	if err := view.checkTransaction(tx); err != errMissingOutput {
+		t.Errorf("expected %s, got %v", errMissingOutput, err)
+	}
+
+	if len(view.ownedBy(pubKey)) != 2*walletOutputCount-1 {
+		t.Errorf("expected %d outputs, got %d", 2*walletOutputCount-1, len(view.ownedBy(pubKey)))
+	}
+
+	forged := tx
+	forged.Outputs = w.split(2 * owned[0].output.Value)
+	if err := set.checkTransaction(forged); err == nil {
+		t.Errorf("transaction with an invalid signature is accepted")
+	}
+}
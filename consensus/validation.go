@@ -0,0 +1,419 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// RejectReason identifies the consensus rule violated by a block
+type RejectReason string
+
+const (
+	RejectHeightDiscontinuity RejectReason = "HEIGHT_DISCONTINUITY"
+	RejectInvalidNonce        RejectReason = "INVALID_NONCE"
+	RejectInvalidIssuer       RejectReason = "INVALID_ISSUER"
+	RejectUnknownIssuer       RejectReason = "UNKNOWN_ISSUER"
+	RejectInvalidSignature    RejectReason = "INVALID_SIGNATURE"
+	RejectInsufficientWork    RejectReason = "INSUFFICIENT_WORK"
+	RejectInvalidDifficulty   RejectReason = "INVALID_DIFFICULTY"
+	RejectIncompleteParent    RejectReason = "INCOMPLETE_PARENT"
+	RejectUnorderedParent     RejectReason = "UNORDERED_PARENT"
+	RejectInconsistentParent  RejectReason = "INCONSISTENT_PARENT"
+	RejectDuplicateSlot       RejectReason = "DUPLICATE_SLOT"
+	RejectOversizedPayload    RejectReason = "OVERSIZED_PAYLOAD"
+	RejectMalformedPayload    RejectReason = "MALFORMED_PAYLOAD"
+	RejectInvalidPayloadRoot  RejectReason = "INVALID_PAYLOAD_ROOT"
+	RejectMissingInput        RejectReason = "MISSING_INPUT"
+	RejectInvalidTransaction  RejectReason = "INVALID_TRANSACTION"
+)
+
+// RejectError is returned by a validation rule when a block violates it
+type RejectError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+func reject(reason RejectReason, format string, args ...interface{}) error {
+	return &RejectError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// headerRule checks a block header on its own. It is applied before a received header or block is appended or forwarded,
+// so it can not depend on the payload
+type headerRule func(header common.BlockHeader) error
+
+// parentRule checks a block against the headers of the blocks referenced by its previous block hashes, in the same order
+type parentRule func(block common.Block, parentHeaders []common.BlockHeader) error
+
+// chainRule checks a block against the branch it extends
+type chainRule func(block common.Block, parent *macroBlock) error
+
+// validator is the validation pipeline of blocks. Rules are applied in the order they are added,
+// and the first violated rule rejects the block
+type validator struct {
+	headerRules []headerRule
+	parentRules []parentRule
+	chainRules  []chainRule
+
+	// statLogger counts rejected blocks by reason. Counting is skipped if it is nil
+	statLogger *common.StatLogger
+}
+
+// newValidator creates a validator with the rules that only depend on the concurrency level
+func newValidator(concurrencyLevel int) *validator {
+
+	v := &validator{}
+
+	v.addHeaderRule(checkHeight)
+	v.addHeaderRule(checkNonce)
+	v.addHeaderRule(checkIssuer)
+	v.addHeaderRule(checkParentCount(concurrencyLevel))
+	v.addHeaderRule(checkUniqueParents)
+
+	v.addParentRule(checkParentHeight)
+	v.addParentRule(checkParentOrder(concurrencyLevel))
+	v.addParentRule(checkParentBranch)
+
+	return v
+}
+
+func (v *validator) addHeaderRule(rule headerRule) {
+	v.headerRules = append(v.headerRules, rule)
+}
+
+func (v *validator) addParentRule(rule parentRule) {
+	v.parentRules = append(v.parentRules, rule)
+}
+
+func (v *validator) addChainRule(rule chainRule) {
+	v.chainRules = append(v.chainRules, rule)
+}
+
+// validateHeader applies header rules
+func (v *validator) validateHeader(header common.BlockHeader) error {
+
+	for _, rule := range v.headerRules {
+		if err := rule(header); err != nil {
+			return v.rejected(header.Hash(), err)
+		}
+	}
+
+	return nil
+}
+
+// validateBlock applies header rules, and checks that the payload matches the header
+func (v *validator) validateBlock(block common.Block) error {
+
+	if err := v.validateHeader(block.Header()); err != nil {
+		return err
+	}
+
+	if !block.HasValidPayload() {
+		return v.rejected(block.Hash(), reject(RejectInvalidPayloadRoot, "payload does not match the payload root"))
+	}
+
+	return nil
+}
+
+// validateParents applies parent rules
+func (v *validator) validateParents(block common.Block, parentHeaders []common.BlockHeader) error {
+
+	for _, rule := range v.parentRules {
+		if err := rule(block, parentHeaders); err != nil {
+			return v.rejected(block.Hash(), err)
+		}
+	}
+
+	return nil
+}
+
+// validateChain applies chain rules
+func (v *validator) validateChain(block common.Block, parent *macroBlock) error {
+
+	for _, rule := range v.chainRules {
+		if err := rule(block, parent); err != nil {
+			return v.rejected(block.Hash(), err)
+		}
+	}
+
+	return nil
+}
+
+// rejected logs the rejection, and counts it by reason
+func (v *validator) rejected(hash []byte, err error) error {
+
+	log.Printf("Rejected:\t\t%x\t%s\n", hash, err)
+
+	if rejectErr, ok := err.(*RejectError); ok && v.statLogger != nil {
+		v.statLogger.IncrementCounter(fmt.Sprintf("REJECTED_%s", rejectErr.Reason))
+	}
+
+	return err
+}
+
+func checkHeight(header common.BlockHeader) error {
+
+	if header.Height < 1 {
+		return reject(RejectHeightDiscontinuity, "block height is %d", header.Height)
+	}
+
+	return nil
+}
+
+func checkNonce(header common.BlockHeader) error {
+
+	if header.Nonce < 0 {
+		return reject(RejectInvalidNonce, "block nonce is %d", header.Nonce)
+	}
+
+	return nil
+}
+
+func checkIssuer(header common.BlockHeader) error {
+
+	if len(header.Issuer) != ed25519.PublicKeySize {
+		return reject(RejectInvalidIssuer, "issuer key size is %d bytes", len(header.Issuer))
+	}
+
+	return nil
+}
+
+// issuerSet keeps the keys allowed to issue blocks. It is updated while blocks are validated, and an empty set rejects all issuers
+type issuerSet struct {
+	mutex sync.RWMutex
+	keys  map[string]struct{}
+}
+
+// set replaces the allowed keys
+func (s *issuerSet) set(keys [][]byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		s.keys[string(key)] = struct{}{}
+	}
+}
+
+// newIssuerSet creates an issuer set allowing the given keys
+func newIssuerSet(keys [][]byte) *issuerSet {
+
+	s := &issuerSet{}
+	s.set(keys)
+	return s
+}
+
+// allows returns true if the key is in the set
+func (s *issuerSet) allows(key []byte) bool {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.keys[string(key)]
+	return ok
+}
+
+// checkKnownIssuer rejects blocks whose issuer is not in the issuer set
+func checkKnownIssuer(issuers *issuerSet) headerRule {
+	return func(header common.BlockHeader) error {
+
+		if !issuers.allows(header.Issuer) {
+			return reject(RejectUnknownIssuer, "issuer %x is not a registered validator", header.Issuer)
+		}
+
+		return nil
+	}
+}
+
+func checkSignature(header common.BlockHeader) error {
+
+	if !ed25519.Verify(header.Issuer, header.SigningHash(), header.Signature) {
+		return reject(RejectInvalidSignature, "signature does not match the issuer")
+	}
+
+	return nil
+}
+
+func checkProofOfWork(header common.BlockHeader) error {
+
+	if !meetsTarget(header.SigningHash(), difficultyTarget(header.Difficulty)) {
+		return reject(RejectInsufficientWork, "hash does not meet the target of difficulty %d", header.Difficulty)
+	}
+
+	return nil
+}
+
+// checkPayloadSize rejects blocks whose payload is larger than maxPayloadSize bytes
+func checkPayloadSize(maxPayloadSize int) headerRule {
+	return func(header common.BlockHeader) error {
+
+		if header.PayloadSize > maxPayloadSize {
+			return reject(RejectOversizedPayload, "payload size is %d bytes, maximum is %d bytes", header.PayloadSize, maxPayloadSize)
+		}
+
+		return nil
+	}
+}
+
+// checkParentCount rejects blocks that do not reference a complete macroblock.
+// The genesis macroblock contains a single block
+func checkParentCount(concurrencyLevel int) headerRule {
+	return func(header common.BlockHeader) error {
+
+		expectedCount := concurrencyLevel
+		if header.Height == 1 {
+			expectedCount = 1
+		}
+
+		if len(header.PrevBlockHashes) != expectedCount {
+			return reject(RejectIncompleteParent, "block references %d parents, expected %d", len(header.PrevBlockHashes), expectedCount)
+		}
+
+		return nil
+	}
+}
+
+func checkUniqueParents(header common.BlockHeader) error {
+
+	seen := make(map[string]struct{}, len(header.PrevBlockHashes))
+	for _, h := range header.PrevBlockHashes {
+
+		if _, ok := seen[string(h)]; ok {
+			return reject(RejectDuplicateSlot, "parent %x is referenced more than once", h)
+		}
+
+		seen[string(h)] = struct{}{}
+	}
+
+	return nil
+}
+
+func checkParentHeight(block common.Block, parentHeaders []common.BlockHeader) error {
+
+	for _, parent := range parentHeaders {
+		if parent.Height != block.Height-1 {
+			return reject(RejectHeightDiscontinuity, "block height is %d, parent height is %d", block.Height, parent.Height)
+		}
+	}
+
+	return nil
+}
+
+// checkParentOrder rejects blocks whose parents are not ordered by microblock index
+func checkParentOrder(concurrencyLevel int) parentRule {
+	return func(block common.Block, parentHeaders []common.BlockHeader) error {
+
+		// the genesis block does not have a microblock index
+		if block.Height == 1 {
+			return nil
+		}
+
+		for i, parent := range parentHeaders {
+
+			index := int(parent.Nonce % int64(concurrencyLevel))
+			if index == i {
+				continue
+			}
+
+			for j := 0; j < i; j++ {
+				if int(parentHeaders[j].Nonce%int64(concurrencyLevel)) == index {
+					return reject(RejectDuplicateSlot, "two parents have the microblock index %d", index)
+				}
+			}
+
+			return reject(RejectUnorderedParent, "parent with microblock index %d is at position %d", index, i)
+		}
+
+		return nil
+	}
+}
+
+// checkParentBranch rejects blocks whose parents extend different macroblocks
+func checkParentBranch(block common.Block, parentHeaders []common.BlockHeader) error {
+
+	for i := 1; i < len(parentHeaders); i++ {
+		if macroBlockKey(parentHeaders[i].PrevBlockHashes) != macroBlockKey(parentHeaders[0].PrevBlockHashes) {
+			return reject(RejectInconsistentParent, "parents extend different macroblocks")
+		}
+	}
+
+	return nil
+}
+
+// checkDifficulty rejects blocks whose difficulty differs from the one computed by the adjuster
+func checkDifficulty(adjuster *difficultyAdjuster) chainRule {
+	return func(block common.Block, parent *macroBlock) error {
+
+		expectedDifficulty, err := adjuster.difficulty(parent)
+		if err != nil {
+			return reject(RejectInvalidDifficulty, "%s", err)
+		}
+
+		if block.Difficulty != expectedDifficulty {
+			return reject(RejectInvalidDifficulty, "block difficulty is %d, expected difficulty is %d", block.Difficulty, expectedDifficulty)
+		}
+
+		return nil
+	}
+}
+
+// checkTransactions rejects blocks whose payload is not a list of transactions starting with a coinbase transaction,
+// or whose transactions spend missing or already spent outputs of the branch they extend
+func checkTransactions(ledger *Ledger) chainRule {
+	return func(block common.Block, parent *macroBlock) error {
+
+		txs, err := common.DecodeTransactions(block.Payload)
+		if err != nil {
+			return reject(RejectMalformedPayload, "%s", err)
+		}
+
+		if len(txs) == 0 {
+			return reject(RejectInvalidTransaction, "block does not contain a coinbase transaction")
+		}
+
+		if err := checkCoinbase(txs[0], block.Height); err != nil {
+			return reject(RejectInvalidTransaction, "%s", err)
+		}
+
+		view := ledger.utxoSetAt(parent).view()
+		view.applyTransaction(txs[0])
+
+		for i, tx := range txs[1:] {
+
+			err := view.checkTransaction(tx)
+			if err == errMissingOutput || err == errDoubleSpend {
+				return reject(RejectMissingInput, "transaction %d: %s", i+1, err)
+			}
+
+			if err != nil {
+				return reject(RejectInvalidTransaction, "transaction %d: %s", i+1, err)
+			}
+
+			view.applyTransaction(tx)
+		}
+
+		return nil
+	}
+}
+
+// checkCoinbase returns an error if the coinbase transaction is not valid for the given height
+func checkCoinbase(tx common.Transaction, height int) error {
+
+	if !tx.IsCoinbase() {
+		return fmt.Errorf("first transaction is not a coinbase transaction")
+	}
+
+	if tx.CoinbaseHeight != height {
+		return fmt.Errorf("coinbase height is %d, block height is %d", tx.CoinbaseHeight, height)
+	}
+
+	return checkOutputs(tx, blockReward)
+}
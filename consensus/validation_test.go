@@ -0,0 +1,123 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func expectReject(t *testing.T, err error, reason RejectReason) {
+
+	t.Helper()
+
+	rejectErr, ok := err.(*RejectError)
+	if !ok {
+		t.Errorf("expected %s rejection, got %v", reason, err)
+		return
+	}
+
+	if rejectErr.Reason != reason {
+		t.Errorf("expected %s rejection, got %s", reason, rejectErr.Reason)
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := newValidator(2)
+	v.addHeaderRule(checkPayloadSize(1000))
+	v.addHeaderRule(checkSignature)
+
+	block := createBlock(1, [][]byte{[]byte("genesis")}, 1000, 1)
+	block.Issuer = pubKey
+	block.Signature = Sign(block.SigningHash(), privKey)
+
+	if err := v.validateBlock(block); err != nil {
+		t.Errorf("valid block is rejected: %s", err)
+	}
+
+	tampered := block
+	tampered.Nonce++
+	expectReject(t, v.validateBlock(tampered), RejectInvalidSignature)
+
+	tampered = block
+	tampered.Issuer = []byte("short key")
+	expectReject(t, v.validateBlock(tampered), RejectInvalidIssuer)
+
+	tampered = block
+	tampered.Height = 0
+	expectReject(t, v.validateBlock(tampered), RejectHeightDiscontinuity)
+
+	tampered = block
+	tampered.Height = 2
+	expectReject(t, v.validateBlock(tampered), RejectIncompleteParent)
+
+	tampered = block
+	tampered.SetPayload(make([]byte, 1001))
+	expectReject(t, v.validateBlock(tampered), RejectOversizedPayload)
+
+	// the payload does not match the signed header
+	tampered = block
+	tampered.Payload = make([]byte, block.PayloadSize)
+	expectReject(t, v.validateBlock(tampered), RejectInvalidPayloadRoot)
+}
+
+func TestValidateIssuerSet(t *testing.T) {
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuers := newIssuerSet(nil)
+
+	v := newValidator(2)
+	v.addHeaderRule(checkKnownIssuer(issuers))
+	v.addHeaderRule(checkSignature)
+
+	block := createBlock(1, [][]byte{[]byte("genesis")}, 1000, 1)
+	block.Issuer = pubKey
+	block.Signature = Sign(block.SigningHash(), privKey)
+
+	// an empty validator key set rejects all issuers
+	expectReject(t, v.validateBlock(block), RejectUnknownIssuer)
+
+	issuers.set([][]byte{otherKey})
+	expectReject(t, v.validateBlock(block), RejectUnknownIssuer)
+
+	issuers.set([][]byte{otherKey, pubKey})
+	if err := v.validateBlock(block); err != nil {
+		t.Errorf("block of a validator is rejected: %s", err)
+	}
+}
+
+func TestValidateParents(t *testing.T) {
+
+	v := newValidator(2)
+
+	first := common.BlockHeader{Height: 1, Nonce: 0}
+	second := common.BlockHeader{Height: 1, Nonce: 1}
+	block := common.Block{Height: 2}
+
+	if err := v.validateParents(block, []common.BlockHeader{first, second}); err != nil {
+		t.Errorf("valid parents are rejected: %s", err)
+	}
+
+	expectReject(t, v.validateParents(block, []common.BlockHeader{second, first}), RejectUnorderedParent)
+
+	third := common.BlockHeader{Height: 1, Nonce: 2}
+	expectReject(t, v.validateParents(block, []common.BlockHeader{first, third}), RejectDuplicateSlot)
+
+	second.Height = 0
+	expectReject(t, v.validateParents(block, []common.BlockHeader{first, second}), RejectHeightDiscontinuity)
+}
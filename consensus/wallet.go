@@ -0,0 +1,86 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// walletOutputCount is the number of outputs the wallet splits a coinbase or a spent output into.
+// Splitting increases the number of outputs the node can spend in the next rounds
+const walletOutputCount = 16
+
+// wallet creates transactions spending the outputs of a key pair
+type wallet struct {
+	publicKey  []byte
+	privateKey []byte
+}
+
+func newWallet(publicKey []byte, privateKey []byte) *wallet {
+	return &wallet{publicKey: publicKey, privateKey: privateKey}
+}
+
+// coinbase creates the coinbase transaction of a block of the given height
+func (w *wallet) coinbase(height int) common.Transaction {
+
+	return common.Transaction{CoinbaseHeight: height, Outputs: w.split(blockReward)}
+}
+
+// spend creates a signed transaction that splits the given output between new outputs of the wallet
+func (w *wallet) spend(entry utxoEntry) common.Transaction {
+
+	tx := common.Transaction{
+		Inputs:  []common.TxInput{{PrevOut: entry.outPoint}},
+		Outputs: w.split(entry.output.Value),
+	}
+
+	digest := tx.Hash()
+	for i := range tx.Inputs {
+		tx.Inputs[i].Signature = ed25519.Sign(w.privateKey, digest)
+	}
+
+	return tx
+}
+
+// createTransactions creates transactions spending the outputs of the wallet in the given UTXO set
+// that are not spent yet according to isSpent. The total size of the transactions is at most maxSize bytes
+func (w *wallet) createTransactions(set *utxoSet, isSpent func(common.OutPoint) bool, maxSize int) []common.Transaction {
+
+	var txs []common.Transaction
+	size := 0
+
+	for _, entry := range set.ownedBy(w.publicKey) {
+
+		if isSpent(entry.outPoint) {
+			continue
+		}
+
+		tx := w.spend(entry)
+		if size+tx.Size() > maxSize {
+			break
+		}
+
+		txs = append(txs, tx)
+		size += tx.Size()
+	}
+
+	return txs
+}
+
+func (w *wallet) split(value int64) []common.TxOutput {
+
+	outputCount := int64(walletOutputCount)
+	if value < outputCount {
+		outputCount = value
+	}
+
+	outputs := make([]common.TxOutput, outputCount)
+	for i := range outputs {
+		outputs[i] = common.TxOutput{Value: value / outputCount, PublicKey: w.publicKey}
+	}
+
+	// the remainder goes to the first output
+	outputs[0].Value += value % outputCount
+
+	return outputs
+}
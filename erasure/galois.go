@@ -0,0 +1,63 @@
+package erasure
+
+// Arithmetic in GF(2^8) with the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+
+	x := 1
+	for i := 0; i < 255; i++ {
+
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// gfInv returns the multiplicative inverse of a non-zero element
+func gfInv(a byte) byte {
+
+	return expTable[255-int(logTable[a])]
+}
+
+// mulTable returns the products of the coefficient with all elements
+func mulTable(coefficient byte) *[256]byte {
+
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(coefficient, byte(i))
+	}
+
+	return &table
+}
+
+// mulAdd adds the product of the coefficient and src to dst
+func mulAdd(dst []byte, src []byte, coefficient byte) {
+
+	if coefficient == 0 {
+		return
+	}
+
+	table := mulTable(coefficient)
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
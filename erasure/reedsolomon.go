@@ -0,0 +1,186 @@
+package erasure
+
+import (
+	"errors"
+)
+
+// MaxFragmentCount is the maximum number of fragments supported by GF(2^8)
+const MaxFragmentCount = 256
+
+var (
+	ErrInvalidParameters = errors.New("fragment counts must satisfy 1 <= data fragments <= fragments <= 256")
+	ErrTooFewFragments   = errors.New("not enough fragments to reconstruct the data")
+	ErrFragmentSize      = errors.New("fragments have different sizes")
+	ErrDataSize          = errors.New("data size is outside of the fragment capacity")
+)
+
+// Encoder implements a systematic Reed-Solomon code. Data is split into dataCount fragments, and extended with
+// fragmentCount-dataCount parity fragments. Any dataCount fragments are enough to reconstruct the data
+type Encoder struct {
+	dataCount     int
+	fragmentCount int
+
+	// parity is the Cauchy matrix producing parity fragments from data fragments.
+	// Every square submatrix of a Cauchy matrix is invertible, so any dataCount rows of the encoding matrix are independent
+	parity [][]byte
+}
+
+// NewEncoder creates an encoder producing fragmentCount fragments, any dataCount of which reconstruct the data
+func NewEncoder(dataCount int, fragmentCount int) (*Encoder, error) {
+
+	if dataCount < 1 || fragmentCount < dataCount || fragmentCount > MaxFragmentCount {
+		return nil, ErrInvalidParameters
+	}
+
+	parity := make([][]byte, fragmentCount-dataCount)
+	for i := range parity {
+
+		parity[i] = make([]byte, dataCount)
+		for j := range parity[i] {
+			// x = dataCount+i and y = j are distinct, so x+y is not zero
+			parity[i][j] = gfInv(byte(dataCount+i) ^ byte(j))
+		}
+	}
+
+	return &Encoder{dataCount: dataCount, fragmentCount: fragmentCount, parity: parity}, nil
+}
+
+// DataCount returns the number of fragments required to reconstruct the data
+func (e *Encoder) DataCount() int {
+	return e.dataCount
+}
+
+// FragmentCount returns the number of fragments produced by the encoder
+func (e *Encoder) FragmentCount() int {
+	return e.fragmentCount
+}
+
+// Encode splits the data into fragments of equal size. The first dataCount fragments contain the data padded with zeros
+func (e *Encoder) Encode(data []byte) [][]byte {
+
+	fragmentSize := (len(data) + e.dataCount - 1) / e.dataCount
+
+	fragments := make([][]byte, e.fragmentCount)
+	for i := range fragments {
+		fragments[i] = make([]byte, fragmentSize)
+	}
+
+	for i := 0; i < e.dataCount; i++ {
+
+		start := i * fragmentSize
+		if start < len(data) {
+			copy(fragments[i], data[start:])
+		}
+	}
+
+	for i, row := range e.parity {
+		for j, coefficient := range row {
+			mulAdd(fragments[e.dataCount+i], fragments[j], coefficient)
+		}
+	}
+
+	return fragments
+}
+
+// Decode reconstructs dataSize bytes of data from the fragments. Missing fragments are nil,
+// and at least dataCount fragments must be available
+func (e *Encoder) Decode(fragments [][]byte, dataSize int) ([]byte, error) {
+
+	if len(fragments) != e.fragmentCount {
+		return nil, ErrTooFewFragments
+	}
+
+	var indexes []int
+	for i, fragment := range fragments {
+		if fragment != nil && len(indexes) < e.dataCount {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if len(indexes) < e.dataCount {
+		return nil, ErrTooFewFragments
+	}
+
+	fragmentSize := len(fragments[indexes[0]])
+	for _, i := range indexes {
+		if len(fragments[i]) != fragmentSize {
+			return nil, ErrFragmentSize
+		}
+	}
+
+	if dataSize < 0 || dataSize > fragmentSize*e.dataCount {
+		return nil, ErrDataSize
+	}
+
+	// the rows of the encoding matrix producing the available fragments
+	matrix := make([][]byte, e.dataCount)
+	for r, i := range indexes {
+
+		if i < e.dataCount {
+			matrix[r] = make([]byte, e.dataCount)
+			matrix[r][i] = 1
+		} else {
+			matrix[r] = append([]byte{}, e.parity[i-e.dataCount]...)
+		}
+	}
+
+	inverse := invert(matrix)
+
+	data := make([]byte, fragmentSize*e.dataCount)
+	for j := 0; j < e.dataCount; j++ {
+
+		dataFragment := data[j*fragmentSize : (j+1)*fragmentSize]
+		if fragments[j] != nil {
+			// the data fragment is available, and it is one of the selected fragments
+			copy(dataFragment, fragments[j])
+			continue
+		}
+
+		for r, i := range indexes {
+			mulAdd(dataFragment, fragments[i], inverse[j][r])
+		}
+	}
+
+	return data[:dataSize], nil
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan elimination. The matrix must be invertible
+func invert(matrix [][]byte) [][]byte {
+
+	size := len(matrix)
+
+	inverse := make([][]byte, size)
+	for i := range inverse {
+		inverse[i] = make([]byte, size)
+		inverse[i][i] = 1
+	}
+
+	for column := 0; column < size; column++ {
+
+		pivot := column
+		for matrix[pivot][column] == 0 {
+			pivot++
+		}
+		matrix[column], matrix[pivot] = matrix[pivot], matrix[column]
+		inverse[column], inverse[pivot] = inverse[pivot], inverse[column]
+
+		scale := gfInv(matrix[column][column])
+		for k := 0; k < size; k++ {
+			matrix[column][k] = gfMul(matrix[column][k], scale)
+			inverse[column][k] = gfMul(inverse[column][k], scale)
+		}
+
+		for row := 0; row < size; row++ {
+
+			factor := matrix[row][column]
+			if row == column || factor == 0 {
+				continue
+			}
+
+			mulAdd(matrix[row], matrix[column], factor)
+			mulAdd(inverse[row], inverse[column], factor)
+		}
+	}
+
+	return inverse
+}
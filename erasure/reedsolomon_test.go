@@ -0,0 +1,57 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+
+	encoder, err := NewEncoder(4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1001)
+	rand.Read(data)
+
+	fragments := encoder.Encode(data)
+	if len(fragments) != 10 {
+		t.Fatalf("expected 10 fragments, got %d", len(fragments))
+	}
+
+	// any 4 of 10 fragments reconstruct the data
+	for trial := 0; trial < 50; trial++ {
+
+		available := make([][]byte, len(fragments))
+		for _, i := range rand.Perm(len(fragments))[:4] {
+			available[i] = fragments[i]
+		}
+
+		decoded, err := encoder.Decode(available, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("decoded data is different from the encoded data")
+		}
+	}
+
+	available := make([][]byte, len(fragments))
+	copy(available[7:], fragments[7:])
+	if _, err := encoder.Decode(available, len(data)); err != ErrTooFewFragments {
+		t.Errorf("expected %s, got %v", ErrTooFewFragments, err)
+	}
+
+	for _, size := range []int{-1, len(fragments[0])*4 + 1} {
+		if _, err := encoder.Decode(fragments, size); err != ErrDataSize {
+			t.Errorf("expected %s for data size %d, got %v", ErrDataSize, size, err)
+		}
+	}
+
+	if _, err := NewEncoder(4, 3); err != ErrInvalidParameters {
+		t.Errorf("expected %s, got %v", ErrInvalidParameters, err)
+	}
+}
@@ -0,0 +1,103 @@
+package keystore
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// pemType is the PEM block type of the key file
+const pemType = "PRIVATE KEY"
+
+var (
+	// ErrInvalidKeyFile is returned when a key file does not keep an ed25519 private key
+	ErrInvalidKeyFile = errors.New("file does not keep an ed25519 private key")
+)
+
+// LoadOrCreate loads the ed25519 private key of the node from the given path. If the file does not exist,
+// a new key is generated and written to the file, so the node keeps its identity across restarts.
+// The key is kept as a PKCS #8 PEM block, readable only by the owner
+func LoadOrCreate(path string) (ed25519.PrivateKey, error) {
+
+	privateKey, err := Load(path)
+	if !os.IsNotExist(err) {
+		return privateKey, err
+	}
+
+	_, privateKey, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := write(path, privateKey); err != nil {
+		return nil, err
+	}
+
+	return privateKey, nil
+}
+
+// Load reads the ed25519 private key from the given path
+func Load(path string) (ed25519.PrivateKey, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, ErrInvalidKeyFile
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidKeyFile
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidKeyFile
+	}
+
+	return privateKey, nil
+}
+
+// write writes the key to a temporary file and renames it, so a crash does not leave a partial key file
+func write(path string, privateKey ed25519.PrivateKey) error {
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := pem.Encode(file, &pem.Block{Type: pemType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
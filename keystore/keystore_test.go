@@ -0,0 +1,69 @@
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "node.key")
+
+	created, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file permissions are %v", info.Mode().Perm())
+	}
+
+	// the key is loaded on the next start instead of generated again
+	loaded, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(created, loaded) {
+		t.Errorf("loaded key is different from the created key")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("expected only the key file in the directory, found %d files", len(files))
+	}
+}
+
+func TestLoadInvalidKeyFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "node.key")
+	if err := ioutil.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid key file is not replaced, the node would lose its identity otherwise
+	if _, err := LoadOrCreate(path); err != ErrInvalidKeyFile {
+		t.Errorf("expected %v, got %v", ErrInvalidKeyFile, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "not a key" {
+		t.Errorf("invalid key file is modified")
+	}
+}
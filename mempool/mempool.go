@@ -0,0 +1,260 @@
+package mempool
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+var (
+	ErrAlreadyKnown    = errors.New("transaction is already in the mempool")
+	ErrConflict        = errors.New("transaction spends an output spent by another transaction in the mempool")
+	ErrCoinbase        = errors.New("coinbase transactions are not accepted")
+	ErrTooLarge        = errors.New("transaction is larger than the mempool")
+	ErrInvalidSpending = errors.New("transaction is not valid")
+)
+
+// TransactionChecker returns an error if a transaction can not be applied to the current chain state
+type TransactionChecker func(tx common.Transaction) error
+
+type entry struct {
+	tx      common.Transaction
+	hash    string
+	shortID uint64
+	size    int
+	arrival time.Time
+}
+
+// Mempool keeps the transactions waiting to be included in a block.
+// When the mempool is full or a transaction gets too old, the oldest transactions are evicted first
+type Mempool struct {
+	mutex sync.Mutex
+
+	maxSize int
+	maxAge  time.Duration
+
+	// entries keeps transactions in arrival order
+	entries *list.List
+	byHash  map[string]*list.Element
+
+	// byShortID keeps the transactions by their short identifiers, so compact blocks are matched without hashing the mempool
+	byShortID map[uint64][]*list.Element
+
+	// spentBy keeps the hash of the transaction spending an outpoint
+	spentBy map[string]string
+
+	size         int
+	evictedCount int
+}
+
+// NewMempool creates a mempool holding at most maxSize bytes of transactions for at most maxAge
+func NewMempool(maxSize int, maxAge time.Duration) *Mempool {
+
+	return &Mempool{
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		entries:   list.New(),
+		byHash:    make(map[string]*list.Element),
+		byShortID: make(map[uint64][]*list.Element),
+		spentBy:   make(map[string]string),
+	}
+}
+
+// Add admits a transaction if it is valid according to the checker, and it does not conflict with the transactions in the mempool
+func (m *Mempool) Add(tx common.Transaction, checker TransactionChecker) error {
+
+	if tx.IsCoinbase() {
+		return ErrCoinbase
+	}
+
+	hash := string(tx.Hash())
+	size := tx.Size()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.byHash[hash]; ok {
+		return ErrAlreadyKnown
+	}
+
+	if size > m.maxSize {
+		return ErrTooLarge
+	}
+
+	for _, input := range tx.Inputs {
+		if _, ok := m.spentBy[input.PrevOut.Key()]; ok {
+			return ErrConflict
+		}
+	}
+
+	if checker != nil {
+		if err := checker(tx); err != nil {
+			return ErrInvalidSpending
+		}
+	}
+
+	e := &entry{tx: tx, hash: hash, shortID: common.ShortTransactionID([]byte(hash)), size: size, arrival: time.Now()}
+	element := m.entries.PushBack(e)
+	m.byHash[hash] = element
+	m.byShortID[e.shortID] = append(m.byShortID[e.shortID], element)
+	for _, input := range tx.Inputs {
+		m.spentBy[input.PrevOut.Key()] = hash
+	}
+	m.size += size
+
+	m.evict()
+
+	return nil
+}
+
+// Contains returns true if the transaction with the given hash is in the mempool
+func (m *Mempool) Contains(hash []byte) bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.byHash[string(hash)]
+	return ok
+}
+
+// IsSpent returns true if a transaction in the mempool spends the outpoint
+func (m *Mempool) IsSpent(outPoint common.OutPoint) bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.spentBy[outPoint.Key()]
+	return ok
+}
+
+// Select returns the oldest transactions whose total size is at most maxSize bytes
+func (m *Mempool) Select(maxSize int) []common.Transaction {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.evict()
+
+	var txs []common.Transaction
+	size := 0
+	for element := m.entries.Front(); element != nil; element = element.Next() {
+
+		e := element.Value.(*entry)
+		if size+e.size > maxSize {
+			break
+		}
+
+		txs = append(txs, e.tx)
+		size += e.size
+	}
+
+	return txs
+}
+
+// TransactionByShortID returns the transaction with the given short identifier.
+// It returns false if no transaction, or more than one transaction has it
+func (m *Mempool) TransactionByShortID(shortID uint64) (common.Transaction, bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	elements := m.byShortID[shortID]
+	if len(elements) != 1 {
+		return common.Transaction{}, false
+	}
+
+	return elements[0].Value.(*entry).tx, true
+}
+
+// RemoveIncluded removes the transactions included in a block, and the transactions spending the same outputs
+func (m *Mempool) RemoveIncluded(txs []common.Transaction) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, tx := range txs {
+
+		if element, ok := m.byHash[string(tx.Hash())]; ok {
+			m.remove(element)
+			continue
+		}
+
+		for _, input := range tx.Inputs {
+			if hash, ok := m.spentBy[input.PrevOut.Key()]; ok {
+				m.remove(m.byHash[hash])
+			}
+		}
+	}
+}
+
+// Count returns the number of transactions in the mempool
+func (m *Mempool) Count() int {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.entries.Len()
+}
+
+// Size returns the total size of the transactions in the mempool in bytes
+func (m *Mempool) Size() int {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.size
+}
+
+// EvictedCount returns the number of transactions evicted because of size or age limits
+func (m *Mempool) EvictedCount() int {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.evictedCount
+}
+
+// evict removes the oldest transactions while the mempool is larger than its limit or they are older than the maximum age
+func (m *Mempool) evict() {
+
+	now := time.Now()
+	for element := m.entries.Front(); element != nil; element = m.entries.Front() {
+
+		e := element.Value.(*entry)
+		if m.size <= m.maxSize && now.Sub(e.arrival) <= m.maxAge {
+			return
+		}
+
+		m.remove(element)
+		m.evictedCount++
+	}
+}
+
+func (m *Mempool) remove(element *list.Element) {
+
+	e := m.entries.Remove(element).(*entry)
+	delete(m.byHash, e.hash)
+
+	elements := m.byShortID[e.shortID]
+	for i := range elements {
+		if elements[i] == element {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+
+	if len(elements) == 0 {
+		delete(m.byShortID, e.shortID)
+	} else {
+		m.byShortID[e.shortID] = elements
+	}
+	for _, input := range e.tx.Inputs {
+		if m.spentBy[input.PrevOut.Key()] == e.hash {
+			delete(m.spentBy, input.PrevOut.Key())
+		}
+	}
+	m.size -= e.size
+}
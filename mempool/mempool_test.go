@@ -0,0 +1,90 @@
+package mempool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func createTransaction(txHash string, index int, value int64) common.Transaction {
+	return common.Transaction{
+		Inputs:  []common.TxInput{{PrevOut: common.OutPoint{TxHash: []byte(txHash), Index: index}}},
+		Outputs: []common.TxOutput{{Value: value, PublicKey: []byte("key")}},
+	}
+}
+
+func TestMempool(t *testing.T) {
+
+	mempool := NewMempool(1000, time.Minute)
+
+	tx1 := createTransaction("a", 0, 10)
+	tx2 := createTransaction("a", 1, 10)
+	conflicting := createTransaction("a", 0, 20)
+
+	if err := mempool.Add(tx1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mempool.Add(tx1, nil); err != ErrAlreadyKnown {
+		t.Errorf("expected %s, got %v", ErrAlreadyKnown, err)
+	}
+
+	if err := mempool.Add(conflicting, nil); err != ErrConflict {
+		t.Errorf("expected %s, got %v", ErrConflict, err)
+	}
+
+	rejectAll := func(tx common.Transaction) error { return errors.New("invalid") }
+	if err := mempool.Add(tx2, rejectAll); err != ErrInvalidSpending {
+		t.Errorf("expected %s, got %v", ErrInvalidSpending, err)
+	}
+
+	if err := mempool.Add(tx2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx, ok := mempool.TransactionByShortID(common.ShortTransactionID(tx2.Hash())); !ok || string(tx.Hash()) != string(tx2.Hash()) {
+		t.Errorf("transaction is not found by its short identifier")
+	}
+
+	if txs := mempool.Select(tx1.Size()); len(txs) != 1 {
+		t.Errorf("expected one transaction, selected %d", len(txs))
+	}
+
+	// a transaction of a block spending the same output removes the conflicting transaction
+	mempool.RemoveIncluded([]common.Transaction{conflicting})
+	if mempool.Contains(tx1.Hash()) || mempool.IsSpent(tx1.Inputs[0].PrevOut) {
+		t.Errorf("conflicting transaction is not removed")
+	}
+
+	if _, ok := mempool.TransactionByShortID(common.ShortTransactionID(tx1.Hash())); ok {
+		t.Errorf("removed transaction is found by its short identifier")
+	}
+
+	if mempool.Count() != 1 || mempool.Size() != tx2.Size() {
+		t.Errorf("expected one transaction of %d bytes, got %d transactions of %d bytes", tx2.Size(), mempool.Count(), mempool.Size())
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+
+	tx1 := createTransaction("a", 0, 10)
+	tx2 := createTransaction("b", 0, 10)
+
+	mempool := NewMempool(tx1.Size()+tx2.Size()-1, time.Minute)
+	mempool.Add(tx1, nil)
+	mempool.Add(tx2, nil)
+
+	if mempool.Contains(tx1.Hash()) || !mempool.Contains(tx2.Hash()) || mempool.EvictedCount() != 1 {
+		t.Errorf("the oldest transaction is not evicted")
+	}
+
+	mempool = NewMempool(1000, 0)
+	mempool.Add(tx1, nil)
+	time.Sleep(time.Millisecond)
+
+	if len(mempool.Select(1000)) != 0 {
+		t.Errorf("expired transaction is selected")
+	}
+}
@@ -2,9 +2,11 @@ package network
 
 import (
 	"fmt"
+	"log"
 	"net/rpc"
 
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/wire"
 )
 
 // Client implements P2P client
@@ -16,25 +18,72 @@ type P2PClient struct {
 
 	blockChan chan common.Block
 
+	chunkChan chan common.BlockChunk
+
+	fragmentChan chan common.BlockFragment
+
+	transactionChan chan common.Transaction
+
+	headerChan chan HeaderAnnouncement
+
+	inventoryChan chan Inventory
+
+	compactBlockChan chan CompactBlock
+
+	tipChan chan TipAnnouncement
+
+	// framed sends messages with the framed protocol on wireConn instead of rpcClient. It is nil if the framed protocol is not enabled
+	framed   *FramedProtocol
+	wireConn *wire.Conn
+
 	err error
 }
 
 // NewClient creates a new client
 func NewClient(IPAddress string, portNumber int) (*P2PClient, error) {
 
-	rpcClient, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", IPAddress, portNumber))
+	rpcClient, err := dial(fmt.Sprintf("%s:%d", IPAddress, portNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	client := newClient(IPAddress, portNumber)
+	client.rpcClient = rpcClient
+
+	return client, nil
+}
+
+// newFramedClient creates a client sending blocks, transactions and tip announcements with the framed protocol
+func newFramedClient(IPAddress string, portNumber int, framed *FramedProtocol) (*P2PClient, error) {
+
+	wireConn, err := framed.dial(fmt.Sprintf("%s:%d", IPAddress, portNumber))
 	if err != nil {
 		return nil, err
 	}
 
+	client := newClient(IPAddress, portNumber)
+	client.framed = framed
+	client.wireConn = wireConn
+
+	return client, nil
+}
+
+func newClient(IPAddress string, portNumber int) *P2PClient {
+
 	client := &P2PClient{}
 	client.IPAddress = IPAddress
 	client.portNumber = portNumber
-	client.rpcClient = rpcClient
 
 	client.blockChan = make(chan common.Block, 1024)
-
-	return client, nil
+	client.chunkChan = make(chan common.BlockChunk, 1024)
+	client.fragmentChan = make(chan common.BlockFragment, 1024)
+	client.transactionChan = make(chan common.Transaction, 1024)
+	client.headerChan = make(chan HeaderAnnouncement, 1024)
+	client.inventoryChan = make(chan Inventory, 1024)
+	client.compactBlockChan = make(chan CompactBlock, 1024)
+	client.tipChan = make(chan TipAnnouncement, 1024)
+
+	return client
 }
 
 // Start starts the main loop of client. It blocks the calling goroutine
@@ -43,20 +92,128 @@ func (c *P2PClient) Start() {
 	c.mainLoop()
 }
 
-// SendBlockChunk enques a chunk of a block to send
+// SendBlock enques a block to send
 func (c *P2PClient) SendBlock(block common.Block) {
 
 	c.blockChan <- block
 }
 
+// SendBlockChunk enques a chunk of a block to send
+func (c *P2PClient) SendBlockChunk(chunk common.BlockChunk) {
+
+	c.chunkChan <- chunk
+}
+
+// SendBlockFragment enques an erasure coded fragment of a block to send
+func (c *P2PClient) SendBlockFragment(fragment common.BlockFragment) {
+
+	c.fragmentChan <- fragment
+}
+
+// SendTransaction enques a transaction to send
+func (c *P2PClient) SendTransaction(tx common.Transaction) {
+
+	c.transactionChan <- tx
+}
+
+// SendHeader enques a header announcement to send
+func (c *P2PClient) SendHeader(announcement HeaderAnnouncement) {
+
+	c.headerChan <- announcement
+}
+
+// SendInventory enques a block announcement to send
+func (c *P2PClient) SendInventory(inventory Inventory) {
+
+	c.inventoryChan <- inventory
+}
+
+// SendCompactBlock enques a compact block to send
+func (c *P2PClient) SendCompactBlock(compactBlock CompactBlock) {
+
+	c.compactBlockChan <- compactBlock
+}
+
+// SendTip enques a tip announcement to send
+func (c *P2PClient) SendTip(announcement TipAnnouncement) {
+
+	c.tipChan <- announcement
+}
+
 func (c *P2PClient) mainLoop() {
 
+	if c.framed != nil {
+		c.framedLoop()
+		return
+	}
+
 	for {
 		select {
 
 		case block := <-c.blockChan:
 			go c.rpcClient.Call("P2PServer.HandleBlock", block, nil)
 
+		case chunk := <-c.chunkChan:
+			go c.rpcClient.Call("P2PServer.HandleBlockChunk", chunk, nil)
+
+		case fragment := <-c.fragmentChan:
+			go c.rpcClient.Call("P2PServer.HandleBlockFragment", fragment, nil)
+
+		case tx := <-c.transactionChan:
+			go c.rpcClient.Call("P2PServer.HandleTransaction", tx, nil)
+
+		case announcement := <-c.headerChan:
+			go c.rpcClient.Call("P2PServer.HandleHeader", announcement, nil)
+
+		case inventory := <-c.inventoryChan:
+			go c.rpcClient.Call("P2PServer.HandleInventory", inventory, nil)
+
+		case compactBlock := <-c.compactBlockChan:
+			go c.rpcClient.Call("P2PServer.HandleCompactBlock", compactBlock, nil)
+
+		case announcement := <-c.tipChan:
+			go c.rpcClient.Call("P2PServer.HandleTip", announcement, nil)
+
 		}
 	}
 }
+
+// framedLoop sends blocks, transactions and tip announcements as framed messages. Other propagation modes are not supported by the framed protocol
+func (c *P2PClient) framedLoop() {
+
+	for {
+		select {
+
+		case block := <-c.blockChan:
+			c.sendMessage(wire.Block{Block: block})
+
+		case tx := <-c.transactionChan:
+			c.sendMessage(wire.Transactions{Transactions: []common.Transaction{tx}})
+
+		case announcement := <-c.tipChan:
+			c.sendMessage(wire.Announce{Height: announcement.Height, Hashes: announcement.BlockHashes})
+
+		}
+	}
+}
+
+// sendMessage writes a message to the peer. The connection is opened again if it is closed, and the message is dropped if that fails
+func (c *P2PClient) sendMessage(m wire.Message) {
+
+	if c.wireConn == nil {
+
+		wireConn, err := c.framed.dial(fmt.Sprintf("%s:%d", c.IPAddress, c.portNumber))
+		if err != nil {
+			log.Printf("could not connect to %s:%d: %s\n", c.IPAddress, c.portNumber, err)
+			return
+		}
+
+		c.wireConn = wireConn
+	}
+
+	if err := c.wireConn.WriteMessage(m); err != nil {
+		log.Printf("could not send %s message to %s:%d: %s\n", m.Type(), c.IPAddress, c.portNumber, err)
+		c.wireConn.Close()
+		c.wireConn = nil
+	}
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+)
+
+// boundServerCodec is the gob codec of net/rpc for a connection opened by an authenticated node.
+// The self-declared address of each received announcement is replaced with the registered address of the node,
+// so a node can not direct the requests of the receiver to the address of another node
+type boundServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	ipAddress  string
+	portNumber int
+}
+
+// newBoundServerCodec creates a codec binding the announcements received on the connection to the given host:port address
+func newBoundServerCodec(conn io.ReadWriteCloser, address string) (*boundServerCodec, error) {
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewWriter(conn)
+	codec := &boundServerCodec{
+		rwc:        conn,
+		dec:        gob.NewDecoder(conn),
+		enc:        gob.NewEncoder(buf),
+		encBuf:     buf,
+		ipAddress:  host,
+		portNumber: portNumber,
+	}
+
+	return codec, nil
+}
+
+func (c *boundServerCodec) ReadRequestHeader(r *rpc.Request) error {
+
+	return c.dec.Decode(r)
+}
+
+func (c *boundServerCodec) ReadRequestBody(body interface{}) error {
+
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+
+	switch m := body.(type) {
+	case *HeaderAnnouncement:
+		c.bind(&m.IPAddress, &m.PortNumber)
+	case *Inventory:
+		c.bind(&m.IPAddress, &m.PortNumber)
+	case *CompactBlock:
+		c.bind(&m.IPAddress, &m.PortNumber)
+	case *TipAnnouncement:
+		c.bind(&m.IPAddress, &m.PortNumber)
+	}
+
+	return nil
+}
+
+// bind replaces a self-declared address with the registered address of the node
+func (c *boundServerCodec) bind(ipAddress *string, portNumber *int) {
+
+	if *ipAddress != c.ipAddress || *portNumber != c.portNumber {
+		log.Printf("node %s:%d declared the address %s:%d, using its registered address\n", c.ipAddress, c.portNumber, *ipAddress, *portNumber)
+	}
+
+	*ipAddress = c.ipAddress
+	*portNumber = c.portNumber
+}
+
+func (c *boundServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the header could not be encoded, the connection is closed since the stream can not be recovered
+			c.Close()
+		}
+		return err
+	}
+
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *boundServerCodec) Close() error {
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,267 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// transactionRequestTimeout is the time to wait for the missing transactions of a compact block
+const transactionRequestTimeout = 5 * time.Second
+
+var (
+	ErrCompactBlockDisabled = errors.New("compact block propagation is not enabled")
+	ErrInvalidIndex         = errors.New("transaction index is out of range")
+)
+
+// TransactionPool provides the transactions a compact block is reconstructed from
+type TransactionPool interface {
+	// TransactionByShortID returns the transaction with the given short identifier. It returns false if no transaction,
+	// or more than one transaction has it
+	TransactionByShortID(shortID uint64) (common.Transaction, bool)
+}
+
+// CompactBlock announces a block with its header, and the short identifiers of its transactions.
+// The coinbase transaction is sent in full, since it can not be in the mempool of the receiver
+type CompactBlock struct {
+	Header common.BlockHeader
+
+	Coinbase common.Transaction
+
+	// ShortIDs identify the transactions following the coinbase transaction in order
+	ShortIDs []uint64
+
+	IPAddress  string
+	PortNumber int
+}
+
+// TransactionRequest requests the transactions of a block by their indexes in the payload
+type TransactionRequest struct {
+	BlockHash []byte
+	Indexes   []int
+}
+
+// CompactBlockRelay implements compact block propagation. A received compact block is rebuilt from the transactions of
+// the local mempool, and only the missing transactions are requested from the sender before the block is enqueued
+type CompactBlockRelay struct {
+	mutex sync.Mutex
+
+	demux      *common.Demux
+	statLogger *common.StatLogger
+	pool       TransactionPool
+
+	IPAddress  string
+	portNumber int
+
+	// blocks keeps the transactions of the blocks announced by the node by block hash. Blocks of finalized rounds are evicted
+	blocks map[string][]common.Transaction
+
+	// rounds keeps the hashes of the announced blocks by round
+	rounds *roundIndex
+
+	// pending keeps the hashes of the blocks being reconstructed
+	pending map[string]struct{}
+
+	// connections keeps connections to the nodes missing transactions are requested from
+	connections *connectionPool
+}
+
+// NewCompactBlockRelay creates a compact block relay for the node listening on the given address
+func NewCompactBlockRelay(demux *common.Demux, statLogger *common.StatLogger, IPAddress string, portNumber int) *CompactBlockRelay {
+
+	return &CompactBlockRelay{
+		demux:       demux,
+		statLogger:  statLogger,
+		IPAddress:   IPAddress,
+		portNumber:  portNumber,
+		blocks:      make(map[string][]common.Transaction),
+		rounds:      newRoundIndex(),
+		pending:     make(map[string]struct{}),
+		connections: newConnectionPool(),
+	}
+}
+
+// SetTransactionPool sets the pool compact blocks are reconstructed from.
+// All transactions are requested from the sender until it is set
+func (r *CompactBlockRelay) SetTransactionPool(pool TransactionPool) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pool = pool
+}
+
+// publish keeps the block to serve its transactions, and returns its compact form.
+// It returns false if the block is already announced, or its payload is not a list of transactions. The blocks of finalized rounds are evicted
+func (r *CompactBlockRelay) publish(block common.Block) (CompactBlock, bool) {
+
+	txs, err := common.DecodeTransactions(block.Payload)
+	if err != nil || len(txs) == 0 {
+		return CompactBlock{}, false
+	}
+
+	blockHash := block.Hash()
+	finalizedRound := r.demux.FinalizedRound()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, key := range r.rounds.evict(finalizedRound) {
+		delete(r.blocks, key)
+	}
+
+	if _, ok := r.blocks[string(blockHash)]; ok {
+		return CompactBlock{}, false
+	}
+
+	r.blocks[string(blockHash)] = txs
+	r.rounds.add(block.Height, string(blockHash))
+
+	shortIDs := make([]uint64, len(txs)-1)
+	for i, tx := range txs[1:] {
+		shortIDs[i] = common.ShortTransactionID(tx.Hash())
+	}
+
+	return CompactBlock{Header: block.Header(), Coinbase: txs[0], ShortIDs: shortIDs, IPAddress: r.IPAddress, PortNumber: r.portNumber}, true
+}
+
+// handleCompactBlock reconstructs the block, and enqueues it
+func (r *CompactBlockRelay) handleCompactBlock(compactBlock CompactBlock) error {
+
+	blockHash := compactBlock.Header.Hash()
+	key := string(blockHash)
+
+	err := r.demux.ValidateHeader(compactBlock.Header)
+	if err == common.ErrAlreadyProcessed {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	_, published := r.blocks[key]
+	_, pending := r.pending[key]
+	if published || pending {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.pending[key] = struct{}{}
+	pool := r.pool
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.pending, key)
+		r.mutex.Unlock()
+	}()
+
+	txs, missing := r.match(compactBlock, pool)
+	r.statLogger.AddToCounter("COMPACT_BLOCK_MISSING_TRANSACTIONS", len(missing))
+
+	source := fmt.Sprintf("%s:%d", compactBlock.IPAddress, compactBlock.PortNumber)
+	if len(missing) > 0 {
+		if err := r.requestTransactions(source, blockHash, txs, missing); err != nil {
+			log.Printf("could not fetch the transactions of %x from %s: %s\n", blockHash, source, err)
+			return err
+		}
+	}
+
+	block := compactBlock.Header.Block(common.EncodeTransactions(txs))
+	if !block.HasValidPayload() {
+		// a short identifier collision, or a transaction with different signatures in the mempool
+		r.statLogger.IncrementCounter("COMPACT_BLOCK_FALLBACK")
+
+		all := make([]int, len(txs))
+		for i := range all {
+			all[i] = i
+		}
+
+		if err := r.requestTransactions(source, blockHash, txs, all); err != nil {
+			log.Printf("could not fetch the transactions of %x from %s: %s\n", blockHash, source, err)
+			return err
+		}
+
+		block = compactBlock.Header.Block(common.EncodeTransactions(txs))
+	}
+
+	r.statLogger.IncrementCounter("COMPACT_BLOCK_RECONSTRUCTED")
+	r.demux.EnqueBlock(block)
+
+	return nil
+}
+
+// match fills the transactions of the compact block available in the pool, and returns the indexes of the missing ones
+func (r *CompactBlockRelay) match(compactBlock CompactBlock, pool TransactionPool) ([]common.Transaction, []int) {
+
+	txs := make([]common.Transaction, len(compactBlock.ShortIDs)+1)
+	txs[0] = compactBlock.Coinbase
+
+	var missing []int
+	for i, shortID := range compactBlock.ShortIDs {
+
+		var tx common.Transaction
+		ok := false
+		if pool != nil {
+			tx, ok = pool.TransactionByShortID(shortID)
+		}
+
+		if !ok {
+			missing = append(missing, i+1)
+			continue
+		}
+
+		txs[i+1] = tx
+	}
+
+	return txs, missing
+}
+
+// requestTransactions requests the transactions with the given indexes from the sender of the compact block
+func (r *CompactBlockRelay) requestTransactions(source string, blockHash []byte, txs []common.Transaction, indexes []int) error {
+
+	var received []common.Transaction
+	request := TransactionRequest{BlockHash: blockHash, Indexes: indexes}
+	if err := r.connections.call(source, "P2PServer.GetBlockTransactions", request, &received, transactionRequestTimeout); err != nil {
+		return err
+	}
+
+	if len(received) != len(indexes) {
+		return ErrInvalidIndex
+	}
+
+	for i, index := range indexes {
+		txs[index] = received[i]
+	}
+
+	return nil
+}
+
+// transactions returns the transactions with the given indexes of an announced block
+func (r *CompactBlockRelay) transactions(request TransactionRequest) ([]common.Transaction, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	blockTxs, ok := r.blocks[string(request.BlockHash)]
+	if !ok {
+		return nil, ErrUnknownBlock
+	}
+
+	txs := make([]common.Transaction, len(request.Indexes))
+	for i, index := range request.Indexes {
+
+		if index < 0 || index >= len(blockTxs) {
+			return nil, ErrInvalidIndex
+		}
+
+		txs[i] = blockTxs[index]
+	}
+
+	return txs, nil
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var ErrRequestTimeout = errors.New("request timed out")
+
+// connectionPool keeps connections to the nodes that data is requested from.
+// These nodes are not necessarily peers, a connection is opened at the first request
+type connectionPool struct {
+	mutex   sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func newConnectionPool() *connectionPool {
+	return &connectionPool{clients: make(map[string]*rpc.Client)}
+}
+
+// call calls the method on the node with the given address, and waits for the reply for at most timeout
+func (p *connectionPool) call(address string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+
+	client, err := p.client(address)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+	case <-time.After(timeout):
+		return ErrRequestTimeout
+	}
+
+	if call.Error == rpc.ErrShutdown {
+		p.close(address, client)
+	}
+
+	return call.Error
+}
+
+// client returns a connection to the node with the given address
+func (p *connectionPool) client(address string) (*rpc.Client, error) {
+
+	p.mutex.Lock()
+	client, ok := p.clients[address]
+	p.mutex.Unlock()
+
+	if ok {
+		return client, nil
+	}
+
+	client, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// another request may have connected in the meantime
+	if existing, ok := p.clients[address]; ok {
+		client.Close()
+		return existing, nil
+	}
+
+	p.clients[address] = client
+	return client, nil
+}
+
+func (p *connectionPool) close(address string, client *rpc.Client) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.clients[address] == client {
+		delete(p.clients, address)
+	}
+
+	client.Close()
+}
@@ -0,0 +1,344 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/wire"
+)
+
+const (
+	// responseQueueCapacity is the number of messages the reading goroutine of a connection queues for writing
+	responseQueueCapacity = 1024
+
+	// framedWriteTimeout is the time a message write can take. The connection of a peer that stops reading is closed after it
+	framedWriteTimeout = 30 * time.Second
+)
+
+// ErrNodeIDMismatch is returned when the handshake of an authenticated peer declares another node ID than the ID registered for its address
+var ErrNodeIDMismatch = errors.New("handshake node ID is not the registered node ID of the peer")
+
+// FramedProtocol sends blocks, transactions and tip announcements to the peers with the framed wire protocol instead of net/rpc.
+// Blocks requested by the consensus layer and the catch-up of lagging nodes still use net/rpc, which is served on the same port.
+// Both sides of a connection handle the messages of the other side, so a node can request the announced blocks on the connection it receives them
+type FramedProtocol struct {
+	nodeID     int
+	configHash []byte
+
+	demux *common.Demux
+
+	mutex sync.Mutex
+
+	// blockSync provides the local tip for the handshake, and serves the requested blocks. It is nil until block sync is enabled
+	blockSync *BlockSync
+
+	// peerIDs keeps the registered node ID of each node address. The handshakes of the peers authenticated by the transport are checked against it
+	peerIDs map[string]int
+}
+
+// NewFramedProtocol creates the framed protocol of a node. Peers with another config hash are rejected in the handshake
+func NewFramedProtocol(demux *common.Demux, nodeID int, configHash []byte) *FramedProtocol {
+
+	return &FramedProtocol{demux: demux, nodeID: nodeID, configHash: configHash}
+}
+
+// SetPeerIDs sets the registered node ID of each node address. The address is in host:port form.
+// It must be called before the transport authenticates peers, so their handshakes can be checked
+func (p *FramedProtocol) SetPeerIDs(idsByAddress map[string]int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.peerIDs = make(map[string]int, len(idsByAddress))
+	for address, id := range idsByAddress {
+		p.peerIDs[address] = id
+	}
+}
+
+func (p *FramedProtocol) setBlockSync(blockSync *BlockSync) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.blockSync = blockSync
+}
+
+func (p *FramedProtocol) getBlockSync() *BlockSync {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.blockSync
+}
+
+// handshake returns the local handshake with the current tip, and the port catch-up requests are served on
+func (p *FramedProtocol) handshake() wire.Handshake {
+
+	handshake := wire.Handshake{Version: wire.ProtocolVersion, NodeID: p.nodeID, ConfigHash: p.configHash}
+	if blockSync := p.getBlockSync(); blockSync != nil {
+		handshake.TipHeight, handshake.TipHashes = blockSync.tip()
+		handshake.PortNumber = blockSync.portNumber
+	}
+
+	return handshake
+}
+
+// dial opens a framed connection to the node with the given address, and handles the messages of the node in the background
+func (p *FramedProtocol) dial(address string) (*wire.Conn, error) {
+
+	conn, err := currentTransport().Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	wireConn, err := wire.Client(conn, p.handshake())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the transport authenticated the node registered for the address
+	if _, ok := currentTransport().(authenticatingTransport); ok {
+		if err := p.checkPeer(address, wireConn.Peer()); err != nil {
+			wireConn.Close()
+			return nil, err
+		}
+	}
+
+	wireConn.SetWriteTimeout(framedWriteTimeout)
+	go p.serve(wireConn, address)
+
+	return wireConn, nil
+}
+
+// accept starts a framed connection accepted by the P2P server, and handles its messages until it is closed.
+// The address is the registered address of the peer if the transport authenticates it, and the handshake must declare
+// the node ID registered for it. Otherwise, the peer serves catch-up requests on the port of its handshake at the address of the connection
+func (p *FramedProtocol) accept(conn net.Conn, reader *bufio.Reader, address string) {
+
+	wireConn, err := wire.Server(conn, reader, p.handshake())
+	if err != nil {
+		log.Printf("framed connection from %s is closed: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	wireConn.SetWriteTimeout(framedWriteTimeout)
+
+	if address != "" {
+		if err := p.checkPeer(address, wireConn.Peer()); err != nil {
+			log.Printf("framed connection from %s is closed: %s\n", conn.RemoteAddr(), err)
+			wireConn.WriteMessage(wire.Reject{Reason: err.Error()})
+			wireConn.Close()
+			return
+		}
+	} else if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && wireConn.Peer().PortNumber > 0 {
+		address = net.JoinHostPort(host, strconv.Itoa(wireConn.Peer().PortNumber))
+	}
+
+	p.serve(wireConn, address)
+}
+
+// checkPeer returns an error if the handshake of a peer authenticated for the address does not declare the node ID registered for it
+func (p *FramedProtocol) checkPeer(address string, peer wire.Handshake) error {
+
+	p.mutex.Lock()
+	id, ok := p.peerIDs[address]
+	p.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, address)
+	}
+
+	if peer.NodeID != id {
+		return fmt.Errorf("%w: node %d is registered for %s, the handshake declares node %d", ErrNodeIDMismatch, id, address, peer.NodeID)
+	}
+
+	return nil
+}
+
+// peerConn is a framed connection whose reading goroutine queues its writes. They are written by a dedicated goroutine,
+// so reading never blocks on writing, and peers requesting blocks from each other at the same time do not deadlock
+type peerConn struct {
+	*wire.Conn
+	responses chan wire.Message
+
+	// address is the address the peer serves catch-up requests on. It is empty if it is not known
+	address string
+}
+
+// send queues a message without blocking. The message is dropped if the queue is full
+func (c *peerConn) send(m wire.Message) {
+
+	select {
+	case c.responses <- m:
+	default:
+		log.Printf("response queue of node %d is full, dropping %s message\n", c.Peer().NodeID, m.Type())
+	}
+}
+
+// writeResponses writes the queued messages until the queue is closed. The connection is closed if a write fails
+func (c *peerConn) writeResponses() {
+
+	failed := false
+	for m := range c.responses {
+
+		if failed {
+			continue
+		}
+
+		if err := c.WriteMessage(m); err != nil {
+			log.Printf("could not send %s message to node %d: %s\n", m.Type(), c.Peer().NodeID, err)
+			c.Close()
+			failed = true
+		}
+	}
+}
+
+// serve handles the messages of a peer until the connection is closed. Messages of unknown types are skipped
+func (p *FramedProtocol) serve(wireConn *wire.Conn, address string) {
+
+	conn := &peerConn{Conn: wireConn, responses: make(chan wire.Message, responseQueueCapacity), address: address}
+	go conn.writeResponses()
+
+	defer close(conn.responses)
+	defer conn.Close()
+
+	// requested keeps the hashes of the blocks requested on the connection. They are enqueued as requested blocks,
+	// so the demux does not drop them for being older than the current round
+	requested := make(map[string]struct{})
+
+	// requests the tip of a peer that is ahead, its missing parents are requested by the consensus layer
+	peer := conn.Peer()
+	if height, _ := p.tip(); peer.TipHeight > height {
+		p.handleTip(conn, peer.TipHeight, peer.TipHashes, requested)
+	}
+
+	for {
+		m, err := conn.ReadMessage()
+		if errors.Is(err, wire.ErrUnknownMessageType) {
+			continue
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("framed connection of node %d is closed: %s\n", peer.NodeID, err)
+			}
+			return
+		}
+
+		if err := p.handle(conn, m, requested); err != nil {
+			log.Printf("framed connection of node %d is closed: %s\n", peer.NodeID, err)
+			return
+		}
+	}
+}
+
+func (p *FramedProtocol) handle(conn *peerConn, m wire.Message, requested map[string]struct{}) error {
+
+	switch m := m.(type) {
+
+	case wire.Block:
+		hash := string(m.Block.Hash())
+		if _, ok := requested[hash]; ok {
+			delete(requested, hash)
+			if blockSync := p.getBlockSync(); blockSync != nil {
+				blockSync.enqueue(m.Block)
+			}
+			return nil
+		}
+		p.demux.EnqueBlock(m.Block)
+
+	case wire.Transactions:
+		for _, tx := range m.Transactions {
+			p.demux.EnqueTransaction(tx)
+		}
+
+	case wire.Announce:
+		p.handleTip(conn, m.Height, m.Hashes, requested)
+
+	case wire.Request:
+		blockSync := p.getBlockSync()
+		if blockSync == nil {
+			return nil
+		}
+		for _, block := range blockSync.blocksByHash(BlockRequest{Hashes: m.Hashes}) {
+			conn.send(wire.Block{Block: block})
+		}
+
+	case wire.Ping:
+		conn.send(wire.Pong{Nonce: m.Nonce})
+
+	case wire.Pong:
+
+	case wire.Reject:
+		return errors.New(m.Reason)
+
+	case wire.Handshake:
+		return wire.ErrUnexpectedMessage
+	}
+
+	return nil
+}
+
+// handleTip requests the missing blocks of the tip of a peer on the connection. If the address of the peer is known,
+// the tip is handled by the block sync too, so a node that is far behind catches up by height ranges instead of parent by parent
+func (p *FramedProtocol) handleTip(conn *peerConn, height int, hashes [][]byte, requested map[string]struct{}) {
+
+	p.requestMissing(conn, hashes, requested)
+
+	blockSync := p.getBlockSync()
+	if blockSync == nil || conn.address == "" {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(conn.address)
+	if err != nil {
+		return
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+
+	blockSync.handleTip(TipAnnouncement{Height: height, BlockHashes: hashes, IPAddress: host, PortNumber: portNumber})
+}
+
+// requestMissing requests the blocks that are not stored yet
+func (p *FramedProtocol) requestMissing(conn *peerConn, hashes [][]byte, requested map[string]struct{}) {
+
+	blockSync := p.getBlockSync()
+	if blockSync == nil {
+		return
+	}
+
+	var missing [][]byte
+	for _, hash := range hashes {
+		if _, ok := requested[string(hash)]; !ok && !blockSync.store.Contains(hash) {
+			requested[string(hash)] = struct{}{}
+			missing = append(missing, hash)
+		}
+	}
+
+	if len(missing) > 0 {
+		conn.send(wire.Request{Hashes: missing})
+	}
+}
+
+func (p *FramedProtocol) tip() (int, [][]byte) {
+
+	if blockSync := p.getBlockSync(); blockSync != nil {
+		return blockSync.tip()
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,233 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
+	"github.com/korkmazkadir/bitcoin/wire"
+)
+
+// startFramedNode starts a P2P server accepting framed connections, and returns its demux, framed protocol, store and port
+func startFramedNode(t *testing.T, nodeID int, configHash []byte) (*common.Demux, *FramedProtocol, storage.BlockStore, int) {
+
+	t.Helper()
+
+	demux := common.NewDemultiplexer(1)
+	server := NewServer(demux)
+
+	framed := NewFramedProtocol(demux, nodeID, configHash)
+	server.SetFramedProtocol(framed)
+
+	store := storage.NewMemoryStore()
+	framed.setBlockSync(NewBlockSync(demux, nil, store, "127.0.0.1", 0))
+
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(rpcServer, conn)
+		}
+	}()
+
+	return demux, framed, store, listener.Addr().(*net.TCPAddr).Port
+}
+
+func receiveBlock(t *testing.T, demux *common.Demux) common.Block {
+
+	t.Helper()
+
+	select {
+	case block := <-demux.GetBlockChan():
+		return block
+	case <-time.After(time.Second):
+		t.Fatal("block is not received")
+		return common.Block{}
+	}
+}
+
+func TestFramedProtocol(t *testing.T) {
+
+	configHash := []byte("config")
+	receiverDemux, _, _, port := startFramedNode(t, 1, configHash)
+	_, senderFramed, senderStore, _ := startFramedNode(t, 2, configHash)
+
+	peerSet := PeerSet{}
+	peerSet.SetFramedProtocol(senderFramed)
+	if err := peerSet.AddPeer("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+
+	block := common.Block{Issuer: []byte("issuer"), PrevBlockHashes: [][]byte{[]byte("parent")}, Height: 1, Nonce: 1}
+	block.SetPayload(common.EncodeTransactions(nil))
+
+	peerSet.DissaminateBlock(block)
+	if received := receiveBlock(t, receiverDemux); !bytes.Equal(received.Hash(), block.Hash()) {
+		t.Errorf("received block is different from the sent block")
+	}
+
+	// an announced block is requested on the same connection, and served by the announcing node
+	announced := block
+	announced.Nonce = 2
+	if err := senderStore.Append(announced); err != nil {
+		t.Fatal(err)
+	}
+
+	peerSet.DisseminateTip(TipAnnouncement{Height: 1, BlockHashes: [][]byte{announced.Hash()}})
+	if received := receiveBlock(t, receiverDemux); !bytes.Equal(received.Hash(), announced.Hash()) {
+		t.Errorf("received block is not the announced block")
+	}
+}
+
+func TestFramedProtocolRejectsOtherConfig(t *testing.T) {
+
+	_, _, _, port := startFramedNode(t, 1, []byte("config"))
+	_, framed, _, _ := startFramedNode(t, 2, []byte("other config"))
+
+	peerSet := PeerSet{}
+	peerSet.SetFramedProtocol(framed)
+	if err := peerSet.AddPeer("127.0.0.1", port); err == nil {
+		t.Errorf("node with another config is connected")
+	}
+}
+
+func TestFramedProtocolConcurrentRequests(t *testing.T) {
+
+	configHash := []byte("config")
+
+	var demuxes [2]*common.Demux
+	var protocols [2]*FramedProtocol
+	var hashes [2][][]byte
+	for i := range protocols {
+
+		demuxes[i] = common.NewDemultiplexer(1)
+		protocols[i] = NewFramedProtocol(demuxes[i], i+1, configHash)
+
+		store := storage.NewMemoryStore()
+		protocols[i].setBlockSync(NewBlockSync(demuxes[i], nil, store, "127.0.0.1", 0))
+
+		// the blocks are larger than the socket buffers, so writing them blocks until the other node reads them
+		for nonce := 0; nonce < 16; nonce++ {
+			block := common.Block{Issuer: []byte{byte(i)}, Height: 1, Nonce: int64(nonce)}
+			block.SetPayload(bytes.Repeat([]byte{byte(nonce)}, 1<<20))
+			if err := store.Append(block); err != nil {
+				t.Fatal(err)
+			}
+			hashes[i] = append(hashes[i], block.Hash())
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *wire.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			accepted <- nil
+			return
+		}
+
+		wireConn, err := wire.Server(conn, bufio.NewReader(conn), protocols[1].handshake())
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- wireConn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, err := wire.Client(conn, protocols[0].handshake())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.FailNow()
+	}
+
+	// both nodes receive the request of the other node before they start reading
+	if err := clientConn.WriteMessage(wire.Request{Hashes: hashes[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serverConn.WriteMessage(wire.Request{Hashes: hashes[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	go protocols[0].serve(clientConn, "")
+	go protocols[1].serve(serverConn, "")
+
+	for i, demux := range demuxes {
+		for range hashes[1-i] {
+			if received := receiveBlock(t, demux); received.Issuer[0] != byte(1-i) {
+				t.Fatalf("node %d received its own block", i+1)
+			}
+		}
+	}
+}
+
+func TestFramedAnnounceCatchUp(t *testing.T) {
+
+	configHash := []byte("config")
+	_, receiverFramed, _, port := startFramedNode(t, 1, configHash)
+	receiverFramed.getBlockSync().delay = 10 * time.Millisecond
+
+	// the announcing node serves catch-up requests on the port of its handshake
+	server := &rangeServer{}
+	announcement := tipAnnouncement(t, 40, startSyncNode(t, server))
+
+	demux := common.NewDemultiplexer(1)
+	sender := NewFramedProtocol(demux, 2, configHash)
+	sender.setBlockSync(NewBlockSync(demux, nil, storage.NewMemoryStore(), "127.0.0.1", announcement.PortNumber))
+
+	conn, err := sender.dial(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(wire.Announce{Height: 40, Hashes: [][]byte{[]byte("tip")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.requestCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("announced tip does not start catching up by height")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if request := server.requests[0]; request.FromHeight != 1 {
+		t.Errorf("expected the heights from 1, got %d to %d", request.FromHeight, request.ToHeight)
+	}
+}
@@ -0,0 +1,281 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+const (
+	// payloadRequestTimeout is the time to wait for a payload from a single source
+	payloadRequestTimeout = 5 * time.Second
+
+	// payloadFetchTimeout is the time to wait for a source serving the payload of an announced header
+	payloadFetchTimeout = time.Minute
+
+	// payloadServeTimeout is the time a payload request waits for a payload that is still being fetched
+	payloadServeTimeout = 10 * time.Second
+)
+
+var (
+	ErrHeaderFirstDisabled = errors.New("header-first propagation is not enabled")
+	ErrUnknownBlock        = errors.New("block is not known")
+	ErrPayloadUnavailable  = errors.New("payload is not available")
+	ErrInvalidPayload      = errors.New("payload does not match the header")
+)
+
+// HeaderAnnouncement announces a block header. The payload of the block is served by the announcing node
+type HeaderAnnouncement struct {
+	Header     common.BlockHeader
+	IPAddress  string
+	PortNumber int
+}
+
+type payloadEntry struct {
+	header  common.BlockHeader
+	payload []byte
+
+	// available is closed when the payload is set
+	available chan struct{}
+
+	// sources keeps the addresses of the nodes that announced the header in order of arrival
+	sources   []string
+	newSource chan struct{}
+}
+
+// HeaderRelay implements header-first propagation.
+// A received header is validated, and forwarded to peers before its payload is fetched from the nodes that announced it.
+// Once the payload is fetched, the complete block is enqueued to the demux
+type HeaderRelay struct {
+	mutex sync.Mutex
+
+	demux   *common.Demux
+	peerSet *PeerSet
+
+	IPAddress  string
+	portNumber int
+
+	// entries keeps announced blocks by hash. Entries of finalized rounds are evicted
+	entries map[string]*payloadEntry
+
+	// rounds keeps the hashes of the entries by round
+	rounds *roundIndex
+
+	// connections keeps connections to the nodes payloads are fetched from
+	connections *connectionPool
+}
+
+// NewHeaderRelay creates a header relay for the node listening on the given address
+func NewHeaderRelay(demux *common.Demux, IPAddress string, portNumber int) *HeaderRelay {
+
+	return &HeaderRelay{
+		demux:       demux,
+		IPAddress:   IPAddress,
+		portNumber:  portNumber,
+		entries:     make(map[string]*payloadEntry),
+		rounds:      newRoundIndex(),
+		connections: newConnectionPool(),
+	}
+}
+
+// publish keeps the payload of a block to serve it, and returns its header announcement.
+// It returns false if the header is already announced
+func (r *HeaderRelay) publish(block common.Block) (HeaderAnnouncement, bool) {
+
+	finalizedRound := r.demux.FinalizedRound()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.evict(finalizedRound)
+
+	key := string(block.Hash())
+	if _, ok := r.entries[key]; ok {
+		return HeaderAnnouncement{}, false
+	}
+
+	entry := &payloadEntry{header: block.Header(), payload: block.Payload, available: make(chan struct{})}
+	close(entry.available)
+	r.entries[key] = entry
+	r.rounds.add(block.Height, key)
+
+	return r.announcement(block.Header()), true
+}
+
+// handleHeader validates and forwards a received header, and starts fetching its payload
+func (r *HeaderRelay) handleHeader(announcement HeaderAnnouncement) error {
+
+	header := announcement.Header
+	key := string(header.Hash())
+	source := fmt.Sprintf("%s:%d", announcement.IPAddress, announcement.PortNumber)
+
+	if r.addSource(key, source) {
+		return nil
+	}
+
+	err := r.demux.ValidateHeader(header)
+	if err == common.ErrAlreadyProcessed {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	finalizedRound := r.demux.FinalizedRound()
+
+	r.mutex.Lock()
+	r.evict(finalizedRound)
+
+	if _, ok := r.entries[key]; ok {
+		r.mutex.Unlock()
+		r.addSource(key, source)
+		return nil
+	}
+
+	entry := &payloadEntry{header: header, available: make(chan struct{}), sources: []string{source}, newSource: make(chan struct{}, 1)}
+	r.entries[key] = entry
+	r.rounds.add(header.Height, key)
+	r.mutex.Unlock()
+
+	// the header is forwarded before the payload is available
+	r.peerSet.DisseminateHeader(r.announcement(header))
+
+	go r.fetchPayload(key, entry)
+
+	return nil
+}
+
+// payload returns the payload of the block with the given hash.
+// If the payload is being fetched, it waits for it
+func (r *HeaderRelay) payload(hash []byte) ([]byte, error) {
+
+	r.mutex.Lock()
+	entry, ok := r.entries[string(hash)]
+	r.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrUnknownBlock
+	}
+
+	select {
+	case <-entry.available:
+	case <-time.After(payloadServeTimeout):
+		return nil, ErrPayloadUnavailable
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return entry.payload, nil
+}
+
+// addSource adds a source to the block if it is already announced. It returns false if the block is not known
+func (r *HeaderRelay) addSource(key string, source string) bool {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.entries[key]
+	if !ok {
+		return false
+	}
+
+	// the payload is already available or the entry is created by publish
+	if entry.newSource == nil {
+		return true
+	}
+
+	for _, s := range entry.sources {
+		if s == source {
+			return true
+		}
+	}
+
+	entry.sources = append(entry.sources, source)
+	select {
+	case entry.newSource <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// fetchPayload requests the payload from the sources in order of announcement until a valid payload is received.
+// The entry is removed if no source serves the payload before payloadFetchTimeout
+func (r *HeaderRelay) fetchPayload(key string, entry *payloadEntry) {
+
+	deadline := time.After(payloadFetchTimeout)
+	tried := 0
+
+	for {
+
+		r.mutex.Lock()
+		sources := entry.sources
+		r.mutex.Unlock()
+
+		for ; tried < len(sources); tried++ {
+
+			payload, err := r.requestPayload(sources[tried], entry.header)
+			if err != nil {
+				log.Printf("could not fetch the payload of %x from %s: %s\n", key, sources[tried], err)
+				continue
+			}
+
+			r.mutex.Lock()
+			entry.payload = payload
+			entry.newSource = nil
+			close(entry.available)
+			r.mutex.Unlock()
+
+			r.demux.EnqueBlock(entry.header.Block(payload))
+			return
+		}
+
+		select {
+		case <-entry.newSource:
+		case <-deadline:
+			log.Printf("could not fetch the payload of %x from %d sources\n", key, tried)
+			r.mutex.Lock()
+			// the entry may be evicted, and the header announced again in the meantime
+			if r.entries[key] == entry {
+				delete(r.entries, key)
+			}
+			r.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// requestPayload requests the payload of the block with the given header from a node, and checks it against the header
+func (r *HeaderRelay) requestPayload(address string, header common.BlockHeader) ([]byte, error) {
+
+	var payload []byte
+	err := r.connections.call(address, "P2PServer.GetPayload", header.Hash(), &payload, payloadRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if !header.Block(payload).HasValidPayload() {
+		return nil, ErrInvalidPayload
+	}
+
+	return payload, nil
+}
+
+// evict removes the entries of the rounds before the finalized round. The caller must hold the mutex
+func (r *HeaderRelay) evict(finalizedRound int) {
+
+	for _, key := range r.rounds.evict(finalizedRound) {
+		delete(r.entries, key)
+	}
+}
+
+func (r *HeaderRelay) announcement(header common.BlockHeader) HeaderAnnouncement {
+
+	return HeaderAnnouncement{Header: header, IPAddress: r.IPAddress, PortNumber: r.portNumber}
+}
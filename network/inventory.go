@@ -0,0 +1,203 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+const (
+	// blockRequestTimeout is the time to wait for a block from a single announcer
+	blockRequestTimeout = 5 * time.Second
+
+	// inventoryFetchTimeout is the time to wait for an announcer serving an announced block
+	inventoryFetchTimeout = time.Minute
+)
+
+var (
+	ErrInventoryDisabled = errors.New("inventory propagation is not enabled")
+	ErrBlockMismatch     = errors.New("received block does not match the announced hash")
+)
+
+// Inventory announces a block by its hash. The block is served by the announcing node
+type Inventory struct {
+	BlockHash []byte
+
+	// BlockSize is the size of the block payload in bytes
+	BlockSize int
+
+	IPAddress  string
+	PortNumber int
+}
+
+type blockRequest struct {
+	sources   []string
+	newSource chan struct{}
+}
+
+// InventoryRelay implements announce and request gossip. A node announces the hashes of the blocks it appends,
+// and requests an announced block only if it has not seen it, from one announcer at a time
+type InventoryRelay struct {
+	mutex sync.Mutex
+
+	demux      *common.Demux
+	statLogger *common.StatLogger
+
+	IPAddress  string
+	portNumber int
+
+	// blocks keeps the blocks announced by the node by hash. Blocks of finalized rounds are evicted
+	blocks map[string]common.Block
+
+	// rounds keeps the hashes of the announced blocks by round
+	rounds *roundIndex
+
+	// requests keeps the blocks being requested by hash
+	requests map[string]*blockRequest
+
+	// connections keeps connections to the nodes blocks are requested from
+	connections *connectionPool
+}
+
+// NewInventoryRelay creates an inventory relay for the node listening on the given address
+func NewInventoryRelay(demux *common.Demux, statLogger *common.StatLogger, IPAddress string, portNumber int) *InventoryRelay {
+
+	return &InventoryRelay{
+		demux:       demux,
+		statLogger:  statLogger,
+		IPAddress:   IPAddress,
+		portNumber:  portNumber,
+		blocks:      make(map[string]common.Block),
+		rounds:      newRoundIndex(),
+		requests:    make(map[string]*blockRequest),
+		connections: newConnectionPool(),
+	}
+}
+
+// publish keeps the block to serve it, and returns its inventory.
+// It returns false if the block is already announced. The blocks of finalized rounds are evicted
+func (r *InventoryRelay) publish(block common.Block) (Inventory, bool) {
+
+	finalizedRound := r.demux.FinalizedRound()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, key := range r.rounds.evict(finalizedRound) {
+		delete(r.blocks, key)
+	}
+
+	key := string(block.Hash())
+	if _, ok := r.blocks[key]; ok {
+		return Inventory{}, false
+	}
+
+	r.blocks[key] = block
+	r.rounds.add(block.Height, key)
+
+	return Inventory{BlockHash: block.Hash(), BlockSize: len(block.Payload), IPAddress: r.IPAddress, PortNumber: r.portNumber}, true
+}
+
+// handleInventory requests the announced block if it is not seen yet.
+// Otherwise the announcer is kept as a fallback, or the announcement is counted as a saved download
+func (r *InventoryRelay) handleInventory(inventory Inventory) {
+
+	key := string(inventory.BlockHash)
+	source := fmt.Sprintf("%s:%d", inventory.IPAddress, inventory.PortNumber)
+
+	processed := r.demux.IsProcessed(inventory.BlockHash)
+
+	r.mutex.Lock()
+
+	_, published := r.blocks[key]
+	request, requested := r.requests[key]
+
+	if published || requested || processed {
+
+		if requested {
+			request.sources = append(request.sources, source)
+			select {
+			case request.newSource <- struct{}{}:
+			default:
+			}
+		}
+
+		r.mutex.Unlock()
+
+		// a push based protocol would have downloaded the block again
+		r.statLogger.AddToCounter("INVENTORY_BYTES_SAVED", inventory.BlockSize)
+		return
+	}
+
+	request = &blockRequest{sources: []string{source}, newSource: make(chan struct{}, 1)}
+	r.requests[key] = request
+
+	r.mutex.Unlock()
+
+	go r.fetchBlock(key, inventory.BlockHash, request)
+}
+
+// block returns the announced block with the given hash
+func (r *InventoryRelay) block(hash []byte) (common.Block, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	block, ok := r.blocks[string(hash)]
+	if !ok {
+		return common.Block{}, ErrUnknownBlock
+	}
+
+	return block, nil
+}
+
+// fetchBlock requests the block from the announcers in order of announcement until the block is received.
+// The request is dropped if no announcer serves the block before inventoryFetchTimeout
+func (r *InventoryRelay) fetchBlock(key string, hash []byte, request *blockRequest) {
+
+	deadline := time.After(inventoryFetchTimeout)
+	tried := 0
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.requests, key)
+		r.mutex.Unlock()
+	}()
+
+	for {
+
+		r.mutex.Lock()
+		sources := request.sources
+		r.mutex.Unlock()
+
+		for ; tried < len(sources); tried++ {
+
+			var block common.Block
+			err := r.connections.call(sources[tried], "P2PServer.GetBlock", hash, &block, blockRequestTimeout)
+			if err == nil && !bytes.Equal(block.Hash(), hash) {
+				err = ErrBlockMismatch
+			}
+
+			if err != nil {
+				log.Printf("could not fetch the block %x from %s: %s\n", hash, sources[tried], err)
+				continue
+			}
+
+			r.statLogger.AddToCounter("INVENTORY_BYTES_DOWNLOADED", len(block.Payload))
+			r.demux.EnqueBlock(block)
+			return
+		}
+
+		select {
+		case <-request.newSource:
+		case <-deadline:
+			log.Printf("could not fetch the block %x from %d announcers\n", hash, tried)
+			return
+		}
+	}
+}
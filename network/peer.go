@@ -2,19 +2,74 @@ package network
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/erasure"
 )
 
 var ErrorNoCorrectPeerAvailable = errors.New("there are no correct peers available")
 
 type PeerSet struct {
 	peers []*P2PClient
+
+	// headerRelay is used to announce headers instead of sending blocks. It is nil if header-first propagation is not enabled
+	headerRelay *HeaderRelay
+
+	// inventoryRelay is used to announce block hashes instead of sending blocks. It is nil if inventory propagation is not enabled
+	inventoryRelay *InventoryRelay
+
+	// compactRelay is used to send compact blocks instead of blocks. It is nil if compact block propagation is not enabled
+	compactRelay *CompactBlockRelay
+
+	// blockChunkCount is the number of chunks a block is split into. Blocks are sent whole if it is less than 2
+	blockChunkCount int
+
+	// encoder encodes blocks into fragments. It is nil if erasure coded propagation is not enabled
+	encoder *erasure.Encoder
+
+	// sentBlocks keeps the hashes of the blocks whose chunks or fragments are already sent
+	sentBlocks *hashSet
+
+	// blockSync requests missing blocks from the peers. It is nil if block sync is not enabled
+	blockSync *BlockSync
+
+	// framed is used to send messages to the peers instead of net/rpc. It is nil if the framed protocol is not enabled
+	framed *FramedProtocol
+}
+
+// hashSet is a set of hashes safe for concurrent use
+type hashSet struct {
+	mutex  sync.Mutex
+	hashes map[string]struct{}
+}
+
+// add adds the hash to the set, and returns false if it is already in the set
+func (h *hashSet) add(hash []byte) bool {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.hashes[string(hash)]; ok {
+		return false
+	}
+
+	h.hashes[string(hash)] = struct{}{}
+	return true
 }
 
 func (p *PeerSet) AddPeer(IPAddress string, portNumber int) error {
 
-	client, err := NewClient(IPAddress, portNumber)
+	var client *P2PClient
+	var err error
+
+	if p.framed != nil {
+		client, err = newFramedClient(IPAddress, portNumber, p.framed)
+	} else {
+		client, err = NewClient(IPAddress, portNumber)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -27,8 +82,108 @@ func (p *PeerSet) AddPeer(IPAddress string, portNumber int) error {
 	return nil
 }
 
+// SetHeaderRelay enables header-first propagation. Received headers are forwarded to the peers of the set
+func (p *PeerSet) SetHeaderRelay(relay *HeaderRelay) {
+
+	p.headerRelay = relay
+	relay.peerSet = p
+}
+
+// SetInventoryRelay enables inventory propagation
+func (p *PeerSet) SetInventoryRelay(relay *InventoryRelay) {
+
+	p.inventoryRelay = relay
+}
+
+// SetCompactBlockRelay enables compact block propagation
+func (p *PeerSet) SetCompactBlockRelay(relay *CompactBlockRelay) {
+
+	p.compactRelay = relay
+}
+
+// SetFramedProtocol enables sending messages to the peers with the framed protocol. It must be called before the peers are added
+func (p *PeerSet) SetFramedProtocol(framed *FramedProtocol) {
+
+	p.framed = framed
+}
+
+// SetBlockSync enables requesting missing blocks from the peers of the set, and announcing the tip to them
+func (p *PeerSet) SetBlockSync(blockSync *BlockSync) {
+
+	p.blockSync = blockSync
+
+	if p.framed != nil {
+		p.framed.setBlockSync(blockSync)
+	}
+
+	blockSync.mutex.Lock()
+	blockSync.peerSet = p
+	blockSync.mutex.Unlock()
+}
+
+// SetBlockChunkCount enables chunked propagation. Blocks are split into the given number of chunks
+func (p *PeerSet) SetBlockChunkCount(chunkCount int) {
+
+	p.blockChunkCount = chunkCount
+	p.sentBlocks = &hashSet{hashes: make(map[string]struct{})}
+}
+
+// SetErasureCoding enables erasure coded propagation. Blocks are encoded into fragmentCount fragments,
+// and any dataFragmentCount fragments reconstruct a block
+func (p *PeerSet) SetErasureCoding(dataFragmentCount int, fragmentCount int) error {
+
+	encoder, err := erasure.NewEncoder(dataFragmentCount, fragmentCount)
+	if err != nil {
+		return err
+	}
+
+	p.encoder = encoder
+	p.sentBlocks = &hashSet{hashes: make(map[string]struct{})}
+
+	return nil
+}
+
 func (p *PeerSet) DissaminateBlock(block common.Block) {
 
+	if p.headerRelay != nil {
+		if announcement, ok := p.headerRelay.publish(block); ok {
+			p.DisseminateHeader(announcement)
+		}
+		return
+	}
+
+	if p.inventoryRelay != nil {
+		if inventory, ok := p.inventoryRelay.publish(block); ok {
+			p.DisseminateInventory(inventory)
+		}
+		return
+	}
+
+	if p.compactRelay != nil {
+		if compactBlock, ok := p.compactRelay.publish(block); ok {
+			p.DisseminateCompactBlock(compactBlock)
+		}
+		return
+	}
+
+	if p.encoder != nil {
+		// the fragments of a received block are already forwarded
+		if p.sentBlocks.add(block.Hash()) {
+			p.disseminateFragmentsOf(block)
+		}
+		return
+	}
+
+	if p.blockChunkCount > 1 {
+		// the chunks of a received block are already forwarded
+		if p.sentBlocks.add(block.Hash()) {
+			for _, chunk := range common.SplitBlock(block, p.blockChunkCount) {
+				p.DisseminateBlockChunk(chunk)
+			}
+		}
+		return
+	}
+
 	for i := 0; i < len(p.peers); i++ {
 		peer := p.peers[i]
 		peer.SendBlock(block)
@@ -38,3 +193,111 @@ func (p *PeerSet) DissaminateBlock(block common.Block) {
 		panic(ErrorNoCorrectPeerAvailable)
 	}
 }
+
+func (p *PeerSet) DisseminateTransaction(tx common.Transaction) {
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendTransaction(tx)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
+
+func (p *PeerSet) DisseminateHeader(announcement HeaderAnnouncement) {
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendHeader(announcement)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
+
+func (p *PeerSet) DisseminateBlockChunk(chunk common.BlockChunk) {
+
+	p.sentBlocks.add(chunk.BlockHash)
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendBlockChunk(chunk)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
+
+func (p *PeerSet) DisseminateBlockFragment(fragment common.BlockFragment) {
+
+	p.sentBlocks.add(fragment.BlockHash)
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendBlockFragment(fragment)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
+
+// disseminateFragmentsOf encodes the block, and sends each fragment to a single peer in turn.
+// Peers forward the fragments to each other, so the node uploads the fragments once instead of sending the block to every peer
+func (p *PeerSet) disseminateFragmentsOf(block common.Block) {
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+
+	for i, fragment := range common.EncodeBlockFragments(block, p.encoder) {
+		p.peers[i%len(p.peers)].SendBlockFragment(fragment)
+	}
+}
+
+func (p *PeerSet) DisseminateInventory(inventory Inventory) {
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendInventory(inventory)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
+
+func (p *PeerSet) DisseminateTip(announcement TipAnnouncement) {
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendTip(announcement)
+	}
+}
+
+// addresses returns the network addresses of the peers
+func (p *PeerSet) addresses() []string {
+
+	addresses := make([]string, len(p.peers))
+	for i, peer := range p.peers {
+		addresses[i] = fmt.Sprintf("%s:%d", peer.IPAddress, peer.portNumber)
+	}
+
+	return addresses
+}
+
+func (p *PeerSet) DisseminateCompactBlock(compactBlock CompactBlock) {
+
+	for i := 0; i < len(p.peers); i++ {
+		peer := p.peers[i]
+		peer.SendCompactBlock(compactBlock)
+	}
+
+	if len(p.peers) == 0 {
+		panic(ErrorNoCorrectPeerAvailable)
+	}
+}
@@ -0,0 +1,345 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func TestInventoryRelayEviction(t *testing.T) {
+
+	demux := common.NewDemultiplexer(1)
+	relay := NewInventoryRelay(demux, nil, "127.0.0.1", 0)
+
+	finalized := common.Block{Issuer: []byte("issuer"), Height: 1}
+	if _, ok := relay.publish(finalized); !ok {
+		t.Fatal("block is not published")
+	}
+
+	if _, err := relay.block(finalized.Hash()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blocks of finalized rounds are evicted when the next block is published
+	demux.UpdateRound(3, 2)
+
+	current := common.Block{Issuer: []byte("issuer"), Height: 3}
+	if _, ok := relay.publish(current); !ok {
+		t.Fatal("block is not published")
+	}
+
+	if _, err := relay.block(finalized.Hash()); err != ErrUnknownBlock {
+		t.Errorf("block of a finalized round is not evicted")
+	}
+
+	if _, err := relay.block(current.Hash()); err != nil {
+		t.Errorf("block of the current round is evicted: %s", err)
+	}
+}
+
+func TestHeaderRelayEviction(t *testing.T) {
+
+	demux := common.NewDemultiplexer(1)
+	relay := NewHeaderRelay(demux, "127.0.0.1", 0)
+
+	finalized := common.Block{Issuer: []byte("issuer"), Height: 1}
+	finalized.SetPayload([]byte("payload"))
+	if _, ok := relay.publish(finalized); !ok {
+		t.Fatal("block is not published")
+	}
+
+	// the payloads of finalized rounds are evicted when the next block is published
+	demux.UpdateRound(3, 2)
+
+	current := common.Block{Issuer: []byte("issuer"), Height: 3}
+	current.SetPayload([]byte("payload"))
+	if _, ok := relay.publish(current); !ok {
+		t.Fatal("block is not published")
+	}
+
+	if _, err := relay.payload(finalized.Hash()); err != ErrUnknownBlock {
+		t.Errorf("payload of a finalized round is not evicted")
+	}
+
+	if _, err := relay.payload(current.Hash()); err != nil {
+		t.Errorf("payload of the current round is evicted: %s", err)
+	}
+}
+
+func TestCompactBlockRelayEviction(t *testing.T) {
+
+	demux := common.NewDemultiplexer(1)
+	relay := NewCompactBlockRelay(demux, nil, "127.0.0.1", 0)
+
+	newBlock := func(height int) common.Block {
+		block := common.Block{Issuer: []byte("issuer"), Height: height}
+		block.SetPayload(common.EncodeTransactions([]common.Transaction{{}}))
+		return block
+	}
+
+	finalized := newBlock(1)
+	if _, ok := relay.publish(finalized); !ok {
+		t.Fatal("block is not published")
+	}
+
+	// the transactions of finalized rounds are evicted when the next block is published
+	demux.UpdateRound(3, 2)
+
+	current := newBlock(3)
+	if _, ok := relay.publish(current); !ok {
+		t.Fatal("block is not published")
+	}
+
+	if _, err := relay.transactions(TransactionRequest{BlockHash: finalized.Hash(), Indexes: []int{0}}); err != ErrUnknownBlock {
+		t.Errorf("transactions of a finalized round are not evicted")
+	}
+
+	if _, err := relay.transactions(TransactionRequest{BlockHash: current.Hash(), Indexes: []int{0}}); err != nil {
+		t.Errorf("transactions of the current round are evicted: %s", err)
+	}
+}
+
+// shortIDPool is a transaction pool indexed by short identifiers
+type shortIDPool map[uint64]common.Transaction
+
+func (p shortIDPool) TransactionByShortID(shortID uint64) (common.Transaction, bool) {
+	tx, ok := p[shortID]
+	return tx, ok
+}
+
+func compactTransactions(height int) []common.Transaction {
+
+	txs := []common.Transaction{{CoinbaseHeight: height, Outputs: []common.TxOutput{{Value: 50, PublicKey: []byte("miner")}}}}
+	for i := 0; i < 3; i++ {
+		txs = append(txs, common.Transaction{
+			Inputs:  []common.TxInput{{PrevOut: common.OutPoint{TxHash: []byte("prev"), Index: height*10 + i}, Signature: []byte("signature")}},
+			Outputs: []common.TxOutput{{Value: 10, PublicKey: []byte("key")}},
+		})
+	}
+
+	return txs
+}
+
+func TestCompactBlockRelayReconstruction(t *testing.T) {
+
+	// the sender serves the transactions of the blocks it announces
+	sender := NewCompactBlockRelay(common.NewDemultiplexer(1), nil, "127.0.0.1", 0)
+	senderServer := NewServer(common.NewDemultiplexer(1))
+	senderServer.SetCompactBlockRelay(sender)
+	senderAddress := tipAnnouncement(t, 0, startSyncNode(t, senderServer))
+
+	demux := common.NewDemultiplexer(1)
+	statLogger := common.NewStatLogger(1)
+	receiver := NewCompactBlockRelay(demux, statLogger, "127.0.0.1", 0)
+
+	tests := []struct {
+		name string
+
+		// pool returns the pool of the receiver from the transactions of the block
+		pool func(txs []common.Transaction) shortIDPool
+
+		// counter is the counter incremented by the reconstruction, and value is its expected value
+		counter string
+		value   int
+	}{
+		{
+			name: "all transactions are in the mempool",
+			pool: func(txs []common.Transaction) shortIDPool {
+				pool := shortIDPool{}
+				for _, tx := range txs[1:] {
+					pool[common.ShortTransactionID(tx.Hash())] = tx
+				}
+				return pool
+			},
+			counter: "COMPACT_BLOCK_MISSING_TRANSACTIONS",
+			value:   0,
+		},
+		{
+			name: "missing transactions are requested",
+			pool: func(txs []common.Transaction) shortIDPool {
+				return shortIDPool{common.ShortTransactionID(txs[1].Hash()): txs[1]}
+			},
+			counter: "COMPACT_BLOCK_MISSING_TRANSACTIONS",
+			value:   2,
+		},
+		{
+			name: "a payload root mismatch falls back to the full block",
+			pool: func(txs []common.Transaction) shortIDPool {
+				// a copy with other signatures has the same short identifier
+				resigned := txs[1]
+				resigned.Inputs = []common.TxInput{{PrevOut: txs[1].Inputs[0].PrevOut, Signature: []byte("other signature")}}
+				return shortIDPool{common.ShortTransactionID(resigned.Hash()): resigned}
+			},
+			counter: "COMPACT_BLOCK_FALLBACK",
+			value:   1,
+		},
+	}
+
+	for i, test := range tests {
+
+		txs := compactTransactions(i + 1)
+		block := common.Block{Issuer: []byte("issuer"), Height: 1, Nonce: int64(i)}
+		block.SetPayload(common.EncodeTransactions(txs))
+
+		compactBlock, ok := sender.publish(block)
+		if !ok {
+			t.Fatal("block is not published")
+		}
+		compactBlock.IPAddress, compactBlock.PortNumber = senderAddress.IPAddress, senderAddress.PortNumber
+
+		counters := statLogger.GetCounters()
+		receiver.SetTransactionPool(test.pool(txs))
+
+		if err := receiver.handleCompactBlock(compactBlock); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		select {
+		case received := <-demux.GetBlockChan():
+			if !bytes.Equal(received.Hash(), block.Hash()) || !bytes.Equal(received.Payload, block.Payload) {
+				t.Errorf("%s: reconstructed block is not the original block", test.name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: block is not reconstructed", test.name)
+		}
+
+		if value := statLogger.GetCounters()[test.counter] - counters[test.counter]; value != test.value {
+			t.Errorf("%s: expected %s to increase by %d, got %d", test.name, test.counter, test.value, value)
+		}
+	}
+}
+
+func TestCompactBlockRelayWithoutSender(t *testing.T) {
+
+	demux := common.NewDemultiplexer(1)
+	receiver := NewCompactBlockRelay(demux, common.NewStatLogger(1), "127.0.0.1", 0)
+
+	txs := compactTransactions(1)
+	block := common.Block{Issuer: []byte("issuer"), Height: 1}
+	block.SetPayload(common.EncodeTransactions(txs))
+
+	compactBlock, _ := NewCompactBlockRelay(common.NewDemultiplexer(1), nil, "127.0.0.1", 0).publish(block)
+	unreachable := tipAnnouncement(t, 0, unreachableAddress(t))
+	compactBlock.IPAddress, compactBlock.PortNumber = unreachable.IPAddress, unreachable.PortNumber
+
+	// the missing transactions can not be requested, so the block is not enqueued
+	receiver.SetTransactionPool(shortIDPool{common.ShortTransactionID(txs[1].Hash()): txs[1]})
+	if err := receiver.handleCompactBlock(compactBlock); err == nil {
+		t.Errorf("block with missing transactions is reconstructed without the sender")
+	}
+
+	select {
+	case <-demux.GetBlockChan():
+		t.Errorf("incomplete block is enqueued")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInventoryRelayFetch(t *testing.T) {
+
+	block := common.Block{Issuer: []byte("issuer"), Height: 1}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 100))
+
+	// the second announcer serves the block, the first one is not reachable
+	announcer := NewInventoryRelay(common.NewDemultiplexer(1), nil, "127.0.0.1", 0)
+	announcerServer := NewServer(common.NewDemultiplexer(1))
+	announcerServer.SetInventoryRelay(announcer)
+
+	inventory, ok := announcer.publish(block)
+	if !ok {
+		t.Fatal("block is not published")
+	}
+
+	announce := func(relay *InventoryRelay, address string) {
+		source := tipAnnouncement(t, 0, address)
+		inventory.IPAddress, inventory.PortNumber = source.IPAddress, source.PortNumber
+		relay.handleInventory(inventory)
+	}
+
+	demux := common.NewDemultiplexer(1)
+	statLogger := common.NewStatLogger(1)
+	receiver := NewInventoryRelay(demux, statLogger, "127.0.0.1", 0)
+
+	announce(receiver, unreachableAddress(t))
+	announce(receiver, startSyncNode(t, announcerServer))
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if !bytes.Equal(received.Hash(), block.Hash()) || !bytes.Equal(received.Payload, block.Payload) {
+			t.Errorf("received block is not the announced block")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("block is not fetched from the second announcer")
+	}
+
+	// the block is processed, so later announcements do not download it again
+	announce(receiver, unreachableAddress(t))
+
+	counters := statLogger.GetCounters()
+	if downloaded := counters["INVENTORY_BYTES_DOWNLOADED"]; downloaded != len(block.Payload) {
+		t.Errorf("expected %d downloaded bytes, got %d", len(block.Payload), downloaded)
+	}
+
+	if saved := counters["INVENTORY_BYTES_SAVED"]; saved != 2*len(block.Payload) {
+		t.Errorf("expected %d saved bytes, got %d", 2*len(block.Payload), saved)
+	}
+}
+
+func TestHeaderRelayFetch(t *testing.T) {
+
+	block := common.Block{Issuer: []byte("issuer"), Height: 1}
+	block.SetPayload(bytes.Repeat([]byte("payload"), 100))
+
+	// startPayloadNode starts a node serving the given payload for the header of the block
+	startPayloadNode := func(payload []byte) string {
+
+		served := block
+		served.Payload = payload
+
+		relay := NewHeaderRelay(common.NewDemultiplexer(1), "127.0.0.1", 0)
+		relay.publish(served)
+
+		server := NewServer(common.NewDemultiplexer(1))
+		server.SetHeaderRelay(relay)
+
+		return startSyncNode(t, server)
+	}
+
+	corrupted := append([]byte{}, block.Payload...)
+	corrupted[0]++
+
+	// the first source is not reachable, and the second one serves an invalid payload
+	sources := []string{unreachableAddress(t), startPayloadNode(corrupted), startPayloadNode(block.Payload)}
+
+	demux := common.NewDemultiplexer(1)
+	receiver := NewHeaderRelay(demux, "127.0.0.1", 0)
+	receiver.peerSet = &PeerSet{peers: []*P2PClient{newClient("127.0.0.1", 1)}}
+
+	for _, source := range sources {
+		address := tipAnnouncement(t, 0, source)
+		announcement := HeaderAnnouncement{Header: block.Header(), IPAddress: address.IPAddress, PortNumber: address.PortNumber}
+		if err := receiver.handleHeader(announcement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case received := <-demux.GetBlockChan():
+		if !bytes.Equal(received.Payload, block.Payload) {
+			t.Errorf("block with an invalid payload is enqueued")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payload is not fetched from the third source")
+	}
+
+	payload, err := receiver.payload(block.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, block.Payload) {
+		t.Errorf("fetched payload is not served")
+	}
+}
@@ -0,0 +1,35 @@
+package network
+
+// roundIndex keeps the keys of relay entries by round, so that the entries of finalized rounds can be evicted
+type roundIndex struct {
+	rounds map[int][]string
+
+	// evicted is the round before which all keys are evicted
+	evicted int
+}
+
+func newRoundIndex() *roundIndex {
+	return &roundIndex{rounds: make(map[int][]string)}
+}
+
+// add adds the key of an entry of the round. Keys of evicted rounds are kept with the earliest round that is not evicted
+func (i *roundIndex) add(round int, key string) {
+
+	if round < i.evicted {
+		round = i.evicted
+	}
+
+	i.rounds[round] = append(i.rounds[round], key)
+}
+
+// evict forgets the keys of the rounds before the finalized round, and returns them
+func (i *roundIndex) evict(finalizedRound int) []string {
+
+	var keys []string
+	for ; i.evicted < finalizedRound; i.evicted++ {
+		keys = append(keys, i.rounds[i.evicted]...)
+		delete(i.rounds, i.evicted)
+	}
+
+	return keys
+}
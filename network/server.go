@@ -1,11 +1,35 @@
 package network
 
 import (
+	"bufio"
+	"log"
+	"net"
+	"net/rpc"
+
 	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/wire"
 )
 
 type P2PServer struct {
 	demux *common.Demux
+
+	// headerRelay handles header announcements. It is nil if header-first propagation is not enabled
+	headerRelay *HeaderRelay
+
+	// inventoryRelay handles block announcements. It is nil if inventory propagation is not enabled
+	inventoryRelay *InventoryRelay
+
+	// compactRelay handles compact blocks. It is nil if compact block propagation is not enabled
+	compactRelay *CompactBlockRelay
+
+	// relayPeerSet is used to forward received block chunks and fragments. It is nil if they are not forwarded
+	relayPeerSet *PeerSet
+
+	// blockSync serves requested blocks, and handles tip announcements. It is nil if block sync is not enabled
+	blockSync *BlockSync
+
+	// framed handles framed protocol connections. They are closed if it is nil
+	framed *FramedProtocol
 }
 
 func NewServer(demux *common.Demux) *P2PServer {
@@ -13,9 +37,241 @@ func NewServer(demux *common.Demux) *P2PServer {
 	return server
 }
 
+// SetHeaderRelay enables header-first propagation. It must be called before peers start sending headers
+func (s *P2PServer) SetHeaderRelay(relay *HeaderRelay) {
+	s.headerRelay = relay
+}
+
+// SetInventoryRelay enables inventory propagation. It must be called before peers start sending announcements
+func (s *P2PServer) SetInventoryRelay(relay *InventoryRelay) {
+	s.inventoryRelay = relay
+}
+
+// SetCompactBlockRelay enables compact block propagation. It must be called before peers start sending compact blocks
+func (s *P2PServer) SetCompactBlockRelay(relay *CompactBlockRelay) {
+	s.compactRelay = relay
+}
+
+// SetBlockSync enables serving blocks to the nodes that are catching up
+func (s *P2PServer) SetBlockSync(blockSync *BlockSync) {
+	s.blockSync = blockSync
+}
+
+// SetFramedProtocol enables accepting framed protocol connections. It must be called before the server accepts connections
+func (s *P2PServer) SetFramedProtocol(framed *FramedProtocol) {
+	s.framed = framed
+}
+
+// ServeConn serves a connection accepted by the listener of the node, using the transport of the node.
+// Framed protocol connections are recognized by their magic, and other connections are served by the RPC server.
+// If the transport authenticates the node, the connection is bound to its registered address
+func (s *P2PServer) ServeConn(rpcServer *rpc.Server, conn net.Conn) {
+
+	transport := currentTransport()
+	conn = transport.Server(conn)
+	reader := bufio.NewReader(conn)
+
+	// the node is authenticated before the first message of either protocol is read
+	address := ""
+	authenticating, authenticated := transport.(authenticatingTransport)
+	if authenticated {
+
+		var err error
+		address, err = authenticating.PeerAddress(conn)
+		if err != nil {
+			log.Printf("could not authenticate the connection from %s: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	if wire.IsFramed(reader) {
+
+		if s.framed == nil {
+			log.Printf("framed protocol is not enabled, closing the connection from %s\n", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+
+		s.framed.accept(conn, reader, address)
+		return
+	}
+
+	if authenticated {
+
+		codec, err := newBoundServerCodec(bufferedConn{Conn: conn, reader: reader}, address)
+		if err != nil {
+			log.Printf("registered address %s of the connection from %s is not valid: %s\n", address, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		rpcServer.ServeCodec(codec)
+		return
+	}
+
+	rpcServer.ServeConn(bufferedConn{Conn: conn, reader: reader})
+}
+
+// SetTransactionPool sets the pool compact blocks are reconstructed from
+func (s *P2PServer) SetTransactionPool(pool TransactionPool) {
+
+	if s.compactRelay != nil {
+		s.compactRelay.SetTransactionPool(pool)
+	}
+}
+
+// SetRelayPeerSet enables forwarding received block chunks and fragments to the given peers.
+// It must be called before peers start sending chunks or fragments
+func (s *P2PServer) SetRelayPeerSet(peerSet *PeerSet) {
+	s.relayPeerSet = peerSet
+}
+
 func (s *P2PServer) HandleBlock(block *common.Block, reply *int) error {
 
 	s.demux.EnqueBlock(*block)
 
 	return nil
 }
+
+func (s *P2PServer) HandleBlockChunk(chunk *common.BlockChunk, reply *int) error {
+
+	// chunks are forwarded independently before the block is reassembled
+	if s.demux.EnqueBlockChunk(*chunk) && s.relayPeerSet != nil {
+		s.relayPeerSet.DisseminateBlockChunk(*chunk)
+	}
+
+	return nil
+}
+
+func (s *P2PServer) HandleBlockFragment(fragment *common.BlockFragment, reply *int) error {
+
+	// fragments are forwarded independently before the block is reconstructed
+	if s.demux.EnqueBlockFragment(*fragment) && s.relayPeerSet != nil {
+		s.relayPeerSet.DisseminateBlockFragment(*fragment)
+	}
+
+	return nil
+}
+
+func (s *P2PServer) HandleTransaction(tx *common.Transaction, reply *int) error {
+
+	s.demux.EnqueTransaction(*tx)
+
+	return nil
+}
+
+func (s *P2PServer) HandleHeader(announcement *HeaderAnnouncement, reply *int) error {
+
+	if s.headerRelay == nil {
+		return ErrHeaderFirstDisabled
+	}
+
+	return s.headerRelay.handleHeader(*announcement)
+}
+
+// GetPayload returns the payload of the block with the given hash
+func (s *P2PServer) GetPayload(hash []byte, reply *[]byte) error {
+
+	if s.headerRelay == nil {
+		return ErrHeaderFirstDisabled
+	}
+
+	payload, err := s.headerRelay.payload(hash)
+	if err != nil {
+		return err
+	}
+
+	*reply = payload
+
+	return nil
+}
+
+func (s *P2PServer) HandleInventory(inventory *Inventory, reply *int) error {
+
+	if s.inventoryRelay == nil {
+		return ErrInventoryDisabled
+	}
+
+	s.inventoryRelay.handleInventory(*inventory)
+
+	return nil
+}
+
+// GetBlock returns the announced block with the given hash
+func (s *P2PServer) GetBlock(hash []byte, reply *common.Block) error {
+
+	if s.inventoryRelay == nil {
+		return ErrInventoryDisabled
+	}
+
+	block, err := s.inventoryRelay.block(hash)
+	if err != nil {
+		return err
+	}
+
+	*reply = block
+
+	return nil
+}
+
+func (s *P2PServer) HandleCompactBlock(compactBlock *CompactBlock, reply *int) error {
+
+	if s.compactRelay == nil {
+		return ErrCompactBlockDisabled
+	}
+
+	return s.compactRelay.handleCompactBlock(*compactBlock)
+}
+
+// GetBlockTransactions returns the requested transactions of an announced compact block
+func (s *P2PServer) GetBlockTransactions(request *TransactionRequest, reply *[]common.Transaction) error {
+
+	if s.compactRelay == nil {
+		return ErrCompactBlockDisabled
+	}
+
+	txs, err := s.compactRelay.transactions(*request)
+	if err != nil {
+		return err
+	}
+
+	*reply = txs
+
+	return nil
+}
+
+func (s *P2PServer) HandleTip(announcement *TipAnnouncement, reply *int) error {
+
+	if s.blockSync == nil {
+		return ErrSyncDisabled
+	}
+
+	s.blockSync.handleTip(*announcement)
+
+	return nil
+}
+
+// GetBlocksByHash returns the requested blocks that are available
+func (s *P2PServer) GetBlocksByHash(request *BlockRequest, reply *[]common.Block) error {
+
+	if s.blockSync == nil {
+		return ErrSyncDisabled
+	}
+
+	*reply = s.blockSync.blocksByHash(*request)
+
+	return nil
+}
+
+// GetBlocksByHeight returns the blocks of the requested heights, including the blocks of competing branches
+func (s *P2PServer) GetBlocksByHeight(request *HeightRangeRequest, reply *[]common.Block) error {
+
+	if s.blockSync == nil {
+		return ErrSyncDisabled
+	}
+
+	*reply = s.blockSync.blocksByHeight(*request)
+
+	return nil
+}
@@ -0,0 +1,398 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
+)
+
+const (
+	// syncRequestTimeout is the time to wait for the blocks requested from a single node
+	syncRequestTimeout = 5 * time.Second
+
+	// syncDelay is the time to wait after a higher tip is announced before requesting blocks.
+	// Blocks of the announced tip are usually received by gossip in the meantime
+	syncDelay = 2 * time.Second
+
+	// syncRetryInterval is the time before a block requested by hash is requested again
+	syncRetryInterval = 10 * time.Second
+
+	// maxSyncHeights is the number of heights whose blocks are requested or served at once
+	maxSyncHeights = 16
+
+	// maxSyncHashes is the number of blocks requested or served by hash at once
+	maxSyncHashes = 64
+
+	// maxSyncFailures is the number of consecutive failed height requests before the node of the best tip is given up
+	maxSyncFailures = 3
+)
+
+var ErrSyncDisabled = errors.New("block sync is not enabled")
+
+// TipAnnouncement advertises the height of the canonical tip of a node. Blocks are requested from the announcing node
+type TipAnnouncement struct {
+	Height int
+
+	// BlockHashes are the hashes of the microblocks of the tip macroblock
+	BlockHashes [][]byte
+
+	IPAddress  string
+	PortNumber int
+}
+
+// BlockRequest requests blocks by hash
+type BlockRequest struct {
+	Hashes [][]byte
+}
+
+// HeightRangeRequest requests all blocks of the heights from FromHeight to ToHeight, including the blocks of competing branches
+type HeightRangeRequest struct {
+	FromHeight int
+	ToHeight   int
+}
+
+// BlockSync requests the blocks a node is missing. The missing parents of received blocks are requested by hash from the peers,
+// and when a node announces a higher tip, the blocks after the local tip are requested by height from that node.
+// Requested blocks are served from the block store
+type BlockSync struct {
+	mutex sync.Mutex
+
+	demux      *common.Demux
+	statLogger *common.StatLogger
+	store      storage.BlockStore
+
+	IPAddress  string
+	portNumber int
+
+	peerSet *PeerSet
+
+	// localHeight is the height of the local canonical tip, and localHashes are the hashes of its microblocks
+	localHeight int
+	localHashes [][]byte
+
+	// bestTip is the highest tip announced by another node
+	bestTip TipAnnouncement
+
+	// tipSources are the addresses of the nodes that announced the height of the best tip. Blocks are requested from the first one,
+	// and a source is removed after maxSyncFailures consecutive failed requests
+	tipSources []string
+
+	// failedRequests is the number of consecutive failed requests to the first tip source
+	failedRequests int
+
+	// catchingUp is true while blocks are requested from the nodes of the best tip
+	catchingUp bool
+
+	// delay is the time to wait before each height request. It is syncDelay except in tests
+	delay time.Duration
+
+	// lastRange is the last requested height range, and lastRangeTime is the time it is requested. The received blocks wait in the demux queue
+	// until their round starts, so the same range is not requested again until the local tip moves, or syncRetryInterval passes
+	lastRange     HeightRangeRequest
+	lastRangeTime time.Time
+
+	// requested keeps the time blocks are requested by hash
+	requested map[string]time.Time
+
+	// connections keeps connections to the nodes blocks are requested from
+	connections *connectionPool
+}
+
+// NewBlockSync creates a block sync serving the blocks of the store for the node listening on the given address
+func NewBlockSync(demux *common.Demux, statLogger *common.StatLogger, store storage.BlockStore, IPAddress string, portNumber int) *BlockSync {
+
+	return &BlockSync{
+		demux:       demux,
+		statLogger:  statLogger,
+		store:       store,
+		IPAddress:   IPAddress,
+		portNumber:  portNumber,
+		delay:       syncDelay,
+		requested:   make(map[string]time.Time),
+		connections: newConnectionPool(),
+	}
+}
+
+// AnnounceTip sets the height and the microblock hashes of the local canonical tip, and announces it to the peers
+func (s *BlockSync) AnnounceTip(height int, blockHashes [][]byte) {
+
+	s.mutex.Lock()
+	s.localHeight = height
+	s.localHashes = blockHashes
+	peerSet := s.peerSet
+	s.mutex.Unlock()
+
+	if peerSet != nil {
+		peerSet.DisseminateTip(TipAnnouncement{Height: height, BlockHashes: blockHashes, IPAddress: s.IPAddress, PortNumber: s.portNumber})
+	}
+}
+
+// tip returns the height and the microblock hashes of the local canonical tip
+func (s *BlockSync) tip() (int, [][]byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.localHeight, s.localHashes
+}
+
+// RequestBlocks requests the blocks with the given hashes from the peers in the background.
+// Blocks that are stored, or requested recently are not requested
+func (s *BlockSync) RequestBlocks(hashes [][]byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for hash, requestTime := range s.requested {
+		if now.Sub(requestTime) > syncRetryInterval {
+			delete(s.requested, hash)
+		}
+	}
+
+	var missing [][]byte
+	for _, hash := range hashes {
+
+		if _, ok := s.requested[string(hash)]; ok || s.store.Contains(hash) {
+			continue
+		}
+
+		s.requested[string(hash)] = now
+		missing = append(missing, hash)
+	}
+
+	if len(missing) == 0 || s.peerSet == nil {
+		return
+	}
+
+	log.Printf("requesting %d missing blocks\n", len(missing))
+	go s.fetchByHash(missing, s.peerSet.addresses())
+}
+
+// handleTip starts catching up if the announced tip is higher than the local tip.
+// Nodes announcing the height of the best tip are kept as sources to catch up from
+func (s *BlockSync) handleTip(announcement TipAnnouncement) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if announcement.Height <= s.localHeight || announcement.Height < s.bestTip.Height {
+		return
+	}
+
+	address := fmt.Sprintf("%s:%d", announcement.IPAddress, announcement.PortNumber)
+
+	if announcement.Height > s.bestTip.Height {
+		s.bestTip = announcement
+		s.tipSources = []string{address}
+		s.failedRequests = 0
+	} else if !containsAddress(s.tipSources, address) {
+		s.tipSources = append(s.tipSources, address)
+	}
+
+	if !s.catchingUp {
+		s.catchingUp = true
+		go s.catchUp()
+	}
+}
+
+// catchUp requests the blocks after the local tip from the nodes of the best tip until the local tip reaches it.
+// It stops when all nodes of the best tip fail, and the best tip is forgotten so that any later announcement restarts it
+func (s *BlockSync) catchUp() {
+
+	for {
+		time.Sleep(s.delay)
+
+		s.mutex.Lock()
+		if s.bestTip.Height <= s.localHeight || len(s.tipSources) == 0 {
+			if s.bestTip.Height > s.localHeight {
+				log.Printf("giving up catching up to the tip %d, none of the announcing nodes serves its blocks\n", s.bestTip.Height)
+			}
+
+			s.bestTip = TipAnnouncement{}
+			s.tipSources = nil
+			s.failedRequests = 0
+			s.lastRange = HeightRangeRequest{}
+			s.catchingUp = false
+			s.mutex.Unlock()
+			return
+		}
+
+		request := HeightRangeRequest{FromHeight: s.localHeight + 1, ToHeight: s.bestTip.Height}
+		if request.ToHeight-request.FromHeight >= maxSyncHeights {
+			request.ToHeight = request.FromHeight + maxSyncHeights - 1
+		}
+
+		if request == s.lastRange && time.Since(s.lastRangeTime) < syncRetryInterval {
+			// the blocks of the range are received, and the local tip did not move yet
+			s.mutex.Unlock()
+			continue
+		}
+
+		s.lastRange = request
+		s.lastRangeTime = time.Now()
+		address := s.tipSources[0]
+		s.mutex.Unlock()
+
+		log.Printf("local tip is %d, requesting the blocks of heights %d to %d from %s\n", request.FromHeight-1, request.FromHeight, request.ToHeight, address)
+
+		var blocks []common.Block
+		err := s.connections.call(address, "P2PServer.GetBlocksByHeight", request, &blocks, syncRequestTimeout)
+		if err == nil && len(blocks) == 0 {
+			err = errors.New("no blocks are served")
+		}
+
+		if err != nil {
+			log.Printf("could not receive the blocks of heights %d to %d from %s: %s\n", request.FromHeight, request.ToHeight, address, err)
+			s.requestFailed(address)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.failedRequests = 0
+		s.mutex.Unlock()
+
+		for _, block := range blocks {
+			if block.Height >= request.FromHeight && block.Height <= request.ToHeight {
+				s.enqueue(block)
+			}
+		}
+	}
+}
+
+// requestFailed counts a failed request to a tip source, and removes the source after maxSyncFailures consecutive failures.
+// The failed range is requested again at the next attempt
+func (s *BlockSync) requestFailed(address string) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastRange = HeightRangeRequest{}
+
+	// the sources may have changed while the request was waiting
+	if len(s.tipSources) == 0 || s.tipSources[0] != address {
+		return
+	}
+
+	s.failedRequests++
+	if s.failedRequests < maxSyncFailures {
+		return
+	}
+
+	log.Printf("%s failed %d requests, removing it from the sources of the tip %d\n", address, s.failedRequests, s.bestTip.Height)
+	s.tipSources = s.tipSources[1:]
+	s.failedRequests = 0
+}
+
+func containsAddress(addresses []string, address string) bool {
+
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchByHash requests the blocks from the given nodes in random order until all of them are received
+func (s *BlockSync) fetchByHash(hashes [][]byte, addresses []string) {
+
+	s.addToCounter("SYNC_REQUESTED_BLOCKS", len(hashes))
+
+	rand.Shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+
+	for _, address := range addresses {
+
+		var blocks []common.Block
+		err := s.connections.call(address, "P2PServer.GetBlocksByHash", BlockRequest{Hashes: hashes}, &blocks, syncRequestTimeout)
+		if err != nil {
+			log.Printf("could not receive the requested blocks from %s: %s\n", address, err)
+			continue
+		}
+
+		var missing [][]byte
+		for _, hash := range hashes {
+
+			received := false
+			for _, block := range blocks {
+				if bytes.Equal(block.Hash(), hash) {
+					s.enqueue(block)
+					received = true
+					break
+				}
+			}
+
+			if !received {
+				missing = append(missing, hash)
+			}
+		}
+
+		if len(missing) == 0 {
+			return
+		}
+
+		hashes = missing
+	}
+
+	log.Printf("%d requested blocks are not available on the peers\n", len(hashes))
+}
+
+// enqueue enqueues a received block if it is not stored yet
+func (s *BlockSync) enqueue(block common.Block) {
+
+	if s.store.Contains(block.Hash()) {
+		return
+	}
+
+	s.addToCounter("SYNC_RECEIVED_BLOCKS", 1)
+	s.demux.EnqueRequestedBlock(block)
+}
+
+// blocksByHash returns the stored blocks with the requested hashes
+func (s *BlockSync) blocksByHash(request BlockRequest) []common.Block {
+
+	hashes := request.Hashes
+	if len(hashes) > maxSyncHashes {
+		hashes = hashes[:maxSyncHashes]
+	}
+
+	var blocks []common.Block
+	for _, hash := range hashes {
+		if block, ok := s.store.Get(hash); ok {
+			blocks = append(blocks, block)
+		}
+	}
+
+	return blocks
+}
+
+// blocksByHeight returns the stored blocks of the requested heights in height order. At most maxSyncHeights heights are served
+func (s *BlockSync) blocksByHeight(request HeightRangeRequest) []common.Block {
+
+	toHeight := request.ToHeight
+	if toHeight-request.FromHeight >= maxSyncHeights {
+		toHeight = request.FromHeight + maxSyncHeights - 1
+	}
+
+	var blocks []common.Block
+	for height := request.FromHeight; height <= toHeight; height++ {
+		blocks = append(blocks, s.store.AtHeight(height)...)
+	}
+
+	return blocks
+}
+
+func (s *BlockSync) addToCounter(name string, value int) {
+
+	if s.statLogger != nil {
+		s.statLogger.AddToCounter(name, value)
+	}
+}
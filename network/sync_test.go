@@ -0,0 +1,307 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
+)
+
+// rangeServer serves blocks by height, and records the height requests
+type rangeServer struct {
+	mutex    sync.Mutex
+	blocks   []common.Block
+	requests []HeightRangeRequest
+}
+
+func (r *rangeServer) GetBlocksByHeight(request *HeightRangeRequest, reply *[]common.Block) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests = append(r.requests, *request)
+	for _, block := range r.blocks {
+		if block.Height >= request.FromHeight && block.Height <= request.ToHeight {
+			*reply = append(*reply, block)
+		}
+	}
+
+	return nil
+}
+
+func (r *rangeServer) requestCount() int {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.requests)
+}
+
+// startSyncNode serves the given receiver as the P2P server of a node, and returns its address
+func startSyncNode(t *testing.T, receiver interface{}) string {
+
+	t.Helper()
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("P2PServer", receiver); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpcServer.ServeConn(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startStoreNode starts a node serving the blocks of a store, and returns its address
+func startStoreNode(t *testing.T, blocks ...common.Block) string {
+
+	t.Helper()
+
+	store := storage.NewMemoryStore()
+	for _, block := range blocks {
+		store.Append(block)
+	}
+
+	demux := common.NewDemultiplexer(0)
+	server := NewServer(demux)
+	server.SetBlockSync(NewBlockSync(demux, nil, store, "127.0.0.1", 0))
+
+	return startSyncNode(t, server)
+}
+
+// unreachableAddress returns the address of a closed listener
+func unreachableAddress(t *testing.T) string {
+
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	return address
+}
+
+func tipAnnouncement(t *testing.T, height int, address string) TipAnnouncement {
+
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return TipAnnouncement{Height: height, IPAddress: host, PortNumber: portNumber}
+}
+
+func syncBlock(height int, nonce int64) common.Block {
+	return common.Block{Issuer: []byte("issuer"), Height: height, Nonce: nonce}
+}
+
+// syncSources returns the tip sources of the block sync
+func syncSources(blockSync *BlockSync) string {
+
+	blockSync.mutex.Lock()
+	defer blockSync.mutex.Unlock()
+
+	return fmt.Sprint(blockSync.tipSources)
+}
+
+func TestBlockSyncRequestFailed(t *testing.T) {
+
+	blockSync := NewBlockSync(common.NewDemultiplexer(0), nil, storage.NewMemoryStore(), "127.0.0.1", 0)
+	blockSync.delay = time.Hour
+
+	first, second := "127.0.0.1:1", "127.0.0.1:2"
+	blockSync.handleTip(tipAnnouncement(t, 5, first))
+	blockSync.handleTip(tipAnnouncement(t, 5, second))
+	blockSync.handleTip(tipAnnouncement(t, 4, "127.0.0.1:3"))
+
+	if sources := syncSources(blockSync); sources != fmt.Sprint([]string{first, second}) {
+		t.Fatalf("expected the nodes of the best tip as sources, got %s", sources)
+	}
+
+	// failures of a node that is not the current source are not counted
+	for i := 0; i < maxSyncFailures; i++ {
+		blockSync.requestFailed(second)
+	}
+
+	for i := 0; i < maxSyncFailures-1; i++ {
+		blockSync.requestFailed(first)
+	}
+
+	if sources := syncSources(blockSync); sources != fmt.Sprint([]string{first, second}) {
+		t.Fatalf("source is removed before %d failures, got %s", maxSyncFailures, sources)
+	}
+
+	blockSync.requestFailed(first)
+
+	if sources := syncSources(blockSync); sources != fmt.Sprint([]string{second}) {
+		t.Errorf("expected the next node as the source, got %s", sources)
+	}
+
+	// a higher tip replaces the sources
+	blockSync.handleTip(tipAnnouncement(t, 6, first))
+
+	if sources := syncSources(blockSync); sources != fmt.Sprint([]string{first}) {
+		t.Errorf("sources of a higher tip are not reset, got %s", sources)
+	}
+}
+
+func TestBlockSyncGiveUp(t *testing.T) {
+
+	blockSync := NewBlockSync(common.NewDemultiplexer(0), nil, storage.NewMemoryStore(), "127.0.0.1", 0)
+	blockSync.delay = time.Millisecond
+
+	blockSync.handleTip(tipAnnouncement(t, 5, unreachableAddress(t)))
+	blockSync.handleTip(tipAnnouncement(t, 5, unreachableAddress(t)))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		blockSync.mutex.Lock()
+		catchingUp, bestTip, sources := blockSync.catchingUp, blockSync.bestTip, blockSync.tipSources
+		blockSync.mutex.Unlock()
+
+		if !catchingUp {
+			if bestTip.Height != 0 || sources != nil {
+				t.Errorf("best tip is not forgotten after all sources failed")
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("catch up does not stop after all sources failed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a later announcement restarts catching up
+	blockSync.handleTip(tipAnnouncement(t, 5, unreachableAddress(t)))
+
+	blockSync.mutex.Lock()
+	defer blockSync.mutex.Unlock()
+
+	if !blockSync.catchingUp {
+		t.Errorf("catch up is not restarted by a new announcement")
+	}
+}
+
+func TestBlockSyncCatchUp(t *testing.T) {
+
+	server := &rangeServer{blocks: []common.Block{syncBlock(1, 1), syncBlock(2, 2), syncBlock(3, 3)}}
+	address := startSyncNode(t, server)
+
+	// the received blocks wait in the demux queue, since their rounds do not start
+	demux := common.NewDemultiplexer(0)
+	blockSync := NewBlockSync(demux, nil, storage.NewMemoryStore(), "127.0.0.1", 0)
+	blockSync.delay = 10 * time.Millisecond
+
+	blockSync.handleTip(tipAnnouncement(t, 40, address))
+	time.Sleep(200 * time.Millisecond)
+
+	// the range is not requested again until the local tip moves
+	if count := server.requestCount(); count != 1 {
+		t.Fatalf("expected 1 request, got %d", count)
+	}
+
+	server.mutex.Lock()
+	if request := server.requests[0]; request.FromHeight != 1 || request.ToHeight != maxSyncHeights {
+		t.Errorf("expected the heights 1 to %d, got %d to %d", maxSyncHeights, request.FromHeight, request.ToHeight)
+	}
+	server.mutex.Unlock()
+
+	if depth := demux.QueueDepth(); depth != 3 {
+		t.Errorf("expected 3 queued blocks, got %d", depth)
+	}
+
+	blockSync.AnnounceTip(2, nil)
+	time.Sleep(200 * time.Millisecond)
+
+	if count := server.requestCount(); count != 2 {
+		t.Fatalf("expected a request after the local tip moved, got %d requests", count)
+	}
+
+	// the blocks waiting in the queue are not enqueued again
+	if depth := demux.QueueDepth(); depth != 3 {
+		t.Errorf("expected 3 queued blocks, got %d", depth)
+	}
+}
+
+func TestBlockSyncFetchByHash(t *testing.T) {
+
+	first, second := syncBlock(1, 1), syncBlock(2, 2)
+
+	// each node serves one of the blocks, and one node is not reachable
+	addresses := []string{startStoreNode(t, first), unreachableAddress(t), startStoreNode(t, second)}
+
+	demux := common.NewDemultiplexer(2)
+	blockSync := NewBlockSync(demux, nil, storage.NewMemoryStore(), "127.0.0.1", 0)
+
+	blockSync.fetchByHash([][]byte{first.Hash(), second.Hash()}, addresses)
+
+	received := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		received[receiveBlock(t, demux).Height] = true
+	}
+
+	if !received[1] || !received[2] {
+		t.Errorf("expected the blocks of both nodes, got the blocks of heights %v", received)
+	}
+}
+
+func TestBlockSyncLimits(t *testing.T) {
+
+	store := storage.NewMemoryStore()
+	var hashes [][]byte
+	for i := 0; i < 2*maxSyncHashes; i++ {
+		block := syncBlock(1+i%(2*maxSyncHeights), int64(i))
+		store.Append(block)
+		hashes = append(hashes, block.Hash())
+	}
+
+	blockSync := NewBlockSync(common.NewDemultiplexer(0), nil, store, "127.0.0.1", 0)
+
+	if blocks := blockSync.blocksByHash(BlockRequest{Hashes: hashes}); len(blocks) != maxSyncHashes {
+		t.Errorf("expected %d blocks by hash, got %d", maxSyncHashes, len(blocks))
+	}
+
+	blocks := blockSync.blocksByHeight(HeightRangeRequest{FromHeight: 1, ToHeight: 2 * maxSyncHeights})
+	for _, block := range blocks {
+		if block.Height > maxSyncHeights {
+			t.Fatalf("block of height %d is served, at most %d heights are served", block.Height, maxSyncHeights)
+		}
+	}
+
+	if expected := len(hashes) / 2; len(blocks) != expected {
+		t.Errorf("expected %d blocks by height, got %d", expected, len(blocks))
+	}
+}
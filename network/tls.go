@@ -0,0 +1,197 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// peerKeysTimeout is the time an accepted connection waits for the registered peer keys before its handshake fails
+const peerKeysTimeout = time.Minute
+
+var (
+	// ErrUnknownPeer is returned when a connection is opened to an address without a registered key
+	ErrUnknownPeer = errors.New("peer address does not have a registered key")
+
+	// ErrUnauthenticatedPeer is returned when the certificate key of a peer is not its registered key
+	ErrUnauthenticatedPeer = errors.New("peer certificate key is not a registered key")
+)
+
+// TLSTransport opens TLS 1.3 connections authenticated by the node keys. Each node presents a self-signed certificate of its ed25519 key,
+// and the handshake proves that the node owns the key. The certificate key of a dialed node must be the key registered for its address,
+// and the certificate key of a connecting node must be one of the registered keys. Certificate chains are not used.
+// An accepted connection is bound to the registered address of the key of the connecting node
+type TLSTransport struct {
+	certificate tls.Certificate
+
+	mutex sync.RWMutex
+
+	// keysByAddress keeps the registered key of each node address, and addressesByKey keeps the registered address of each key
+	keysByAddress  map[string][]byte
+	addressesByKey map[string]string
+
+	// keysReady is closed when the peer keys are set. Accepted connections wait for it to verify their peers
+	keysReady chan struct{}
+	readyOnce sync.Once
+}
+
+// NewTLSTransport creates a TLS transport presenting a certificate of the given node key
+func NewTLSTransport(privateKey ed25519.PrivateKey) (*TLSTransport, error) {
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("%x", privateKey.Public())},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TLSTransport{
+		certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey},
+		keysReady:   make(chan struct{}),
+	}
+
+	return t, nil
+}
+
+// SetPeerKeys sets the registered key of each node address. The address is in host:port form
+func (t *TLSTransport) SetPeerKeys(keysByAddress map[string][]byte) {
+
+	t.mutex.Lock()
+
+	t.keysByAddress = make(map[string][]byte, len(keysByAddress))
+	t.addressesByKey = make(map[string]string, len(keysByAddress))
+	for address, key := range keysByAddress {
+		t.keysByAddress[address] = key
+		t.addressesByKey[string(key)] = address
+	}
+
+	t.mutex.Unlock()
+
+	t.readyOnce.Do(func() { close(t.keysReady) })
+}
+
+// Dial opens a connection to the node with the given address, and checks that the node owns the key registered for the address
+func (t *TLSTransport) Dial(address string) (net.Conn, error) {
+
+	t.mutex.RLock()
+	key, ok := t.keysByAddress[address]
+	t.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, address)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{t.certificate},
+		MinVersion:   tls.VersionTLS13,
+		// the certificate is self-signed, the peer is verified by its registered key instead of a certificate chain
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateKey(rawCerts, func(peerKey []byte) bool { return string(peerKey) == string(key) })
+		},
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, config)
+}
+
+// Server wraps an accepted connection. The handshake is done on the first read, and it fails if the connecting node does not own a registered key
+func (t *TLSTransport) Server(conn net.Conn) net.Conn {
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{t.certificate},
+		MinVersion:            tls.VersionTLS13,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyClient,
+	}
+
+	return tls.Server(conn, config)
+}
+
+// verifyClient checks that the certificate key of a connecting node is a registered key.
+// Nodes may connect before the node list is complete, so it waits for the peer keys
+func (t *TLSTransport) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+
+	select {
+	case <-t.keysReady:
+	case <-time.After(peerKeysTimeout):
+		return ErrUnauthenticatedPeer
+	}
+
+	return verifyCertificateKey(rawCerts, func(peerKey []byte) bool {
+
+		t.mutex.RLock()
+		defer t.mutex.RUnlock()
+
+		_, ok := t.addressesByKey[string(peerKey)]
+		return ok
+	})
+}
+
+// PeerAddress returns the registered address of the node that opened an accepted connection. The address is in host:port form
+func (t *TLSTransport) PeerAddress(conn net.Conn) (string, error) {
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", ErrUnauthenticatedPeer
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) != 1 {
+		return "", ErrUnauthenticatedPeer
+	}
+
+	peerKey, ok := certificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", ErrUnauthenticatedPeer
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	address, ok := t.addressesByKey[string(peerKey)]
+	if !ok {
+		return "", ErrUnauthenticatedPeer
+	}
+
+	return address, nil
+}
+
+// verifyCertificateKey extracts the ed25519 key of the peer certificate, and checks it with isRegistered.
+// The TLS handshake verifies that the peer owns the private key of the certificate
+func verifyCertificateKey(rawCerts [][]byte, isRegistered func(peerKey []byte) bool) error {
+
+	if len(rawCerts) != 1 {
+		return ErrUnauthenticatedPeer
+	}
+
+	certificate, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	peerKey, ok := certificate.PublicKey.(ed25519.PublicKey)
+	if !ok || !isRegistered(peerKey) {
+		return ErrUnauthenticatedPeer
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/korkmazkadir/bitcoin/common"
+	"github.com/korkmazkadir/bitcoin/storage"
+	"github.com/korkmazkadir/bitcoin/wire"
+)
+
+type echoService struct{}
+
+func (echoService) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func newTestTransport(t *testing.T) (*TLSTransport, []byte) {
+
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := NewTLSTransport(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport, publicKey
+}
+
+func TestTLSTransport(t *testing.T) {
+
+	server, serverKey := newTestTransport(t)
+	client, clientKey := newTestTransport(t)
+	impostor, _ := newTestTransport(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Echo", echoService{})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpcServer.ServeConn(server.Server(conn))
+		}
+	}()
+
+	address := listener.Addr().String()
+	keys := map[string][]byte{address: serverKey, "127.0.0.1:1": clientKey}
+
+	server.SetPeerKeys(keys)
+	client.SetPeerKeys(keys)
+	impostor.SetPeerKeys(keys)
+
+	call := func(transport *TLSTransport) error {
+
+		conn, err := transport.Dial(address)
+		if err != nil {
+			return err
+		}
+
+		rpcClient := rpc.NewClient(conn)
+		defer rpcClient.Close()
+
+		var reply string
+		return rpcClient.Call("Echo.Echo", "hello", &reply)
+	}
+
+	if err := call(client); err != nil {
+		t.Errorf("registered node could not call the server: %s", err)
+	}
+
+	// the server closes the connection of a node without a registered key
+	if err := call(impostor); err == nil {
+		t.Errorf("node without a registered key called the server")
+	}
+
+	// the dialed node must own the key registered for its address
+	client.SetPeerKeys(map[string][]byte{address: clientKey})
+	if _, err := client.Dial(address); err == nil {
+		t.Errorf("connected to a node with a different key than the registered key")
+	}
+
+	if _, err := client.Dial("127.0.0.1:2"); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected %v, got %v", ErrUnknownPeer, err)
+	}
+}
+
+func TestTLSTransportBindsPeerAddress(t *testing.T) {
+
+	serverTransport, serverKey := newTestTransport(t)
+	clientTransport, clientKey := newTestTransport(t)
+
+	SetTransport(serverTransport)
+	defer SetTransport(tcpTransport{})
+
+	demux := common.NewDemultiplexer(1)
+	server := NewServer(demux)
+	blockSync := NewBlockSync(demux, nil, storage.NewMemoryStore(), "127.0.0.1", 0)
+	server.SetBlockSync(blockSync)
+
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(rpcServer, conn)
+		}
+	}()
+
+	address := listener.Addr().String()
+	keys := map[string][]byte{address: serverKey, "127.0.0.1:1": clientKey}
+	serverTransport.SetPeerKeys(keys)
+	clientTransport.SetPeerKeys(keys)
+
+	conn, err := clientTransport.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpcClient := rpc.NewClient(conn)
+	defer rpcClient.Close()
+
+	// the node declares the address of the server instead of its own address
+	announcement := TipAnnouncement{Height: 5, IPAddress: "127.0.0.1", PortNumber: listener.Addr().(*net.TCPAddr).Port}
+	if err := rpcClient.Call("P2PServer.HandleTip", announcement, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	blockSync.mutex.Lock()
+	defer blockSync.mutex.Unlock()
+
+	if len(blockSync.tipSources) != 1 || blockSync.tipSources[0] != "127.0.0.1:1" {
+		t.Errorf("expected the registered address of the node as the tip source, got %v", blockSync.tipSources)
+	}
+}
+
+func TestTLSTransportChecksFramedNodeID(t *testing.T) {
+
+	serverTransport, serverKey := newTestTransport(t)
+	clientTransport, clientKey := newTestTransport(t)
+
+	SetTransport(serverTransport)
+	defer SetTransport(tcpTransport{})
+
+	configHash := []byte("config")
+	_, framed, _, port := startFramedNode(t, 1, configHash)
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	keys := map[string][]byte{address: serverKey, "127.0.0.1:1": clientKey}
+	framed.SetPeerIDs(map[string]int{address: 1, "127.0.0.1:1": 2})
+	serverTransport.SetPeerKeys(keys)
+	clientTransport.SetPeerKeys(keys)
+
+	connect := func(nodeID int) *wire.Conn {
+
+		conn, err := clientTransport.Dial(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wireConn, err := wire.Client(conn, wire.Handshake{Version: wire.ProtocolVersion, NodeID: nodeID, ConfigHash: configHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return wireConn
+	}
+
+	// the node declares the ID of another node
+	impostor := connect(3)
+	defer impostor.Close()
+
+	if m, err := impostor.ReadMessage(); err != nil || m.Type() != wire.MessageReject {
+		t.Errorf("handshake with another node ID is not rejected, got %v, %v", m, err)
+	}
+
+	registered := connect(2)
+	defer registered.Close()
+
+	if err := registered.WriteMessage(wire.Ping{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := registered.ReadMessage(); err != nil || m != (wire.Pong{Nonce: 1}) {
+		t.Errorf("expected a pong, got %v, %v", m, err)
+	}
+}
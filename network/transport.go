@@ -0,0 +1,88 @@
+package network
+
+import (
+	"bufio"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// dialTimeout is the time a connection to a node can take to open
+const dialTimeout = 10 * time.Second
+
+// Transport opens the connections between nodes. Dial is used by clients, and Server wraps the connections accepted by the P2P server
+type Transport interface {
+	// Dial opens a connection to the node with the given address
+	Dial(address string) (net.Conn, error)
+
+	// Server wraps a connection accepted by the P2P server of the node
+	Server(conn net.Conn) net.Conn
+}
+
+// authenticatingTransport is a transport that authenticates the nodes opening connections. The self-declared addresses of
+// the messages received on an accepted connection are replaced with the registered address of the authenticated node
+type authenticatingTransport interface {
+	Transport
+
+	// PeerAddress returns the registered address of the node that opened an accepted connection
+	PeerAddress(conn net.Conn) (string, error)
+}
+
+// tcpTransport opens plain TCP connections
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+
+	return net.DialTimeout("tcp", address, dialTimeout)
+}
+
+func (tcpTransport) Server(conn net.Conn) net.Conn {
+
+	return conn
+}
+
+var (
+	transportMutex sync.RWMutex
+	transport      Transport = tcpTransport{}
+)
+
+// SetTransport sets the transport of the connections between nodes. Plain TCP is used by default.
+// It is set before the P2P server accepts connections and before the clients are created, connections opened before keep their transport
+func SetTransport(t Transport) {
+
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+
+	transport = t
+}
+
+func currentTransport() Transport {
+
+	transportMutex.RLock()
+	defer transportMutex.RUnlock()
+
+	return transport
+}
+
+// bufferedConn reads a connection through the reader its first bytes are peeked with
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+
+	return c.reader.Read(b)
+}
+
+// dial opens an RPC connection to the node with the given address using the transport of the node
+func dial(address string) (*rpc.Client, error) {
+
+	conn, err := currentTransport().Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,85 @@
+package registery
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidNodeKey is returned when a node registers without an ed25519 public key
+	ErrInvalidNodeKey = errors.New("node public key is not an ed25519 key")
+
+	// ErrInvalidRegistrationSignature is returned when the registration signature does not match the node key,
+	// or it is not signed for the config of the registry
+	ErrInvalidRegistrationSignature = errors.New("registration signature does not match the node key and the config")
+
+	// ErrStaleRegistration is returned when a registration of a registered key is not newer than the registration it would replace
+	ErrStaleRegistration = errors.New("registration is not newer than the registration of the key")
+)
+
+// RegistrationDigest returns the digest signed by a node to register. It binds the address, the key and the timestamp of the node
+// to the config hash, so a registration can not be replayed for another address or experiment, or to take back a newer registration
+func (n NodeInfo) RegistrationDigest(configHash []byte) []byte {
+
+	h := sha256.New()
+
+	writeField := func(data []byte) {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+		h.Write(length[:])
+		h.Write(data)
+	}
+
+	var portNumber [8]byte
+	binary.BigEndian.PutUint64(portNumber[:], uint64(n.PortNumber))
+
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(n.Timestamp))
+
+	writeField([]byte(n.IPAddress))
+	writeField(portNumber[:])
+	writeField(n.PublicKey)
+	writeField(timestamp[:])
+	writeField(configHash)
+
+	return h.Sum(nil)
+}
+
+// Sign sets the public key and the timestamp of the node, and signs the registration for the config with the given hash
+func (n *NodeInfo) Sign(privateKey ed25519.PrivateKey, configHash []byte) {
+
+	n.PublicKey = privateKey.Public().(ed25519.PublicKey)
+	n.Timestamp = time.Now().UnixNano()
+	n.Signature = ed25519.Sign(privateKey, n.RegistrationDigest(configHash))
+}
+
+// Verify checks the registration signature of the node for the config with the given hash
+func (n NodeInfo) Verify(configHash []byte) error {
+
+	if len(n.PublicKey) != ed25519.PublicKeySize {
+		return ErrInvalidNodeKey
+	}
+
+	if !ed25519.Verify(n.PublicKey, n.RegistrationDigest(configHash), n.Signature) {
+		return ErrInvalidRegistrationSignature
+	}
+
+	return nil
+}
+
+// AuthenticatedKeys returns the public keys of the nodes whose registrations are signed for the config with the given hash.
+// The registry only lists authenticated nodes, and the signatures are checked again so a node does not depend on the registry alone
+func AuthenticatedKeys(nodes []NodeInfo, configHash []byte) [][]byte {
+
+	var keys [][]byte
+	for _, node := range nodes {
+		if node.Verify(configHash) == nil {
+			keys = append(keys, node.PublicKey)
+		}
+	}
+
+	return keys
+}
@@ -5,6 +5,43 @@ import (
 	"fmt"
 )
 
+const (
+	// SimulatedMining waits for an exponentially distributed time instead of hashing
+	SimulatedMining = "simulated"
+
+	// ProofOfWorkMining searches nonces until the block hash meets the difficulty target
+	ProofOfWorkMining = "pow"
+
+	// FullBlockPropagation sends complete blocks to peers
+	FullBlockPropagation = "full"
+
+	// HeaderFirstPropagation sends block headers to peers, and peers fetch the payload from the sender after validating the header
+	HeaderFirstPropagation = "header-first"
+
+	// ErasureCodedPropagation sends erasure coded fragments of blocks to peers. A block is reconstructed from any DataFragmentCount fragments
+	ErasureCodedPropagation = "erasure-coded"
+
+	// InventoryPropagation announces block hashes to peers, and peers request the blocks they have not seen
+	InventoryPropagation = "inventory"
+
+	// CompactBlockPropagation sends block headers with short transaction identifiers to peers.
+	// Peers rebuild blocks from their mempools, and request the missing transactions
+	CompactBlockPropagation = "compact"
+
+	// TCPTransport connects nodes with plain TCP connections
+	TCPTransport = "tcp"
+
+	// TLSTransport connects nodes with TLS connections authenticated by the registered node keys
+	TLSTransport = "tls"
+
+	// RPCWireProtocol sends each message to peers with a net/rpc call
+	RPCWireProtocol = "rpc"
+
+	// FramedWireProtocol sends blocks, transactions and tip announcements to peers as length-prefixed frames after a versioned handshake.
+	// It supports FullBlockPropagation without chunks
+	FramedWireProtocol = "framed"
+)
+
 type NodeConfig struct {
 	NodeCount int
 
@@ -18,12 +55,63 @@ type NodeConfig struct {
 
 	BlockSize int
 
+	// BlockChunkCount is the number of chunks a block is split into in FullBlockPropagation mode.
+	// Chunks are forwarded independently, and blocks are sent whole if it is less than 2
 	BlockChunkCount int
+
+	// MiningMode is either SimulatedMining or ProofOfWorkMining. Empty value means SimulatedMining
+	MiningMode string
+
+	// Difficulty is the expected number of hashes to mine a block in ProofOfWorkMining mode
+	Difficulty int64
+
+	// MinerCount is the number of worker goroutines searching nonces in ProofOfWorkMining mode
+	MinerCount int
+
+	// SimulatedHashRate is the number of hashes per second a node computes in SimulatedMining mode
+	SimulatedHashRate int64
+
+	// TargetRoundTime is the expected time in seconds between two macroblocks
+	TargetRoundTime int
+
+	// RetargetInterval is the number of heights between two difficulty adjustments
+	RetargetInterval int
+
+	// MempoolSize is the maximum size of the mempool in bytes
+	MempoolSize int
+
+	// MempoolMaxAge is the time in seconds a transaction can wait in the mempool
+	MempoolMaxAge int
+
+	// PropagationMode is FullBlockPropagation, HeaderFirstPropagation, ErasureCodedPropagation, InventoryPropagation or CompactBlockPropagation.
+	// Empty value means FullBlockPropagation
+	PropagationMode string
+
+	// FragmentCount is the number of fragments a block is encoded into in ErasureCodedPropagation mode. It is at most 256
+	FragmentCount int
+
+	// DataFragmentCount is the number of fragments required to reconstruct a block in ErasureCodedPropagation mode
+	DataFragmentCount int
+
+	// DemuxQueueCapacity is the number of received blocks waiting for the consensus layer before blocks are dropped.
+	// Zero value means the default capacity
+	DemuxQueueCapacity int
+
+	// DemuxDropPolicy is drop-oldest, drop-future-rounds or prioritize-current-round. Empty value means drop-oldest
+	DemuxDropPolicy string
+
+	// TransportMode is TCPTransport or TLSTransport. Empty value means TCPTransport
+	TransportMode string
+
+	// WireProtocol is RPCWireProtocol or FramedWireProtocol. Empty value means RPCWireProtocol
+	WireProtocol string
 }
 
 func (nc NodeConfig) Hash() []byte {
 
-	str := fmt.Sprintf("%d,%x,%d,%d,%d,%d,%d", nc.NodeCount, nc.EpochSeed, nc.EndRound, nc.GossipFanout, nc.LeaderCount, nc.BlockSize, nc.BlockChunkCount)
+	str := fmt.Sprintf("%d,%x,%d,%d,%d,%d,%d,%s,%d,%d,%d,%d,%d,%d,%d,%s,%d,%d,%d,%s,%s,%s", nc.NodeCount, nc.EpochSeed, nc.EndRound, nc.GossipFanout, nc.LeaderCount, nc.BlockSize, nc.BlockChunkCount,
+		nc.MiningMode, nc.Difficulty, nc.MinerCount, nc.SimulatedHashRate, nc.TargetRoundTime, nc.RetargetInterval, nc.MempoolSize, nc.MempoolMaxAge, nc.PropagationMode, nc.FragmentCount, nc.DataFragmentCount,
+		nc.DemuxQueueCapacity, nc.DemuxDropPolicy, nc.TransportMode, nc.WireProtocol)
 
 	h := sha256.New()
 	_, err := h.Write([]byte(str))
@@ -43,4 +131,19 @@ func (nc *NodeConfig) CopyFields(cp NodeConfig) {
 	nc.LeaderCount = cp.LeaderCount
 	nc.BlockSize = cp.BlockSize
 	nc.BlockChunkCount = cp.BlockChunkCount
+	nc.MiningMode = cp.MiningMode
+	nc.Difficulty = cp.Difficulty
+	nc.MinerCount = cp.MinerCount
+	nc.SimulatedHashRate = cp.SimulatedHashRate
+	nc.TargetRoundTime = cp.TargetRoundTime
+	nc.RetargetInterval = cp.RetargetInterval
+	nc.MempoolSize = cp.MempoolSize
+	nc.MempoolMaxAge = cp.MempoolMaxAge
+	nc.PropagationMode = cp.PropagationMode
+	nc.FragmentCount = cp.FragmentCount
+	nc.DataFragmentCount = cp.DataFragmentCount
+	nc.DemuxQueueCapacity = cp.DemuxQueueCapacity
+	nc.DemuxDropPolicy = cp.DemuxDropPolicy
+	nc.TransportMode = cp.TransportMode
+	nc.WireProtocol = cp.WireProtocol
 }
@@ -2,6 +2,7 @@ package registery
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"testing"
 )
@@ -18,8 +19,14 @@ func TestRegistry(t *testing.T) {
 	nodeRegistry := NewNodeRegistry(nodeConfig)
 
 	// test register function
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	nodeInfo := &NodeInfo{IPAddress: "abc", PortNumber: 6349}
-	err := nodeRegistry.Register(nodeInfo, nodeInfo)
+	nodeInfo.Sign(privateKey, nodeConfig.Hash())
+	err = nodeRegistry.Register(nodeInfo, nodeInfo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -51,7 +58,7 @@ func TestRegistry(t *testing.T) {
 	}
 
 	receivedNode := nodeList.Nodes[0]
-	if receivedNode.IPAddress != nodeInfo.IPAddress || receivedNode.PortNumber != nodeInfo.PortNumber {
+	if receivedNode.IPAddress != nodeInfo.IPAddress || receivedNode.PortNumber != nodeInfo.PortNumber || !bytes.Equal(receivedNode.PublicKey, nodeInfo.PublicKey) {
 		t.Errorf("node list is not correct; ecpected node %v, reveived node %v \n", nodeInfo, receivedNode)
 	}
 
@@ -67,3 +74,126 @@ func TestRegistry(t *testing.T) {
 	}
 
 }
+
+func TestRegistryAuthentication(t *testing.T) {
+
+	nodeConfig := NodeConfig{NodeCount: 10, EndRound: 10}
+	nodeRegistry := NewNodeRegistry(nodeConfig)
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a node without a key can not register
+	reply := &NodeInfo{}
+	if err := nodeRegistry.Register(&NodeInfo{IPAddress: "abc", PortNumber: 1}, reply); err != ErrInvalidNodeKey {
+		t.Errorf("expected %v, got %v", ErrInvalidNodeKey, err)
+	}
+
+	// a registration signed for another config can not be replayed
+	nodeInfo := NodeInfo{IPAddress: "abc", PortNumber: 1}
+	nodeInfo.Sign(privateKey, NodeConfig{NodeCount: 5}.Hash())
+	if err := nodeRegistry.Register(&nodeInfo, reply); err != ErrInvalidRegistrationSignature {
+		t.Errorf("expected %v, got %v", ErrInvalidRegistrationSignature, err)
+	}
+
+	// an impostor can not take the address of a signed registration
+	nodeInfo.Sign(privateKey, nodeConfig.Hash())
+	impostor := nodeInfo
+	impostor.PortNumber = 2
+	if err := nodeRegistry.Register(&impostor, reply); err != ErrInvalidRegistrationSignature {
+		t.Errorf("expected %v, got %v", ErrInvalidRegistrationSignature, err)
+	}
+
+	if err := nodeRegistry.Register(&nodeInfo, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	nodeList := &NodeList{}
+	if err := nodeRegistry.GetNodeList(&nodeInfo, nodeList); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := AuthenticatedKeys(nodeList.Nodes, nodeConfig.Hash())
+	if len(keys) != 1 || !bytes.Equal(keys[0], privateKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("expected the key of the registered node in the validator key set, got %x", keys)
+	}
+
+	// a listed node whose signature does not match is left out of the key set
+	nodeList.Nodes[0].PortNumber = 2
+	if keys := AuthenticatedKeys(nodeList.Nodes, nodeConfig.Hash()); len(keys) != 0 {
+		t.Errorf("unauthenticated node is in the validator key set")
+	}
+}
+
+func TestRegistryRestart(t *testing.T) {
+
+	nodeConfig := NodeConfig{NodeCount: 10, EndRound: 10}
+	nodeRegistry := NewNodeRegistry(nodeConfig)
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var original NodeInfo
+	for i, key := range []ed25519.PrivateKey{otherKey, privateKey} {
+		nodeInfo := NodeInfo{IPAddress: "abc", PortNumber: i}
+		nodeInfo.Sign(key, nodeConfig.Hash())
+		if err := nodeRegistry.Register(&nodeInfo, &NodeInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		original = nodeInfo
+	}
+
+	// the node restarts at another address with the key it keeps in its keystore
+	restarted := NodeInfo{IPAddress: "def", PortNumber: 3}
+	restarted.Sign(privateKey, nodeConfig.Hash())
+
+	reply := &NodeInfo{}
+	if err := nodeRegistry.Register(&restarted, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.ID != 2 {
+		t.Errorf("expected the node ID 2 of the registered key, got %d", reply.ID)
+	}
+
+	nodeList := &NodeList{}
+	if err := nodeRegistry.GetNodeList(&restarted, nodeList); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodeList.Nodes) != 2 {
+		t.Fatalf("expected 2 registered nodes, got %d", len(nodeList.Nodes))
+	}
+
+	node := nodeList.Nodes[1]
+	if node.ID != 2 || node.IPAddress != "def" || node.PortNumber != 3 {
+		t.Errorf("registration is not updated with the new address, got %v", node)
+	}
+
+	if keys := AuthenticatedKeys(nodeList.Nodes, nodeConfig.Hash()); len(keys) != 2 {
+		t.Errorf("expected 2 keys in the validator key set, got %d", len(keys))
+	}
+
+	// the previous registration of the key is replayed
+	if err := nodeRegistry.Register(&original, &NodeInfo{}); err != ErrStaleRegistration {
+		t.Errorf("expected %s, got %v", ErrStaleRegistration, err)
+	}
+
+	nodeList = &NodeList{}
+	if err := nodeRegistry.GetNodeList(&restarted, nodeList); err != nil {
+		t.Fatal(err)
+	}
+
+	if node := nodeList.Nodes[1]; node.IPAddress != "def" || node.PortNumber != 3 {
+		t.Errorf("replayed registration takes back the registration, got %v", node)
+	}
+}
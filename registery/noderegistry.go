@@ -1,6 +1,7 @@
 package registery
 
 import (
+	"bytes"
 	"log"
 	"os"
 	"strconv"
@@ -16,6 +17,13 @@ type NodeInfo struct {
 	ID         int
 	IPAddress  string
 	PortNumber int
+	// PublicKey is the ed25519 key the node signs its blocks with. It attributes block issuers to node IDs
+	PublicKey []byte
+	// Timestamp is the time of the registration in Unix nanoseconds. A registration of a registered key replaces it
+	// only if its timestamp is later, so a previous registration can not be replayed
+	Timestamp int64
+	// Signature signs the address, the key and the timestamp of the node with the config hash of the registry
+	Signature []byte
 }
 
 type NodeList struct {
@@ -36,22 +44,53 @@ func NewNodeRegistry(config NodeConfig) *NodeRegistry {
 	return &NodeRegistry{config: config, isTimerRunning: false}
 }
 
-// Register registers a node with specific node info
+// Register registers a node with specific node info. The registration must be signed by the node key for the config of the registry.
+// A node restarting with a registered key takes over the registration with a newer timestamp, it gets the same node ID at its new address
 func (nr *NodeRegistry) Register(nodeInfo *NodeInfo, reply *NodeInfo) error {
 
 	nr.mutex.Lock()
 	defer nr.mutex.Unlock()
 
-	// assigns a node ID. smallest node ID is 1
-	nodeID := len(nr.registeredNodes) + 1
-	nodeInfo.ID = nodeID
+	if err := nodeInfo.Verify(nr.config.Hash()); err != nil {
+		log.Printf("rejected the registration of %s:%d: %s\n", nodeInfo.IPAddress, nodeInfo.PortNumber, err)
+		return err
+	}
+
+	registered := -1
+	for i, node := range nr.registeredNodes {
+		if bytes.Equal(node.PublicKey, nodeInfo.PublicKey) {
+			registered = i
+			break
+		}
+	}
+
+	if registered >= 0 {
+		node := &nr.registeredNodes[registered]
+		if nodeInfo.Timestamp <= node.Timestamp {
+			log.Printf("rejected the registration of %s:%d: %s\n", nodeInfo.IPAddress, nodeInfo.PortNumber, ErrStaleRegistration)
+			return ErrStaleRegistration
+		}
 
-	nr.registeredNodes = append(nr.registeredNodes, *nodeInfo)
-	log.Printf("new node registered; ip address %s port number %d, registered node count: %d\n", nodeInfo.IPAddress, nodeInfo.PortNumber, len(nr.registeredNodes))
+		node.IPAddress = nodeInfo.IPAddress
+		node.PortNumber = nodeInfo.PortNumber
+		node.Timestamp = nodeInfo.Timestamp
+		node.Signature = nodeInfo.Signature
+		nodeInfo.ID = node.ID
+		log.Printf("node %d registered again; ip address %s port number %d public key %x\n", node.ID, node.IPAddress, node.PortNumber, node.PublicKey)
+	} else {
+		// assigns a node ID. smallest node ID is 1
+		nodeInfo.ID = len(nr.registeredNodes) + 1
+
+		nr.registeredNodes = append(nr.registeredNodes, *nodeInfo)
+		log.Printf("new node registered; ip address %s port number %d public key %x, registered node count: %d\n", nodeInfo.IPAddress, nodeInfo.PortNumber, nodeInfo.PublicKey, len(nr.registeredNodes))
+	}
 
 	reply.IPAddress = nodeInfo.IPAddress
 	reply.PortNumber = nodeInfo.PortNumber
 	reply.ID = nodeInfo.ID
+	reply.PublicKey = nodeInfo.PublicKey
+	reply.Timestamp = nodeInfo.Timestamp
+	reply.Signature = nodeInfo.Signature
 
 	return nil
 }
@@ -103,7 +142,7 @@ func (nr *NodeRegistry) GetConfig(nodeInfo *NodeInfo, config *NodeConfig) error
 	return nil
 }
 
-// GetNodeList returns node list
+// GetNodeList returns node list. The public keys of the listed nodes are the authenticated validator key set
 func (nr *NodeRegistry) GetNodeList(nodeInfo *NodeInfo, nodeList *NodeList) error {
 
 	nr.mutex.Lock()
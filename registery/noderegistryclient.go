@@ -1,6 +1,7 @@
 package registery
 
 import (
+	"crypto/ed25519"
 	"net/rpc"
 
 	"github.com/korkmazkadir/bitcoin/common"
@@ -23,8 +24,10 @@ func NewRegistryClient(registryAddress string, currentNodeInfo NodeInfo) Registr
 	return registeryClient
 }
 
-// RegisterNode registers a node and returns assigned node ID
-func (rc RegistryClient) RegisterNode() int {
+// RegisterNode signs the registration with the node key for the config of the registry, registers the node and returns assigned node ID
+func (rc RegistryClient) RegisterNode(privateKey ed25519.PrivateKey) int {
+
+	rc.nodeInfo.Sign(privateKey, rc.GetConfig().Hash())
 
 	err := rc.rpcClient.Call("NodeRegistry.Register", rc.nodeInfo, &rc.nodeInfo)
 	if err != nil {
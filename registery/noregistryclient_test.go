@@ -2,6 +2,7 @@ package registery
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"log"
 	"net"
 	"net/rpc"
@@ -57,7 +58,12 @@ func TestRegistryClient(t *testing.T) {
 	registryAddress := "localhost:1234"
 	registryClient := NewRegistryClient(registryAddress, nodeInfo)
 
-	nodeInfo.ID = registryClient.RegisterNode()
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeInfo.ID = registryClient.RegisterNode(privateKey)
 	if nodeInfo.ID == 0 {
 		t.Error("registery did not assign a node id")
 	}
@@ -44,7 +44,7 @@ func NewStatKeeper(config NodeConfig) *StatKeeper {
 func (s *StatKeeper) SaveStats(statList common.StatList) {
 
 	// writes node info to the filer
-	nodeInfo := getNodeInfoString(statList.IPAddress, statList.PortNumber, statList.NodeID)
+	nodeInfo := getNodeInfoString(statList.IPAddress, statList.PortNumber, statList.NodeID, statList.PublicKey)
 
 	nodeInfoFile, err := os.OpenFile(s.GetNodesFilePath(), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -79,14 +79,37 @@ func (s *StatKeeper) SaveStats(statList common.StatList) {
 		panic(err)
 	}
 
+	// writes counters to the file
+	countersFile, err := os.OpenFile(s.GetCountersFilePath(), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for name, value := range statList.Counters {
+		_, err = countersFile.WriteString(getCounterString(statList.NodeID, name, value))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	countersFile.Close()
+	if err != nil {
+		panic(err)
+	}
+
 }
 
-func getNodeInfoString(ipAddress string, portNumber int, nodeID int) string {
-	return fmt.Sprintf("%d\t%s\t%d\n", nodeID, ipAddress, portNumber)
+// getNodeInfoString returns a line of the nodes file. The hex encoded public key maps block issuers to node IDs
+func getNodeInfoString(ipAddress string, portNumber int, nodeID int, publicKey []byte) string {
+	return fmt.Sprintf("%d\t%s\t%d\t%x\n", nodeID, ipAddress, portNumber, publicKey)
 }
 
 func getEventString(nodeID int, event common.Event) string {
-	return fmt.Sprintf("%d\t%d\t%s\t%d\n", nodeID, event.Round, event.Type, event.ElapsedTime)
+	return fmt.Sprintf("%d\t%d\t%s\t%d\t%d\n", nodeID, event.Round, event.Type, event.ElapsedTime, event.Value)
+}
+
+func getCounterString(nodeID int, name string, value int) string {
+	return fmt.Sprintf("%d\t%s\t%d\n", nodeID, name, value)
 }
 
 func (s *StatKeeper) GetConfigFilePath() string {
@@ -100,3 +123,7 @@ func (s *StatKeeper) GetStatsFilePath() string {
 func (s *StatKeeper) GetNodesFilePath() string {
 	return fmt.Sprintf("./%s/nodes.txt", s.foderName)
 }
+
+func (s *StatKeeper) GetCountersFilePath() string {
+	return fmt.Sprintf("./%s/counters.log", s.foderName)
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+const (
+	// fileMagic identifies block store files
+	fileMagic = "BLKSTORE"
+
+	// fileVersion is the version of the file layout. Blocks are kept in common.BlockEncodingVersion
+	fileVersion = 2
+
+	// fileHeaderSize is the size of the magic and the version
+	fileHeaderSize = len(fileMagic) + 4
+
+	// recordHeaderSize is the size of the length, the length checksum and the data checksum of a record
+	recordHeaderSize = 12
+
+	// maxRecordSize is the size of the largest block a record can keep
+	maxRecordSize = 1 << 30
+)
+
+// FileStore keeps blocks in an append-only file. Each record is the length of a block encoding, the CRC-32 checksum of the length,
+// and the CRC-32 checksum of the encoding, followed by the encoding. Only the indexes are kept in memory,
+// blocks are read from the file when they are requested.
+//
+// A record is written with a single write followed by a sync, so a crash can only leave an incomplete record at the end of the file.
+// Such a torn tail is detected by its length or checksums, and it is truncated when the file is opened.
+// A corrupted record followed by other records is not a torn tail, and the file is not opened. Since a corrupted length
+// can point past the end of the file, the rest of the file is searched for a record with valid checksums before it is truncated
+type FileStore struct {
+	mutex sync.Mutex
+
+	file *os.File
+	size int64
+
+	// offsets keeps the record offsets in append order
+	offsets  []int64
+	byHash   map[string]int64
+	byHeight map[int][]int64
+
+	// truncatedBytes is the size of the torn tail removed when the file is opened
+	truncatedBytes int64
+
+	// readOnly is true if the file is opened for reading. A torn tail is ignored instead of truncated
+	readOnly bool
+}
+
+// OpenFileStore opens the block store file at the given path, and creates it if it does not exist.
+// The indexes are rebuilt from the file, and a torn tail is truncated
+func OpenFileStore(path string) (*FileStore, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		file:     file,
+		byHash:   make(map[string]int64),
+		byHeight: make(map[int][]int64),
+	}
+
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenFileStoreReadOnly opens an existing block store file for reading. The file may be written by a running node at the same time,
+// so an incomplete record at the end of the file is ignored instead of truncated. Blocks appended after opening the file are not visible
+func OpenFileStoreReadOnly(path string) (*FileStore, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		file:     file,
+		byHash:   make(map[string]int64),
+		byHeight: make(map[int][]int64),
+		readOnly: true,
+	}
+
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Append writes a block to the end of the file, and syncs the file
+func (s *FileStore) Append(block common.Block) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := block.Hash()
+	if _, ok := s.byHash[string(hash)]; ok {
+		return nil
+	}
+
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+
+	data := block.Encode()
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("block %x is larger than the maximum record size", hash)
+	}
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[0:4]))
+	binary.BigEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		// removes the partially written record, it is truncated on the next open otherwise
+		s.file.Truncate(s.size)
+		return err
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.index(s.size, hash, block.Height)
+	s.size += int64(len(record))
+
+	return nil
+}
+
+// Get reads the block with the given hash from the file
+func (s *FileStore) Get(hash []byte) (common.Block, bool) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	offset, ok := s.byHash[string(hash)]
+	if !ok {
+		return common.Block{}, false
+	}
+
+	return s.mustRead(offset), true
+}
+
+// Contains returns true if the block with the given hash is stored
+func (s *FileStore) Contains(hash []byte) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.byHash[string(hash)]
+	return ok
+}
+
+// AtHeight reads the blocks of a height from the file in append order
+func (s *FileStore) AtHeight(height int) []common.Block {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blocks := make([]common.Block, 0, len(s.byHeight[height]))
+	for _, offset := range s.byHeight[height] {
+		blocks = append(blocks, s.mustRead(offset))
+	}
+
+	return blocks
+}
+
+// ForEach reads the blocks from the file in append order, and calls fn for each of them
+func (s *FileStore) ForEach(fn func(block common.Block) error) error {
+
+	s.mutex.Lock()
+	offsets := s.offsets[:len(s.offsets):len(s.offsets)]
+	s.mutex.Unlock()
+
+	for _, offset := range offsets {
+
+		s.mutex.Lock()
+		block, _, err := s.read(offset)
+		s.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Count returns the number of stored blocks
+func (s *FileStore) Count() int {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.offsets)
+}
+
+// TruncatedBytes returns the size of the torn tail removed when the file is opened
+func (s *FileStore) TruncatedBytes() int64 {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.truncatedBytes
+}
+
+// Close closes the file
+func (s *FileStore) Close() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.Close()
+}
+
+// load checks the file header, and indexes the records. The file ends at an incomplete or corrupted last record.
+// Records after a corrupted record can not be trusted to be read correctly, so ErrCorruptStore is returned instead of dropping them
+func (s *FileStore) load() error {
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 && !s.readOnly {
+		header := make([]byte, fileHeaderSize)
+		copy(header, fileMagic)
+		binary.BigEndian.PutUint32(header[len(fileMagic):], fileVersion)
+
+		if _, err := s.file.WriteAt(header, 0); err != nil {
+			return err
+		}
+
+		s.size = int64(fileHeaderSize)
+		return s.file.Sync()
+	}
+
+	header := make([]byte, fileHeaderSize)
+	if _, err := s.file.ReadAt(header, 0); err != nil || !bytes.Equal(header[:len(fileMagic)], []byte(fileMagic)) {
+		return ErrInvalidStore
+	}
+
+	if binary.BigEndian.Uint32(header[len(fileMagic):]) != fileVersion {
+		return ErrUnsupportedStoreVersion
+	}
+
+	offset := int64(fileHeaderSize)
+	for offset < info.Size() {
+
+		block, size, err := s.read(offset)
+		if err != nil {
+
+			next, found, scanErr := s.nextRecord(offset, size, info.Size())
+			if scanErr != nil {
+				return scanErr
+			}
+
+			if found {
+				return fmt.Errorf("%w: %s, a record follows at offset %d", ErrCorruptStore, err, next)
+			}
+
+			// the last record is incomplete or corrupted
+			break
+		}
+
+		s.index(offset, block.Hash(), block.Height)
+		offset += size
+	}
+
+	s.size = offset
+
+	if offset < info.Size() && s.readOnly {
+		log.Printf("ignoring %d bytes after offset %d of the block store\n", info.Size()-offset, offset)
+		return nil
+	}
+
+	if offset < info.Size() {
+		s.truncatedBytes = info.Size() - offset
+		log.Printf("truncating the torn tail of the block store, %d bytes after offset %d\n", s.truncatedBytes, offset)
+
+		if err := s.file.Truncate(offset); err != nil {
+			return err
+		}
+
+		return s.file.Sync()
+	}
+
+	return nil
+}
+
+// nextRecord returns the offset of the first record with valid checksums after the corrupted record at the offset.
+// A record ending before the end of the file is followed by other records. Otherwise its declared size may be corrupted too,
+// so the rest of the file is searched byte by byte for a valid record header, and then for a valid record
+func (s *FileStore) nextRecord(offset int64, size int64, fileSize int64) (int64, bool, error) {
+
+	if size > 0 && offset+size < fileSize {
+		return offset + size, true, nil
+	}
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(s.file, offset+1, fileSize-offset-1), 1<<16)
+	for next := offset + 1; ; next++ {
+
+		header, err := reader.Peek(recordHeaderSize)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+
+		if err != nil {
+			return 0, false, err
+		}
+
+		if validRecordHeader(header) {
+			if _, _, err := s.read(next); err == nil {
+				return next, true, nil
+			}
+		}
+
+		reader.Discard(1)
+	}
+}
+
+// read decodes the record at the offset, and returns the block with the size of the record.
+// If the record can not be decoded, the returned size is the size declared by the record header,
+// or zero if the header can not be read, or its length checksum does not match
+func (s *FileStore) read(offset int64) (common.Block, int64, error) {
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := s.file.ReadAt(header, offset); err != nil {
+		return common.Block{}, 0, err
+	}
+
+	if !validRecordHeader(header) {
+		return common.Block{}, 0, fmt.Errorf("length checksum of the record at offset %d does not match", offset)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	size := int64(recordHeaderSize) + int64(length)
+	if length > maxRecordSize {
+		return common.Block{}, size, fmt.Errorf("record at offset %d is too large", offset)
+	}
+
+	data := make([]byte, length)
+	if _, err := s.file.ReadAt(data, offset+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return common.Block{}, size, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[8:12]) {
+		return common.Block{}, size, fmt.Errorf("checksum of the record at offset %d does not match", offset)
+	}
+
+	block, err := common.DecodeBlock(data)
+	if err != nil {
+		return common.Block{}, size, fmt.Errorf("record at offset %d: %w", offset, err)
+	}
+
+	return block, size, nil
+}
+
+// mustRead reads an indexed record. Indexed records are verified when they are written or loaded,
+// so an error means that the file is modified or the disk is failing, and the ledger can not continue
+func (s *FileStore) mustRead(offset int64) common.Block {
+
+	block, _, err := s.read(offset)
+	if err != nil {
+		panic(fmt.Errorf("could not read the block store: %w", err))
+	}
+
+	return block
+}
+
+// validRecordHeader returns true if the length checksum of the record header matches the length
+func validRecordHeader(header []byte) bool {
+
+	return crc32.ChecksumIEEE(header[0:4]) == binary.BigEndian.Uint32(header[4:8])
+}
+
+func (s *FileStore) index(offset int64, hash []byte, height int) {
+
+	s.offsets = append(s.offsets, offset)
+	s.byHash[string(hash)] = offset
+	s.byHeight[height] = append(s.byHeight[height], offset)
+}
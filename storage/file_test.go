@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func createBlocks(count int) []common.Block {
+
+	var blocks []common.Block
+	for i := 0; i < count; i++ {
+		block := common.Block{Issuer: []byte("issuer"), Height: i / 2, Nonce: int64(i)}
+		block.SetPayload([]byte(fmt.Sprintf("payload %d", i)))
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+func checkStore(t *testing.T, store BlockStore, blocks []common.Block) {
+
+	if store.Count() != len(blocks) {
+		t.Fatalf("expected %d blocks, got %d", len(blocks), store.Count())
+	}
+
+	for _, block := range blocks {
+
+		stored, ok := store.Get(block.Hash())
+		if !ok || !bytes.Equal(stored.Payload, block.Payload) {
+			t.Errorf("block %x is not stored", block.Hash())
+		}
+	}
+
+	if atHeight := store.AtHeight(1); len(blocks) > 3 && (len(atHeight) != 2 || atHeight[1].Nonce != 3) {
+		t.Errorf("blocks of height 1 are not indexed in append order")
+	}
+
+	i := 0
+	err := store.ForEach(func(block common.Block) error {
+		if !bytes.Equal(block.Hash(), blocks[i].Hash()) {
+			return fmt.Errorf("block %d is not in append order", i)
+		}
+		i++
+		return nil
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+
+	store := NewMemoryStore()
+	blocks := createBlocks(5)
+	for _, block := range append(blocks, blocks[0]) {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkStore(t, store, blocks)
+}
+
+func TestFileStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := createBlocks(5)
+	for _, block := range append(blocks, blocks[0]) {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkStore(t, store, blocks)
+	store.Close()
+
+	// the indexes are rebuilt when the file is opened again
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStore(t, store, blocks)
+	store.Close()
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := createBlocks(3)
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while the last record is written leaves a part of it
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStore(t, store, blocks[:2])
+	if store.TruncatedBytes() == 0 {
+		t.Errorf("torn tail is not truncated")
+	}
+
+	// appending after the recovery continues from the last complete record
+	if err := store.Append(blocks[2]); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record with a corrupted checksum is treated as a torn tail
+	data[len(data)-1]++
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStore(t, store, blocks[:2])
+
+	// a corrupted record followed by complete records is not a torn tail
+	if err := store.Append(blocks[2]); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[fileHeaderSize+recordHeaderSize]++
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileStore(path); !errors.Is(err, ErrCorruptStore) {
+		t.Fatalf("expected %s, got %v", ErrCorruptStore, err)
+	}
+
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != int64(len(data)) {
+		t.Errorf("corrupted store is truncated")
+	}
+}
+
+func TestFileStoreCorruptedLength(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range createBlocks(3) {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupted length of the first record points past the end of the file
+	corruptLength := func(data []byte, validChecksum bool) {
+		length := data[fileHeaderSize : fileHeaderSize+4]
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+		if validChecksum {
+			binary.BigEndian.PutUint32(data[fileHeaderSize+4:fileHeaderSize+8], crc32.ChecksumIEEE(length))
+		}
+	}
+
+	for _, validChecksum := range []bool{false, true} {
+
+		data := append([]byte(nil), original...)
+		corruptLength(data, validChecksum)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := OpenFileStore(path); !errors.Is(err, ErrCorruptStore) {
+			t.Fatalf("expected %s with a valid length checksum %t, got %v", ErrCorruptStore, validChecksum, err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() != int64(len(data)) {
+			t.Errorf("records after a corrupted length are truncated")
+		}
+	}
+}
+
+func TestFileStoreReadOnly(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := createBlocks(3)
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record that a running node is writing is ignored, and the file is not modified
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly, err := OpenFileStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	checkStore(t, readOnly, blocks[:2])
+
+	if err := readOnly.Append(blocks[2]); err != ErrReadOnlyStore {
+		t.Errorf("expected %v, got %v", ErrReadOnlyStore, err)
+	}
+
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() == 0 || readOnly.TruncatedBytes() != 0 {
+		t.Errorf("read-only store modified the file")
+	}
+
+	if _, err := OpenFileStoreReadOnly(filepath.Join(t.TempDir(), "missing.dat")); err == nil {
+		t.Errorf("missing file is opened")
+	}
+}
+
+func TestFileStoreInvalidFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	if err := ioutil.WriteFile(path, []byte("not a block store"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileStore(path); err != ErrInvalidStore {
+		t.Errorf("expected %s, got %v", ErrInvalidStore, err)
+	}
+}
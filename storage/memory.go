@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// MemoryStore keeps blocks in memory. The blocks are lost when the process exits
+type MemoryStore struct {
+	mutex sync.Mutex
+
+	blocks   []common.Block
+	byHash   map[string]int
+	byHeight map[int][]int
+}
+
+// NewMemoryStore creates an empty in-memory block store
+func NewMemoryStore() *MemoryStore {
+
+	return &MemoryStore{
+		byHash:   make(map[string]int),
+		byHeight: make(map[int][]int),
+	}
+}
+
+// Append stores a block
+func (s *MemoryStore) Append(block common.Block) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := string(block.Hash())
+	if _, ok := s.byHash[hash]; ok {
+		return nil
+	}
+
+	s.byHash[hash] = len(s.blocks)
+	s.byHeight[block.Height] = append(s.byHeight[block.Height], len(s.blocks))
+	s.blocks = append(s.blocks, block)
+
+	return nil
+}
+
+// Get returns the block with the given hash
+func (s *MemoryStore) Get(hash []byte) (common.Block, bool) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index, ok := s.byHash[string(hash)]
+	if !ok {
+		return common.Block{}, false
+	}
+
+	return s.blocks[index], true
+}
+
+// Contains returns true if the block with the given hash is stored
+func (s *MemoryStore) Contains(hash []byte) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.byHash[string(hash)]
+	return ok
+}
+
+// AtHeight returns the blocks of a height in append order
+func (s *MemoryStore) AtHeight(height int) []common.Block {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blocks := make([]common.Block, 0, len(s.byHeight[height]))
+	for _, index := range s.byHeight[height] {
+		blocks = append(blocks, s.blocks[index])
+	}
+
+	return blocks
+}
+
+// ForEach calls fn for each block in append order
+func (s *MemoryStore) ForEach(fn func(block common.Block) error) error {
+
+	s.mutex.Lock()
+	blocks := s.blocks[:len(s.blocks):len(s.blocks)]
+	s.mutex.Unlock()
+
+	for _, block := range blocks {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Count returns the number of stored blocks
+func (s *MemoryStore) Count() int {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.blocks)
+}
+
+// Close does nothing for an in-memory store
+func (s *MemoryStore) Close() error {
+
+	return nil
+}
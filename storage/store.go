@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+var (
+	// ErrInvalidStore is returned when a file is not a block store file
+	ErrInvalidStore = errors.New("file is not a block store")
+
+	// ErrUnsupportedStoreVersion is returned when a block store file is written by an unknown version
+	ErrUnsupportedStoreVersion = errors.New("unsupported block store version")
+
+	// ErrCorruptStore is returned when a record is corrupted before the end of a block store file
+	ErrCorruptStore = errors.New("block store is corrupted")
+
+	// ErrReadOnlyStore is returned when a block is appended to a store opened for reading
+	ErrReadOnlyStore = errors.New("block store is opened for reading")
+)
+
+// BlockStore keeps blocks in append order with an index by hash and by height.
+// Blocks are appended after their parents, so replaying them in append order rebuilds the ledger
+type BlockStore interface {
+	// Append stores a block. Appending a stored block does nothing
+	Append(block common.Block) error
+
+	// Get returns the block with the given hash
+	Get(hash []byte) (common.Block, bool)
+
+	// Contains returns true if the block with the given hash is stored
+	Contains(hash []byte) bool
+
+	// AtHeight returns the blocks of a height in append order, including the blocks of competing branches
+	AtHeight(height int) []common.Block
+
+	// ForEach calls fn for each block in append order, and stops at the first error
+	ForEach(fn func(block common.Block) error) error
+
+	// Count returns the number of stored blocks
+	Count() int
+
+	// Close releases the resources of the store
+	Close() error
+}
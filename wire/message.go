@@ -0,0 +1,279 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+// MessageType identifies the message carried by a frame. New message types can be added without changing the protocol version,
+// because the receivers skip the frames of unknown types
+type MessageType uint8
+
+const (
+	MessageHandshake MessageType = iota + 1
+	MessageReject
+	MessagePing
+	MessagePong
+	MessageBlock
+	MessageTransactions
+	MessageAnnounce
+	MessageRequest
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageHandshake:
+		return "HANDSHAKE"
+	case MessageReject:
+		return "REJECT"
+	case MessagePing:
+		return "PING"
+	case MessagePong:
+		return "PONG"
+	case MessageBlock:
+		return "BLOCK"
+	case MessageTransactions:
+		return "TRANSACTIONS"
+	case MessageAnnounce:
+		return "ANNOUNCE"
+	case MessageRequest:
+		return "REQUEST"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(t))
+	}
+}
+
+// Message is a typed message of the protocol
+type Message interface {
+	Type() MessageType
+	encode(e *common.Encoder)
+}
+
+// Handshake is the first message of both sides of a connection. The version is the first field,
+// so a handshake of another version can be rejected without decoding the rest of it
+type Handshake struct {
+	Version    uint32
+	NodeID     int
+	ConfigHash []byte
+
+	// TipHeight and TipHashes describe the canonical tip of the node. TipHashes are the hashes of the microblocks of the tip macroblock
+	TipHeight int
+	TipHashes [][]byte
+
+	// PortNumber is the port the node serves catch-up requests on. It is zero if the node does not serve them
+	PortNumber int
+}
+
+// Reject is sent before closing a connection whose handshake is not accepted
+type Reject struct {
+	Reason string
+}
+
+// Ping requests a Pong with the same nonce
+type Ping struct {
+	Nonce uint64
+}
+
+// Pong answers a Ping
+type Pong struct {
+	Nonce uint64
+}
+
+// Block carries a block in the canonical block encoding
+type Block struct {
+	Block common.Block
+}
+
+// Transactions carries transactions in the block payload encoding
+type Transactions struct {
+	Transactions []common.Transaction
+}
+
+// Announce advertises the hashes of the blocks of a height. The receiver requests the blocks it does not have
+type Announce struct {
+	Height int
+	Hashes [][]byte
+}
+
+// Request requests blocks by hash. The available blocks are sent back as Block messages
+type Request struct {
+	Hashes [][]byte
+}
+
+func (Handshake) Type() MessageType    { return MessageHandshake }
+func (Reject) Type() MessageType       { return MessageReject }
+func (Ping) Type() MessageType         { return MessagePing }
+func (Pong) Type() MessageType         { return MessagePong }
+func (Block) Type() MessageType        { return MessageBlock }
+func (Transactions) Type() MessageType { return MessageTransactions }
+func (Announce) Type() MessageType     { return MessageAnnounce }
+func (Request) Type() MessageType      { return MessageRequest }
+
+func (m Handshake) encode(e *common.Encoder) {
+	e.WriteUvarint(uint64(m.Version))
+	e.WriteVarint(int64(m.NodeID))
+	e.WriteBytes(m.ConfigHash)
+	e.WriteVarint(int64(m.TipHeight))
+	e.WriteHashes(m.TipHashes)
+	e.WriteVarint(int64(m.PortNumber))
+}
+
+func (m Reject) encode(e *common.Encoder) {
+	e.WriteBytes([]byte(m.Reason))
+}
+
+func (m Ping) encode(e *common.Encoder) {
+	e.WriteUvarint(m.Nonce)
+}
+
+func (m Pong) encode(e *common.Encoder) {
+	e.WriteUvarint(m.Nonce)
+}
+
+func (m Block) encode(e *common.Encoder) {
+	e.WriteRaw(m.Block.Encode())
+}
+
+func (m Transactions) encode(e *common.Encoder) {
+	e.WriteRaw(common.EncodeTransactions(m.Transactions))
+}
+
+func (m Announce) encode(e *common.Encoder) {
+	e.WriteVarint(int64(m.Height))
+	e.WriteHashes(m.Hashes)
+}
+
+func (m Request) encode(e *common.Encoder) {
+	e.WriteHashes(m.Hashes)
+}
+
+// decodeHandshake decodes a handshake. If the version is not ProtocolVersion, only the version is decoded
+func decodeHandshake(d *common.Decoder) (Message, error) {
+
+	version, err := d.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	m := Handshake{Version: uint32(version)}
+	if m.Version != ProtocolVersion {
+		d.Rest()
+		return m, nil
+	}
+
+	nodeID, err := d.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+	m.NodeID = int(nodeID)
+
+	if m.ConfigHash, err = d.ReadBytes(); err != nil {
+		return nil, err
+	}
+
+	tipHeight, err := d.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+	m.TipHeight = int(tipHeight)
+
+	if m.TipHashes, err = d.ReadHashes(); err != nil {
+		return nil, err
+	}
+
+	portNumber, err := d.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+	m.PortNumber = int(portNumber)
+
+	return m, nil
+}
+
+func decodeReject(d *common.Decoder) (Message, error) {
+
+	reason, err := d.ReadBytes()
+	return Reject{Reason: string(reason)}, err
+}
+
+func decodePing(d *common.Decoder) (Message, error) {
+
+	nonce, err := d.ReadUvarint()
+	return Ping{Nonce: nonce}, err
+}
+
+func decodePong(d *common.Decoder) (Message, error) {
+
+	nonce, err := d.ReadUvarint()
+	return Pong{Nonce: nonce}, err
+}
+
+func decodeBlock(d *common.Decoder) (Message, error) {
+
+	block, err := common.DecodeBlock(d.Rest())
+	return Block{Block: block}, err
+}
+
+func decodeTransactions(d *common.Decoder) (Message, error) {
+
+	txs, err := common.DecodeTransactions(d.Rest())
+	return Transactions{Transactions: txs}, err
+}
+
+func decodeAnnounce(d *common.Decoder) (Message, error) {
+
+	height, err := d.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := d.ReadHashes()
+	return Announce{Height: int(height), Hashes: hashes}, err
+}
+
+func decodeRequest(d *common.Decoder) (Message, error) {
+
+	hashes, err := d.ReadHashes()
+	return Request{Hashes: hashes}, err
+}
+
+var decoders = map[MessageType]func(d *common.Decoder) (Message, error){
+	MessageHandshake:    decodeHandshake,
+	MessageReject:       decodeReject,
+	MessagePing:         decodePing,
+	MessagePong:         decodePong,
+	MessageBlock:        decodeBlock,
+	MessageTransactions: decodeTransactions,
+	MessageAnnounce:     decodeAnnounce,
+	MessageRequest:      decodeRequest,
+}
+
+// EncodeMessage returns the payload of the frame carrying the message
+func EncodeMessage(m Message) []byte {
+
+	e := &common.Encoder{}
+	m.encode(e)
+	return e.Bytes()
+}
+
+// DecodeMessage decodes the payload of a frame. It returns ErrUnknownMessageType if the type is not known by this version
+func DecodeMessage(messageType MessageType, payload []byte) (Message, error) {
+
+	decode, ok := decoders[messageType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMessageType, messageType)
+	}
+
+	d := common.NewDecoder(payload)
+	m, err := decode(d)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s message: %w", messageType, err)
+	}
+
+	if d.Remaining() != 0 {
+		return nil, fmt.Errorf("%s message has %d trailing bytes", messageType, d.Remaining())
+	}
+
+	return m, nil
+}
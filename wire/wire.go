@@ -0,0 +1,243 @@
+// Package wire implements the framed peer protocol. A connection starts with the protocol magic, followed by length-prefixed frames.
+// Each frame is a 4 byte big-endian length, a message type byte and the message payload, where the length covers the type and the payload.
+//
+// Both sides send a handshake first. The connection is rejected with a Reject message if the protocol versions or the config hashes differ.
+// Blocks are carried in the canonical block encoding and transactions in the block payload encoding, so the protocol does not depend on gob
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Magic starts a framed protocol connection. It distinguishes the connections from net/rpc connections on the same port
+	Magic = "BTCW"
+
+	// ProtocolVersion is the version sent in the handshake. Peers of other versions are rejected
+	ProtocolVersion = 1
+
+	// MaxFrameSize is the size of the largest frame, including the message type
+	MaxFrameSize = 64 << 20
+
+	// handshakeTimeout is the time the handshake of a connection can take
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidMagic is returned when a connection does not start with the protocol magic
+	ErrInvalidMagic = errors.New("connection does not start with the protocol magic")
+
+	// ErrUnsupportedVersion is returned when the peer handshake has another protocol version
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrConfigMismatch is returned when the peer handshake has another config hash
+	ErrConfigMismatch = errors.New("config hash does not match")
+
+	// ErrRejected is returned when the peer rejects the handshake
+	ErrRejected = errors.New("handshake is rejected by the peer")
+
+	// ErrUnexpectedMessage is returned when the first message of a peer is not a handshake
+	ErrUnexpectedMessage = errors.New("first message is not a handshake")
+
+	// ErrUnknownMessageType is returned by ReadMessage for the frames of unknown message types. The frame is consumed,
+	// so the caller can skip it and continue reading
+	ErrUnknownMessageType = errors.New("unknown message type")
+
+	// ErrFrameTooLarge is returned when a frame is larger than MaxFrameSize
+	ErrFrameTooLarge = errors.New("frame is too large")
+)
+
+// Conn is a framed protocol connection after the handshake. Messages can be written concurrently, and read by a single goroutine
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+
+	// writeTimeout is the time a message write can take. Writes do not time out if it is zero
+	writeTimeout time.Duration
+
+	peer Handshake
+}
+
+// IsFramed peeks the first bytes of a connection, and returns true if it is a framed protocol connection
+func IsFramed(reader *bufio.Reader) bool {
+
+	magic, err := reader.Peek(len(Magic))
+	return err == nil && string(magic) == Magic
+}
+
+// Client starts a connection opened by the node. It sends the magic and the local handshake, and waits for the handshake of the peer
+func Client(conn net.Conn, local Handshake) (*Conn, error) {
+
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn)}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte(Magic)); err != nil {
+		return nil, err
+	}
+
+	if err := c.WriteMessage(local); err != nil {
+		return nil, err
+	}
+
+	if err := c.readHandshake(local); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Server starts a connection accepted by the node. It waits for the magic and the handshake of the peer, and answers with the local handshake.
+// The reader must buffer the connection if its first bytes are peeked
+func Server(conn net.Conn, reader *bufio.Reader, local Handshake) (*Conn, error) {
+
+	c := &Conn{conn: conn, reader: reader}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(c.reader, magic); err != nil {
+		return nil, err
+	}
+
+	if string(magic) != Magic {
+		return nil, ErrInvalidMagic
+	}
+
+	if err := c.readHandshake(local); err != nil {
+		return nil, err
+	}
+
+	if err := c.WriteMessage(local); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readHandshake reads the handshake of the peer, and rejects it if the version or the config hash do not match the local handshake
+func (c *Conn) readHandshake(local Handshake) error {
+
+	m, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	switch m := m.(type) {
+
+	case Reject:
+		return fmt.Errorf("%w: %s", ErrRejected, m.Reason)
+
+	case Handshake:
+		if m.Version != local.Version {
+			c.reject(fmt.Sprintf("protocol version %d is not supported, expected version %d", m.Version, local.Version))
+			return fmt.Errorf("%w: %d", ErrUnsupportedVersion, m.Version)
+		}
+
+		if !bytes.Equal(m.ConfigHash, local.ConfigHash) {
+			c.reject("config hash does not match")
+			return ErrConfigMismatch
+		}
+
+		c.peer = m
+		return nil
+
+	default:
+		c.reject("first message is not a handshake")
+		return ErrUnexpectedMessage
+	}
+}
+
+func (c *Conn) reject(reason string) {
+
+	c.WriteMessage(Reject{Reason: reason})
+}
+
+// Peer returns the handshake of the peer
+func (c *Conn) Peer() Handshake {
+
+	return c.peer
+}
+
+// SetWriteTimeout sets the time each message write can take, so a peer that stops reading does not block the writers.
+// The connection can not be used after a write times out
+func (c *Conn) SetWriteTimeout(timeout time.Duration) {
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.writeTimeout = timeout
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+
+	return c.conn.RemoteAddr()
+}
+
+// WriteMessage writes a message in a single frame
+func (c *Conn) WriteMessage(m Message) error {
+
+	payload := EncodeMessage(m)
+	if len(payload)+1 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)+1))
+	frame[4] = byte(m.Type())
+	copy(frame[5:], payload)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// ReadMessage reads the next frame, and decodes its message
+func (c *Conn) ReadMessage() (Message, error) {
+
+	var header [5]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length == 0 {
+		return nil, errors.New("frame does not have a message type")
+	}
+
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return nil, err
+	}
+
+	return DecodeMessage(MessageType(header[4]), payload)
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+
+	return c.conn.Close()
+}
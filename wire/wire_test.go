@@ -0,0 +1,186 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/korkmazkadir/bitcoin/common"
+)
+
+func TestMessageEncoding(t *testing.T) {
+
+	block := common.Block{Issuer: []byte("issuer"), PrevBlockHashes: [][]byte{[]byte("parent")}, Height: 3, Nonce: 7, Signature: []byte("signature")}
+	block.SetPayload(common.EncodeTransactions(nil))
+
+	tx := common.Transaction{Outputs: []common.TxOutput{{Value: 5, PublicKey: []byte("key")}}}
+
+	messages := []Message{
+		Handshake{Version: ProtocolVersion, NodeID: 4, ConfigHash: []byte("config"), TipHeight: 9, TipHashes: [][]byte{[]byte("a"), []byte("b")}, PortNumber: 3000},
+		Reject{Reason: "reason"},
+		Ping{Nonce: 42},
+		Pong{Nonce: 42},
+		Block{Block: block},
+		Transactions{Transactions: []common.Transaction{tx}},
+		Announce{Height: 9, Hashes: [][]byte{[]byte("a")}},
+		Request{Hashes: [][]byte{[]byte("a"), []byte("b")}},
+	}
+
+	for _, m := range messages {
+
+		decoded, err := DecodeMessage(m.Type(), EncodeMessage(m))
+		if err != nil {
+			t.Errorf("could not decode %s message: %s", m.Type(), err)
+			continue
+		}
+
+		if m.Type() == MessageBlock {
+			if !reflect.DeepEqual(decoded.(Block).Block.Hash(), block.Hash()) {
+				t.Errorf("decoded block is different")
+			}
+			continue
+		}
+
+		if m.Type() == MessageTransactions {
+			if !reflect.DeepEqual(decoded.(Transactions).Transactions[0].Hash(), tx.Hash()) {
+				t.Errorf("decoded transaction is different")
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("decoded %s message is different: %v, expected %v", m.Type(), decoded, m)
+		}
+	}
+
+	if _, err := DecodeMessage(MessageType(200), nil); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("expected %v, got %v", ErrUnknownMessageType, err)
+	}
+}
+
+// handshake runs the client and the server side of a connection, and returns their errors
+func handshake(client Handshake, server Handshake) (*Conn, error, *Conn, error) {
+
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+
+	serverResult := make(chan result, 1)
+	go func() {
+		conn, err := Server(serverConn, bufio.NewReader(serverConn), server)
+		if err != nil {
+			serverConn.Close()
+		}
+		serverResult <- result{conn, err}
+	}()
+
+	conn, err := Client(clientConn, client)
+	if err != nil {
+		clientConn.Close()
+	}
+
+	r := <-serverResult
+	return conn, err, r.conn, r.err
+}
+
+func TestHandshake(t *testing.T) {
+
+	local := Handshake{Version: ProtocolVersion, NodeID: 1, ConfigHash: []byte("config"), TipHeight: 3, TipHashes: [][]byte{[]byte("tip")}}
+	remote := Handshake{Version: ProtocolVersion, NodeID: 2, ConfigHash: []byte("config")}
+
+	client, clientErr, server, serverErr := handshake(local, remote)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+
+	if !reflect.DeepEqual(client.Peer(), remote) || !reflect.DeepEqual(server.Peer(), local) {
+		t.Errorf("peer handshakes are not exchanged")
+	}
+
+	go client.WriteMessage(Ping{Nonce: 1})
+	if m, err := server.ReadMessage(); err != nil || m != (Ping{Nonce: 1}) {
+		t.Errorf("expected a ping, got %v, %v", m, err)
+	}
+
+	client.Close()
+	server.Close()
+
+	// the server rejects an unknown version, and the client learns the reason
+	future := local
+	future.Version = ProtocolVersion + 1
+	_, clientErr, _, serverErr = handshake(future, remote)
+	if !errors.Is(serverErr, ErrUnsupportedVersion) || !errors.Is(clientErr, ErrRejected) {
+		t.Errorf("unknown version is not rejected: %v, %v", clientErr, serverErr)
+	}
+
+	other := remote
+	other.ConfigHash = []byte("other config")
+	_, clientErr, _, serverErr = handshake(local, other)
+	if !errors.Is(serverErr, ErrConfigMismatch) || !errors.Is(clientErr, ErrRejected) {
+		t.Errorf("config mismatch is not rejected: %v, %v", clientErr, serverErr)
+	}
+}
+
+func TestUnknownMessageIsSkipped(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	conn := &Conn{conn: serverConn, reader: bufio.NewReader(serverConn)}
+
+	go func() {
+		// a frame of a message type added by a later version
+		frame := []byte{0, 0, 0, 3, 200, 1, 2}
+		clientConn.Write(frame)
+
+		writer := &Conn{conn: clientConn}
+		writer.WriteMessage(Pong{Nonce: 5})
+	}()
+
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("expected %v, got %v", ErrUnknownMessageType, err)
+	}
+
+	if m, err := conn.ReadMessage(); err != nil || m != (Pong{Nonce: 5}) {
+		t.Errorf("expected the message after the unknown frame, got %v, %v", m, err)
+	}
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[0:4], MaxFrameSize+1)
+	go clientConn.Write(header[:])
+	if _, err := conn.ReadMessage(); err != ErrFrameTooLarge {
+		t.Errorf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// the peer does not read the connection
+	conn := &Conn{conn: clientConn, reader: bufio.NewReader(clientConn)}
+	conn.SetWriteTimeout(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteMessage(Ping{Nonce: 1})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("write to a peer that does not read succeeds")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write does not time out")
+	}
+}